@@ -1,5 +1,10 @@
 package sdsshared
 
+import (
+	"context"
+	"time"
+)
+
 //DataResource is the interface each Resource service uses and is a central library unit used for a centralised server facility that handles JWT checking centrally.
 type DataResource interface {
 	Startup() error
@@ -11,13 +16,71 @@ type DataResource interface {
 	Shutdown() error
 }
 
+//ContextDataResource is the context-aware form of DataResource. Each method receives a
+// context that is cancelled when the calling request ends or the server shuts down, so
+// slow database scans and dataset downloads can be abandoned early.
+type ContextDataResource interface {
+	StartupContext(context.Context) error
+	UpdateDatasetContext(context.Context) (VersionManager, error)
+	//RetrieveContext is Retrieve with a context. See DataResource.Retrieve
+	RetrieveContext(context.Context, string, map[string]string) (SimpleData, error)
+	ShutdownContext(context.Context) error
+}
+
+//WithContext returns dr as a ContextDataResource. Implementations that already satisfy
+// ContextDataResource are returned as they are, others are wrapped in an adapter so
+// existing DataResource implementations keep working unchanged.
+func WithContext(dr DataResource) ContextDataResource {
+	if cdr, ok := dr.(ContextDataResource); ok {
+		return cdr
+	}
+	return contextAdapter{dr}
+}
+
+//contextAdapter lets a plain DataResource be used where a ContextDataResource is needed.
+// The context is checked before each call but cannot interrupt a call once it has started.
+type contextAdapter struct {
+	DataResource
+}
+
+func (ca contextAdapter) StartupContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ca.Startup()
+}
+
+func (ca contextAdapter) UpdateDatasetContext(ctx context.Context) (VersionManager, error) {
+	if err := ctx.Err(); err != nil {
+		return VersionManager{}, err
+	}
+	return ca.UpdateDataset()
+}
+
+func (ca contextAdapter) RetrieveContext(ctx context.Context, term string, args map[string]string) (SimpleData, error) {
+	if err := ctx.Err(); err != nil {
+		return SimpleData{}, err
+	}
+	return ca.Retrieve(term, args)
+}
+
+func (ca contextAdapter) ShutdownContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ca.Shutdown()
+}
+
 //SimpleData is the standard response interface to the end user. Data resources should return
 type SimpleData struct {
 	ResultCount    int               `json:"result_count"`
 	RequestOptions map[string]string `json:"request_options,omitempty"`
 	Meta           Meta              `json:"meta"`
 	Data           DataOutput        `json:"data"`
-	Errors         map[string]string `json:"errors,omitempty"`
+	//NextCursor is set when there are more results. Pass it as the cursor option to get
+	// the next page
+	NextCursor string            `json:"next_cursor,omitempty"`
+	Errors     map[string]string `json:"errors,omitempty"`
 }
 
 //Meta is the SimpleData componant with meta data on the datasource being queried
@@ -43,6 +106,15 @@ type VersionManager struct {
 	LastUpdated string `json:"dataset_updated"`
 	//List of initial data sources gained from last update from repo
 	DataSources []string `json:"data_sources"`
+	//Revision is the source revision token, such as an ETag or object generation, of the
+	// archive the dataset was loaded from. See DatasetProber
+	Revision string `json:"revision,omitempty"`
+	//SHA256 is the hex encoded SHA-256 digest of the dataset archive. Used to verify
+	// downloads when set in a dataset manifest
+	SHA256 string `json:"sha256,omitempty"`
+	//Signature is the base64 encoded Ed25519 signature of the raw SHA-256 digest of the
+	// dataset archive, checked against DatasetPublicKey
+	Signature string `json:"signature,omitempty"`
 }
 
 func (vt *VersionManager) UpdateDataset(dr DataResource) error {
@@ -56,6 +128,29 @@ func (vt *VersionManager) UpdateDataset(dr DataResource) error {
 	return nil
 }
 
+//DatasetGeneration is a dataset kept by a data resource so that it can be rolled back to
+type DatasetGeneration struct {
+	//Generation numbers datasets in the order they were loaded
+	Generation int `json:"generation"`
+	//Current is true for the generation in use
+	Current bool `json:"current"`
+	//CreatedAt is when the generation was loaded
+	CreatedAt time.Time `json:"created_at"`
+	//Dataset is the version information of the generation
+	Dataset VersionManager `json:"dataset"`
+}
+
+//Rollbacker is implemented by data resources that keep previous datasets and can switch
+// back to one, for example after a bad update. The server serves it at /rollback
+type Rollbacker interface {
+	//Generations lists the kept dataset generations, oldest first
+	Generations() []DatasetGeneration
+	//Rollback puts a kept generation back in use in place of the current one and returns
+	// its version information. A generation of -1 selects the newest generation older than
+	// the current one
+	Rollback(ctx context.Context, generation int) (VersionManager, error)
+}
+
 //DataResourceImplementorTemplate is a simple outline of the basic structure that can
 // implement the full DataResource interface. See `badgerdb` for best practise
 type DataResourceImplementorTemplate struct {
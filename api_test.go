@@ -0,0 +1,95 @@
+package sdsshared
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+//plainResource is a DataResource counting the calls to each method
+type plainResource struct {
+	startups, updates, retrieves, shutdowns int
+}
+
+func (pr *plainResource) Startup() error {
+	pr.startups++
+	return nil
+}
+
+func (pr *plainResource) UpdateDataset() (VersionManager, error) {
+	pr.updates++
+	return VersionManager{CurrentVersion: "1"}, nil
+}
+
+func (pr *plainResource) Retrieve(term string, options map[string]string) (SimpleData, error) {
+	pr.retrieves++
+	return SimpleData{ResultCount: 1, Data: DataOutput{Values: term}}, nil
+}
+
+func (pr *plainResource) Shutdown() error {
+	pr.shutdowns++
+	return nil
+}
+
+//dualResource implements both DataResource and ContextDataResource
+type dualResource struct {
+	plainResource
+	blockingResource
+}
+
+func TestWithContext(t *testing.T) {
+	dual := &dualResource{}
+	if got := WithContext(dual); got != ContextDataResource(dual) {
+		t.Errorf("WithContext wrapped a ContextDataResource: %#v", got)
+	}
+
+	pr := &plainResource{}
+	cdr := WithContext(pr)
+	ca, ok := cdr.(contextAdapter)
+	if !ok || ca.DataResource != pr {
+		t.Fatalf("WithContext(%#v) = %#v, want an adapter around it", pr, cdr)
+	}
+	if s := newTestServer(cdr); s.underlying() != pr {
+		t.Errorf("server sees %#v through the adapter, want the wrapped resource", s.underlying())
+	}
+
+	ctx := context.Background()
+	if err := cdr.StartupContext(ctx); err != nil {
+		t.Errorf("StartupContext: %v", err)
+	}
+	if vm, err := cdr.UpdateDatasetContext(ctx); err != nil || vm.CurrentVersion != "1" {
+		t.Errorf("UpdateDatasetContext = %+v, %v", vm, err)
+	}
+	if data, err := cdr.RetrieveContext(ctx, "term", nil); err != nil || data.Data.Values != "term" {
+		t.Errorf("RetrieveContext = %+v, %v", data, err)
+	}
+	if err := cdr.ShutdownContext(ctx); err != nil {
+		t.Errorf("ShutdownContext: %v", err)
+	}
+	if pr.startups != 1 || pr.updates != 1 || pr.retrieves != 1 || pr.shutdowns != 1 {
+		t.Errorf("calls passed through %+v, want one of each", *pr)
+	}
+}
+
+func TestContextAdapterCancelled(t *testing.T) {
+	pr := &plainResource{}
+	cdr := WithContext(pr)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := cdr.StartupContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("StartupContext = %v, want context.Canceled", err)
+	}
+	if _, err := cdr.UpdateDatasetContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("UpdateDatasetContext = %v, want context.Canceled", err)
+	}
+	if _, err := cdr.RetrieveContext(ctx, "term", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("RetrieveContext = %v, want context.Canceled", err)
+	}
+	if err := cdr.ShutdownContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("ShutdownContext = %v, want context.Canceled", err)
+	}
+	if *pr != (plainResource{}) {
+		t.Errorf("cancelled calls reached the resource: %+v", *pr)
+	}
+}
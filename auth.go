@@ -0,0 +1,364 @@
+package sdsshared
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Supported JWT signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+//Authenticator verifies JWT bearer tokens for the server routes. Tokens must be signed
+// with HS256, RS256 or ES256 by a key from Keys, must not be expired and must match
+// Issuer and Audience when those are set
+type Authenticator struct {
+	//Keys provides the signature verification keys
+	Keys KeySource
+	//Issuer is the required `iss` claim. Not checked if empty
+	Issuer string
+	//Audience must be one of the `aud` claim values. Not checked if empty
+	Audience string
+	//Leeway is the allowed clock skew when checking `exp` and `nbf`
+	Leeway time.Duration
+}
+
+//KeySource provides the keys used to verify JWT signatures
+type KeySource interface {
+	//VerificationKey returns the key for the token header `kid` and `alg` values.
+	// HS256 keys are []byte, RS256 keys *rsa.PublicKey and ES256 keys *ecdsa.PublicKey
+	VerificationKey(ctx context.Context, kid, alg string) (interface{}, error)
+}
+
+//keyLoader is implemented by key sources that can load their keys up front so that
+// misconfiguration is found at server start rather than on the first request
+type keyLoader interface {
+	Load(ctx context.Context) error
+}
+
+//Claims are the verified claims of a JWT
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	//Scope is the space separated OAuth2 scope claim
+	Scope string `json:"scope,omitempty"`
+	//Scp is the scope claim as issued by some providers, a list or space separated string
+	Scp scopeList `json:"scp,omitempty"`
+}
+
+//HasScope reports whether the token was granted scope
+func (c Claims) HasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	for _, s := range c.Scp {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//audience is the aud claim, a single StringOrURI or a list of them (RFC 7519 4.1.3)
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+//scopeList is a scope claim that may be a space separated string or a list of strings
+type scopeList []string
+
+func (s *scopeList) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*s = strings.Fields(single)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+type claimsKey struct{}
+
+//ClaimsFromContext returns the verified token claims stored by the authentication
+// middleware in a request context
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsKey{}).(*Claims)
+	return c, ok
+}
+
+//jwtHeader is the JOSE header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+//Verify checks the token signature and its registered claims and returns the claims
+func (a *Authenticator) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	header := jwtHeader{}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	key, err := a.Keys.VerificationKey(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %v", err)
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+//checkClaims validates the time, issuer and audience claims
+func (a *Authenticator) checkClaims(c *Claims) error {
+	now := time.Now()
+	if c.ExpiresAt == 0 {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(c.ExpiresAt, 0).Add(a.Leeway)) {
+		return errors.New("token has expired")
+	}
+	if c.NotBefore != 0 && now.Add(a.Leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if a.Issuer != "" && c.Issuer != a.Issuer {
+		return errors.New("token issuer not accepted")
+	}
+	if a.Audience != "" {
+		for _, aud := range c.Audience {
+			if aud == a.Audience {
+				return nil
+			}
+		}
+		return errors.New("token audience not accepted")
+	}
+	return nil
+}
+
+//verifySignature checks sig over signed using key. The key type must match alg so that
+// a public key can never be used as an HMAC secret
+func verifySignature(alg string, key interface{}, signed, sig []byte) error {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case AlgHS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("key type does not match token algorithm")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("invalid token signature")
+		}
+	case AlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match token algorithm")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return errors.New("invalid token signature")
+		}
+	case AlgES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match token algorithm")
+		}
+		if len(sig) != 64 {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("token algorithm %q not supported", alg)
+	}
+	return nil
+}
+
+//Require returns middleware that rejects requests without a valid bearer token granting
+// every one of scopes. Rejections are written in the standard SimpleData error shape
+func (a *Authenticator) Require(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authz := r.Header.Get("Authorization")
+			if len(authz) < 7 || !strings.EqualFold(authz[:7], "Bearer ") {
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				writeResourceError(w, "Unauthorised", NewError(ErrUnauthorised, "bearer token required"))
+				return
+			}
+			claims, err := a.Verify(r.Context(), strings.TrimSpace(authz[7:]))
+			if errors.Is(err, ErrKeysUnavailable) {
+				//the cause, such as the key server address, is for the logs only
+				log.Printf("Could not verify bearer token: %v", err)
+				writeResourceError(w, "Service unavailable", NewError(ErrKeysUnavailable, "try again later"))
+				return
+			}
+			if err != nil {
+				if DebugMode {
+					log.Printf("Rejected bearer token: %v", err)
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeResourceError(w, "Unauthorised", WrapError(ErrUnauthorised, err))
+				return
+			}
+			for _, scope := range scopes {
+				if !claims.HasScope(scope) {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(scopes, " ")))
+					writeResourceError(w, "Forbidden", NewError(ErrForbidden, "token lacks required scope %q", scope))
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+		})
+	}
+}
+
+//NewAuthenticatorFromSettings builds an Authenticator from the jwt_* settings. It returns
+// nil if neither JWTKeyFile nor JWTJWKSURI is set, meaning authentication is disabled
+func NewAuthenticatorFromSettings() *Authenticator {
+	var keys KeySource
+	switch {
+	case JWTJWKSURI != "":
+		keys = &JWKS{URI: JWTJWKSURI}
+	case JWTKeyFile != "":
+		keys = &KeyFile{Path: JWTKeyFile}
+	default:
+		return nil
+	}
+	return &Authenticator{
+		Keys:     keys,
+		Issuer:   JWTIssuer,
+		Audience: JWTAudience,
+		Leeway:   30 * time.Second,
+	}
+}
+
+//KeyFile is a KeySource with a single key read from a local file. A PEM encoded public
+// key or certificate is used for RS256 or ES256, anything else is used as an HS256 secret
+type KeyFile struct {
+	Path string
+
+	once sync.Once
+	key  interface{}
+	err  error
+}
+
+//Load reads and parses the key file
+func (kf *KeyFile) Load(ctx context.Context) error {
+	kf.once.Do(func() {
+		raw, err := os.ReadFile(kf.Path)
+		if err != nil {
+			kf.err = WrapError(ErrKeysUnavailable, fmt.Errorf("Error reading JWT key file: %v", err))
+			return
+		}
+		if kf.key, err = parseKey(raw); err != nil {
+			kf.err = WrapError(ErrKeysUnavailable, err)
+		}
+	})
+	return kf.err
+}
+
+//VerificationKey implements KeySource
+func (kf *KeyFile) VerificationKey(ctx context.Context, kid, alg string) (interface{}, error) {
+	if err := kf.Load(ctx); err != nil {
+		return nil, err
+	}
+	return kf.key, nil
+}
+
+//parseKey parses a PEM public key or certificate, or returns raw as an HMAC secret
+func parseKey(raw []byte) (interface{}, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		secret := []byte(strings.TrimSpace(string(raw)))
+		if len(secret) == 0 {
+			return nil, errors.New("JWT key file is empty")
+		}
+		return secret, nil
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing JWT key certificate: %v", err)
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing JWT public key: %v", err)
+		}
+		return pub, nil
+	}
+}
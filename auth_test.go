@@ -0,0 +1,335 @@
+package sdsshared
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//staticKeys is a KeySource returning the same key for every token
+type staticKeys struct {
+	key interface{}
+	err error
+}
+
+func (sk staticKeys) VerificationKey(ctx context.Context, kid, alg string) (interface{}, error) {
+	return sk.key, sk.err
+}
+
+//testKeys are signing keys shared by the tests
+var testKeys struct {
+	once   sync.Once
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+}
+
+func loadTestKeys(t *testing.T) {
+	t.Helper()
+	testKeys.once.Do(func() {
+		testKeys.secret = []byte("test secret")
+		var err error
+		if testKeys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+		if testKeys.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+//signToken returns a JWT of claims with the given header, signed for alg with key
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+//validClaims returns claims accepted by testAuthenticator, with changes applied
+func validClaims(changes map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":   "https://issuer.example",
+		"aud":   "sds",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "data:read",
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func testAuthenticator(keys KeySource) *Authenticator {
+	return &Authenticator{Keys: keys, Issuer: "https://issuer.example", Audience: "sds"}
+}
+
+func TestVerify(t *testing.T) {
+	loadTestKeys(t)
+	hs := staticKeys{key: testKeys.secret}
+	rs := staticKeys{key: &testKeys.rsa.PublicKey}
+	es := staticKeys{key: &testKeys.ec.PublicKey}
+
+	tests := []struct {
+		name  string
+		keys  KeySource
+		token string
+		ok    bool
+	}{
+		{"HS256", hs, signToken(t, AlgHS256, "", testKeys.secret, validClaims(nil)), true},
+		{"RS256", rs, signToken(t, AlgRS256, "", testKeys.rsa, validClaims(nil)), true},
+		{"ES256", es, signToken(t, AlgES256, "", testKeys.ec, validClaims(nil)), true},
+		{"audience list", hs, signToken(t, AlgHS256, "", testKeys.secret, validClaims(map[string]interface{}{"aud": []string{"other", "sds"}})), true},
+		{"alg none", hs, signToken(t, "none", "", nil, validClaims(nil)), false},
+		{"HS256 token for RSA key", rs, signToken(t, AlgHS256, "", []byte("not the key"), validClaims(nil)), false},
+		{"RS256 token for HMAC secret", hs, signToken(t, AlgRS256, "", testKeys.rsa, validClaims(nil)), false},
+		{"ES256 token for RSA key", rs, signToken(t, AlgES256, "", testKeys.ec, validClaims(nil)), false},
+		{"wrong secret", hs, signToken(t, AlgHS256, "", []byte("wrong"), validClaims(nil)), false},
+		{"expired", hs, signToken(t, AlgHS256, "", testKeys.secret, validClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), false},
+		{"no expiry", hs, signToken(t, AlgHS256, "", testKeys.secret, validClaims(map[string]interface{}{"exp": nil})), false},
+		{"not yet valid", hs, signToken(t, AlgHS256, "", testKeys.secret, validClaims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), false},
+		{"wrong issuer", hs, signToken(t, AlgHS256, "", testKeys.secret, validClaims(map[string]interface{}{"iss": "https://evil.example"})), false},
+		{"wrong audience", hs, signToken(t, AlgHS256, "", testKeys.secret, validClaims(map[string]interface{}{"aud": "other"})), false},
+		//aud is a single StringOrURI, not a space separated list
+		{"audience with spaces", hs, signToken(t, AlgHS256, "", testKeys.secret, validClaims(map[string]interface{}{"aud": "other sds"})), false},
+		{"malformed", hs, "not.a.token.at.all", false},
+	}
+	for _, tt := range tests {
+		_, err := testAuthenticator(tt.keys).Verify(context.Background(), tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Verify gave %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		claims string
+		ok     bool
+	}{
+		{`{"scope":"data:read data:write"}`, true},
+		{`{"scp":"data:write data:read"}`, true},
+		{`{"scp":["data:read"]}`, true},
+		{`{"scope":"data:readonly"}`, false},
+		{`{}`, false},
+	}
+	for _, tt := range tests {
+		var c Claims
+		if err := json.Unmarshal([]byte(tt.claims), &c); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.HasScope("data:read"); got != tt.ok {
+			t.Errorf("%s HasScope = %v, want %v", tt.claims, got, tt.ok)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	loadTestKeys(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, found := ClaimsFromContext(r.Context()); !found {
+			t.Error("no claims in the request context")
+		}
+	})
+	good := signToken(t, AlgHS256, "", testKeys.secret, validClaims(nil))
+	tests := []struct {
+		name   string
+		keys   KeySource
+		authz  string
+		status int
+	}{
+		{"valid", staticKeys{key: testKeys.secret}, "Bearer " + good, http.StatusOK},
+		{"no token", staticKeys{key: testKeys.secret}, "", http.StatusUnauthorized},
+		{"bad token", staticKeys{key: testKeys.secret}, "Bearer " + signToken(t, AlgHS256, "", []byte("wrong"), validClaims(nil)), http.StatusUnauthorized},
+		{"missing scope", staticKeys{key: testKeys.secret}, "Bearer " + signToken(t, AlgHS256, "", testKeys.secret, validClaims(map[string]interface{}{"scope": "other"})), http.StatusForbidden},
+		{"keys unavailable", staticKeys{err: WrapError(ErrKeysUnavailable, errors.New("dial tcp https://idp.internal/jwks: connection refused"))}, "Bearer " + good, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		h := testAuthenticator(tt.keys).Require("data:read")(ok)
+		r := httptest.NewRequest(http.MethodGet, "/fetch", nil)
+		if tt.authz != "" {
+			r.Header.Set("Authorization", tt.authz)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if strings.Contains(w.Body.String(), "idp.internal") {
+			t.Errorf("%s: response leaks the key source error: %s", tt.name, w.Body)
+		}
+	}
+}
+
+//jwkFor returns the public JWK of an RSA or EC private key
+func jwkFor(kid string, key interface{}) map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "alg": AlgRS256, "n": enc(k.N.Bytes()), "e": enc(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PrivateKey:
+		return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": enc(k.X.Bytes()), "y": enc(k.Y.Bytes())}
+	}
+	return nil
+}
+
+//jwksServer serves a key set that tests can change or break
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    []map[string]string
+	failing bool
+	fetches int
+}
+
+func newJWKSServer(keys ...map[string]string) *jwksServer {
+	js := &jwksServer{keys: keys}
+	js.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		js.mu.Lock()
+		defer js.mu.Unlock()
+		js.fetches++
+		if js.failing {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": js.keys})
+	}))
+	return js
+}
+
+func (js *jwksServer) set(failing bool, keys ...map[string]string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.failing = failing
+	if keys != nil {
+		js.keys = keys
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	loadTestKeys(t)
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//keys of unsupported types are skipped rather than failing the set
+	okp := map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	js := newJWKSServer(okp, jwkFor("k1", testKeys.rsa), jwkFor("e1", testKeys.ec))
+	defer js.Close()
+	jwks := &JWKS{URI: js.URL}
+	a := testAuthenticator(jwks)
+	ctx := context.Background()
+	verify := func(alg, kid string, key interface{}) error {
+		_, err := a.Verify(ctx, signToken(t, alg, kid, key, validClaims(nil)))
+		return err
+	}
+
+	if err := jwks.Load(ctx); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := verify(AlgRS256, "k1", testKeys.rsa); err != nil {
+		t.Errorf("RS256 with k1: %v", err)
+	}
+	if err := verify(AlgES256, "e1", testKeys.ec); err != nil {
+		t.Errorf("ES256 with e1: %v", err)
+	}
+	if err := verify(AlgRS256, "e1", testKeys.rsa); err == nil {
+		t.Error("RS256 token verified with the EC key e1")
+	}
+
+	//the key set is rotated to a new key
+	js.set(false, jwkFor("k2", second))
+	//unknown key ids only cause a fetch once jwksMinRefresh has passed
+	if err := verify(AlgRS256, "k2", second); err == nil {
+		t.Error("k2 verified before the key set could be fetched again")
+	}
+	jwks.mu.Lock()
+	jwks.attempted = time.Now().Add(-2 * jwksMinRefresh)
+	jwks.mu.Unlock()
+	if err := verify(AlgRS256, "k2", second); err != nil {
+		t.Errorf("RS256 with rotated key k2: %v", err)
+	}
+	if err := verify(AlgRS256, "k1", testKeys.rsa); err == nil {
+		t.Error("k1 still verifies after rotation")
+	}
+
+	//stale keys are kept in use while the key server fails
+	js.set(true)
+	jwks.mu.Lock()
+	jwks.fetched = time.Now().Add(-2 * jwksMaxAge)
+	jwks.attempted = jwks.fetched
+	jwks.mu.Unlock()
+	if err := verify(AlgRS256, "k2", second); err != nil {
+		t.Errorf("cached k2 not used while the key server is down: %v", err)
+	}
+
+	//with nothing cached a failing key server makes keys unavailable
+	_, err = (&JWKS{URI: js.URL}).VerificationKey(ctx, "k2", AlgRS256)
+	if !errors.Is(err, ErrKeysUnavailable) {
+		t.Errorf("failing key server gave %v, want ErrKeysUnavailable", err)
+	}
+}
+
+func TestJWKSSharesFetches(t *testing.T) {
+	loadTestKeys(t)
+	js := newJWKSServer(jwkFor("k1", testKeys.rsa))
+	defer js.Close()
+	jwks := &JWKS{URI: js.URL}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := jwks.VerificationKey(context.Background(), "k1", AlgRS256); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.fetches > 2 {
+		t.Errorf("%d concurrent first requests fetched the key set %d times", 20, js.fetches)
+	}
+}
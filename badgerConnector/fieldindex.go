@@ -0,0 +1,99 @@
+package badgerconnector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	sdsshared "github.com/RhythmicSound/sdsshared"
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+//reservedOptions are the /fetch options that are never read as field filters, even for
+// a field of the same name
+var reservedOptions = map[string]bool{
+	"fetch": true, "limit": true, "cursor": true, "offset": true, "order": true,
+	"since": true, "until": true, "fields": true, "format": true, "stream": true,
+	"match": true, "distance": true, "near": true, "radius": true, "bbox": true,
+	"q": true, "op": true, "records": true,
+}
+
+//fieldIndex returns the name of the index on a value field
+func fieldIndex(field string) string {
+	return "field:" + field
+}
+
+//fieldToken returns the indexed form of a field value: trimmed and upper cased, so that
+// filters ignore case
+func fieldToken(v string) string {
+	return strings.ToUpper(strings.TrimSpace(strings.ReplaceAll(v, "\x00", "")))
+}
+
+//fieldTokens returns the indexed forms of a decoded field value. Strings, numbers and
+// bools are indexed, as is each of those in a list; objects and nulls are not
+func fieldTokens(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{fieldToken(v)}
+	case json.Number, bool, int64, uint64, float64:
+		return []string{fieldToken(fmt.Sprint(v))}
+	case []interface{}:
+		var tokens []string
+		for _, elem := range v {
+			if _, nested := elem.([]interface{}); !nested {
+				tokens = append(tokens, fieldTokens(elem)...)
+			}
+		}
+		return tokens
+	}
+	return nil
+}
+
+//fieldFilters returns the field=value options of q on fields indexed by schema, as field
+// to indexed value
+func fieldFilters(q sdsshared.Query, schema sdsshared.ValueSchema) map[string]string {
+	filters := make(map[string]string)
+	for _, field := range schema.Indexes {
+		if v, ok := q.Options[field]; ok && !reservedOptions[field] {
+			filters[field] = fieldToken(v)
+		}
+	}
+	return filters
+}
+
+//filterKeys returns the record keys, in order, of the records matching every filter
+func filterKeys(txn *badger.Txn, filters map[string]string) [][]byte {
+	var keys [][]byte
+	first := true
+	for field, token := range filters {
+		targets := indexTargets(txn, fieldIndex(field), token)
+		if first {
+			keys, first = targets, false
+		} else {
+			keys = intersectKeys(keys, targets)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+	}
+	return keys
+}
+
+//intersectKeys returns the keys in both sorted lists
+func intersectKeys(a, b [][]byte) [][]byte {
+	var out [][]byte
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch c := bytes.Compare(a[i], b[j]); {
+		case c < 0:
+			i++
+		case c > 0:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
@@ -0,0 +1,362 @@
+package badgerconnector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	sdsshared "github.com/RhythmicSound/sdsshared"
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+//generationsFile is the name of the generation metadata file, stored with the prefix
+// sdsshared.DBURI like the generation databases themselves
+const generationsFile = "generations.json"
+
+//generations is the persisted record of the databases built from dataset archives. Each
+// one lives in the directory sdsshared.DBURI suffixed with its generation number
+type generations struct {
+	//Current is the generation in use, -1 if none has been loaded
+	Current int `json:"current"`
+	//Next is the number the next generation gets
+	Next int `json:"next"`
+	//Kept lists the generations on disk, oldest first
+	Kept []sdsshared.DatasetGeneration `json:"generations"`
+	//Started lists generations whose directories were created but that have not yet been
+	// kept or removed. Only these are ever swept as incomplete
+	Started []int `json:"started,omitempty"`
+}
+
+//generationPath returns the database directory of generation n
+func generationPath(n int) string {
+	return fmt.Sprintf("%s%d", sdsshared.DBURI, n)
+}
+
+//loadGenerations reads the generation metadata, starting afresh if there is none
+func loadGenerations() (*generations, error) {
+	gens := &generations{Current: -1}
+	raw, err := os.ReadFile(sdsshared.DBURI + generationsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return gens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, gens); err != nil {
+		return nil, fmt.Errorf("Error reading generation metadata %s: %v", sdsshared.DBURI+generationsFile, err)
+	}
+	return gens, nil
+}
+
+//save writes the generation metadata, replacing the old file in one step so a crash
+// cannot leave it half written
+func (g *generations) save() error {
+	raw, err := json.MarshalIndent(g, "", " ")
+	if err != nil {
+		return err
+	}
+	target := sdsshared.DBURI + generationsFile
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(target+".tmp", raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(target+".tmp", target)
+}
+
+//copy returns a deep enough copy of g to save outside the lock
+func (g *generations) copy() *generations {
+	c := *g
+	c.Kept = append([]sdsshared.DatasetGeneration(nil), g.Kept...)
+	c.Started = append([]int(nil), g.Started...)
+	return &c
+}
+
+//find returns the index of generation n in Kept, or -1
+func (g *generations) find(n int) int {
+	for i, gen := range g.Kept {
+		if gen.Generation == n {
+			return i
+		}
+	}
+	return -1
+}
+
+//start allocates the next generation number and records it as started. The metadata
+// must be saved before the generation's directory is created
+func (g *generations) start() int {
+	n := g.Next
+	g.Next++
+	g.Started = append(g.Started, n)
+	return n
+}
+
+//finish forgets that generation n was started, once it has been kept or removed
+func (g *generations) finish(n int) {
+	started := g.Started[:0]
+	for _, s := range g.Started {
+		if s != n {
+			started = append(started, s)
+		}
+	}
+	g.Started = started
+}
+
+//add records generation n holding dataset as the current generation
+func (g *generations) add(n int, dataset sdsshared.VersionManager) {
+	g.Kept = append(g.Kept, sdsshared.DatasetGeneration{
+		Generation: n,
+		CreatedAt:  time.Now(),
+		Dataset:    dataset,
+	})
+	g.Current = n
+	g.finish(n)
+}
+
+//prune drops the oldest generations until at most keep remain, never dropping the
+// current one, and returns the numbers of those dropped
+func (g *generations) prune(keep int) []int {
+	var dropped []int
+	for i := 0; len(g.Kept)-len(dropped) > keep && i < len(g.Kept); i++ {
+		if g.Kept[i].Generation != g.Current {
+			dropped = append(dropped, g.Kept[i].Generation)
+		}
+	}
+	kept := g.Kept[:0]
+	for _, gen := range g.Kept {
+		if !containsInt(dropped, gen.Generation) {
+			kept = append(kept, gen)
+		}
+	}
+	g.Kept = kept
+	return dropped
+}
+
+//previous returns the newest kept generation older than the current one
+func (g *generations) previous() (sdsshared.DatasetGeneration, bool) {
+	for i := len(g.Kept) - 1; i >= 0; i-- {
+		if g.Kept[i].Generation < g.Current {
+			return g.Kept[i], true
+		}
+	}
+	return sdsshared.DatasetGeneration{}, false
+}
+
+//rolledBackFrom returns a generation newer than the current one, so one that was rolled
+// back from, holding a dataset at least as new as the one described by latest
+func (g *generations) rolledBackFrom(latest sdsshared.DatasetProbe) (sdsshared.DatasetGeneration, bool) {
+	for _, gen := range g.Kept {
+		if gen.Generation > g.Current && !latest.NeedsUpdate(gen.Dataset) {
+			return gen, true
+		}
+	}
+	return sdsshared.DatasetGeneration{}, false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+//removeGeneration deletes the database directory of generation n
+func removeGeneration(n int) {
+	if err := os.RemoveAll(generationPath(n)); err != nil {
+		log.Printf("Error removing dataset generation %d: %v", n, err)
+	}
+}
+
+//removeStaleGenerations deletes the generations recorded as started but never kept, left
+// behind by an update or startup that failed part way through. Directories the metadata
+// has no record of are never touched, as sdsshared.DBURI may share its location with
+// other files
+func (g *generations) removeStaleGenerations() {
+	for _, n := range g.Started {
+		if g.find(n) >= 0 {
+			continue
+		}
+		log.Printf("Removing incomplete dataset generation %d", n)
+		removeGeneration(n)
+	}
+	g.Started = nil
+}
+
+//reuseGeneration mounts the current generation recorded in gens if it finished loading,
+// holds the recorded dataset version and came from the configured dataset location. It
+// reports whether it did. A current generation failing the checks is dropped
+func (pal *Palawan) reuseGeneration(gens *generations) bool {
+	i := gens.find(gens.Current)
+	if i < 0 {
+		return false
+	}
+	recorded := gens.Kept[i]
+	if repo := pal.version().Repo; recorded.Dataset.Repo != repo {
+		log.Printf("Not reusing dataset generation %d: loaded from %s, not %s", recorded.Generation, recorded.Dataset.Repo, repo)
+		return false
+	}
+	db, err := pal.Open(generationPath(recorded.Generation))
+	if err != nil {
+		log.Printf("Not reusing dataset generation %d: %v", recorded.Generation, err)
+		return false
+	}
+	vs, schema, err := checkGeneration(db, recorded.Dataset)
+	if err != nil {
+		log.Printf("Not reusing dataset generation %d, removing it: %v", recorded.Generation, err)
+		db.Close()
+		gens.Kept = append(gens.Kept[:i], gens.Kept[i+1:]...)
+		gens.Current = -1
+		removeGeneration(recorded.Generation)
+		return false
+	}
+	vs.Revision = recorded.Dataset.Revision
+
+	pal.mu.Lock()
+	pal.gens = gens
+	pal.db = pal.newHandle(db, recorded.Generation, schema)
+	pal.setVersioner(vs)
+	pal.mu.Unlock()
+	log.Printf("Serving dataset generation %d (version %s) loaded before restart", recorded.Generation, vs.CurrentVersion)
+	return true
+}
+
+//checkGeneration checks db finished loading, holds the dataset described by recorded and
+// has indexes built under the current settings, returning the version data and value
+// schema it holds
+func checkGeneration(db *badger.DB, recorded sdsshared.VersionManager) (sdsshared.VersionManager, sdsshared.ValueSchema, error) {
+	none := sdsshared.ValueSchema{}
+	if err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(loadedKey))
+		return err
+	}); err != nil {
+		return sdsshared.VersionManager{}, none, fmt.Errorf("no completed load marker: %v", err)
+	}
+	vs, err := deriveVersioner(db)
+	if err != nil {
+		return sdsshared.VersionManager{}, none, fmt.Errorf("could not read _version: %v", err)
+	}
+	if vs.CurrentVersion != recorded.CurrentVersion {
+		return sdsshared.VersionManager{}, none, fmt.Errorf("holds version %q, expected %q", vs.CurrentVersion, recorded.CurrentVersion)
+	}
+	if err := checkIndexes(db); err != nil {
+		return sdsshared.VersionManager{}, none, err
+	}
+	schema, err := deriveSchema(db)
+	if err != nil {
+		return sdsshared.VersionManager{}, none, fmt.Errorf("could not read %s: %v", sdsshared.SchemaKey, err)
+	}
+	return vs, schema, nil
+}
+
+//Generations lists the dataset generations kept on disk, oldest first
+func (pal *Palawan) Generations() []sdsshared.DatasetGeneration {
+	pal.mu.RLock()
+	defer pal.mu.RUnlock()
+	if pal.gens == nil {
+		return nil
+	}
+	out := make([]sdsshared.DatasetGeneration, len(pal.gens.Kept))
+	for i, gen := range pal.gens.Kept {
+		gen.Current = gen.Generation == pal.gens.Current
+		out[i] = gen
+	}
+	return out
+}
+
+//Rollback mounts a kept dataset generation in place of the current one. A generation of
+// -1 selects the newest generation older than the current one.
+//
+//Rollback cannot run alongside an update; it returns an error matching
+// sdsshared.ErrUpdating if one is running. Rolling back does not drop the newer
+// generations, so a later Rollback can move forward again. Until then updates that are
+// not forced treat the dataset rolled back from as already loaded rather than loading
+// it again
+func (pal *Palawan) Rollback(ctx context.Context, generation int) (sdsshared.VersionManager, error) {
+	if !atomic.CompareAndSwapInt32(&pal.updating, 0, 1) {
+		return sdsshared.VersionManager{}, sdsshared.NewError(sdsshared.ErrUpdating, "an update of %s is running", pal.ResourceName)
+	}
+	defer atomic.StoreInt32(&pal.updating, 0)
+
+	pal.mu.RLock()
+	var target sdsshared.DatasetGeneration
+	found := false
+	current := -1
+	if pal.gens != nil {
+		current = pal.gens.Current
+		if generation < 0 {
+			target, found = pal.gens.previous()
+		} else if i := pal.gens.find(generation); i >= 0 {
+			target, found = pal.gens.Kept[i], true
+		}
+	}
+	pal.mu.RUnlock()
+	switch {
+	case !found && generation < 0:
+		return sdsshared.VersionManager{}, sdsshared.NewError(sdsshared.ErrNotFound, "no earlier dataset generation is kept")
+	case !found:
+		return sdsshared.VersionManager{}, sdsshared.NewError(sdsshared.ErrNotFound, "dataset generation %d is not kept", generation)
+	case target.Generation == current:
+		return sdsshared.VersionManager{}, sdsshared.NewError(sdsshared.ErrBadRequest, "dataset generation %d is already in use", generation)
+	}
+	if err := ctx.Err(); err != nil {
+		return sdsshared.VersionManager{}, err
+	}
+
+	//a generation still open for slow readers is locked by badger, so its handle is reused
+	h, err := pal.liveHandle(ctx, target.Generation)
+	if err != nil {
+		return sdsshared.VersionManager{}, err
+	}
+	if h != nil {
+		vs, err := deriveVersioner(h.db)
+		if err != nil {
+			h.release()
+			return sdsshared.VersionManager{}, err
+		}
+		vs.Revision = target.Dataset.Revision
+		if err := pal.swap(h, vs); err != nil {
+			return sdsshared.VersionManager{}, err
+		}
+	} else {
+		db, err := pal.Open(generationPath(target.Generation))
+		if err != nil {
+			return sdsshared.VersionManager{}, fmt.Errorf("Error opening dataset generation %d: %v", target.Generation, err)
+		}
+		if err := pal.mount(db, target.Generation, target.Dataset.Revision); err != nil {
+			db.Close()
+			return sdsshared.VersionManager{}, err
+		}
+	}
+	log.Printf("Rolled back %s to dataset generation %d (version %s)", pal.ResourceName, target.Generation, target.Dataset.CurrentVersion)
+	return pal.version(), nil
+}
+
+//liveHandle returns the handle of generation gen with a reference taken if it is still
+// open, or nil if it is not. A handle whose database is closing is waited for
+func (pal *Palawan) liveHandle(ctx context.Context, gen int) (*dbHandle, error) {
+	for {
+		pal.mu.RLock()
+		h := pal.open[gen]
+		pal.mu.RUnlock()
+		if h == nil {
+			return nil, nil
+		}
+		if h.retain() {
+			return h, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
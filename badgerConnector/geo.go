@@ -0,0 +1,383 @@
+package badgerconnector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	sdsshared "github.com/RhythmicSound/sdsshared"
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+//MaxNearRadius is the largest radius, in metres, a near query can search
+const MaxNearRadius = 100000
+
+//defaultNearRadius is the radius, in metres, of a near query without a radius option
+const defaultNearRadius = 1000
+
+//geohashPrecision is the length of the geohashes records are indexed under. Cells of 12
+// characters are a few centimetres across, so a record's indexed geohash stands in for
+// its coordinates
+const geohashPrecision = 12
+
+//geoMaxCells is the most geohash cells a geo query reads. Queries read the smallest
+// cells that cover their area in this many
+const geoMaxCells = 32
+
+//earthRadius is the mean radius of the Earth in metres
+const earthRadius = 6371008.8
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+//geoQuery is the area searched by the near, radius and bbox options
+type geoQuery struct {
+	//near is set for a near query, for the point lat, lon and radius in metres
+	near             bool
+	lat, lon, radius float64
+	//bbox is set for a bbox query, bounded by south, west, north and east. west is
+	// greater than east for a box crossing the antimeridian
+	bbox                     bool
+	south, west, north, east float64
+}
+
+//parseGeo returns the geo query of q, or nil if it has none. The near option is a point
+// "lat,lon" searched within radius metres and bbox is "south,west,north,east" in decimal
+// degrees
+func parseGeo(q sdsshared.Query) (*geoQuery, error) {
+	near, bbox, radius := q.Options["near"], q.Options["bbox"], q.Options["radius"]
+	if near == "" && bbox == "" {
+		if radius != "" {
+			return nil, sdsshared.NewError(sdsshared.ErrBadRequest, "radius needs a near point")
+		}
+		return nil, nil
+	}
+	g := &geoQuery{}
+	if near != "" {
+		coords, ok := parseCoords(near, 2)
+		if !ok || !validLat(coords[0]) || !validLon(coords[1]) {
+			return nil, sdsshared.NewError(sdsshared.ErrBadRequest, "near must be a point lat,lon in decimal degrees, got %q", near)
+		}
+		g.near, g.lat, g.lon, g.radius = true, coords[0], coords[1], defaultNearRadius
+		if radius != "" {
+			r, err := strconv.ParseFloat(radius, 64)
+			if err != nil || !(r > 0 && r <= MaxNearRadius) {
+				return nil, sdsshared.NewError(sdsshared.ErrBadRequest, "radius must be a number of metres above 0 and at most %d, got %q", MaxNearRadius, radius)
+			}
+			g.radius = r
+		}
+	} else if radius != "" {
+		return nil, sdsshared.NewError(sdsshared.ErrBadRequest, "radius needs a near point")
+	}
+	if bbox != "" {
+		coords, ok := parseCoords(bbox, 4)
+		if !ok || !validLat(coords[0]) || !validLon(coords[1]) || !validLat(coords[2]) || !validLon(coords[3]) || coords[0] > coords[2] {
+			return nil, sdsshared.NewError(sdsshared.ErrBadRequest, "bbox must be south,west,north,east in decimal degrees, got %q", bbox)
+		}
+		g.bbox = true
+		g.south, g.west, g.north, g.east = coords[0], coords[1], coords[2], coords[3]
+	}
+	return g, nil
+}
+
+//parseCoords parses n comma separated numbers
+func parseCoords(s string, n int) ([]float64, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, false
+	}
+	coords := make([]float64, n)
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, false
+		}
+		coords[i] = v
+	}
+	return coords, true
+}
+
+func validLat(lat float64) bool { return lat >= -90 && lat <= 90 }
+
+func validLon(lon float64) bool { return lon >= -180 && lon <= 180 }
+
+//contains reports whether the point lat, lon is within g, returning its distance in
+// metres from the near point
+func (g *geoQuery) contains(lat, lon float64) (float64, bool) {
+	if g.bbox {
+		if lat < g.south || lat > g.north {
+			return 0, false
+		}
+		if g.west <= g.east && (lon < g.west || lon > g.east) {
+			return 0, false
+		}
+		if g.west > g.east && lon < g.west && lon > g.east {
+			return 0, false
+		}
+	}
+	if !g.near {
+		return 0, true
+	}
+	d := haversine(g.lat, g.lon, lat, lon)
+	return d, d <= g.radius
+}
+
+//bounds returns the box to read cells for: the box around the near circle, or the bbox
+func (g *geoQuery) bounds() (south, west, north, east float64) {
+	if !g.near {
+		return g.south, g.west, g.north, g.east
+	}
+	angle := g.radius / earthRadius
+	dLat := angle * 180 / math.Pi
+	south, north = math.Max(g.lat-dLat, -90), math.Min(g.lat+dLat, 90)
+	//near a pole the circle reaches every longitude
+	sinLon := math.Sin(angle) / math.Cos(g.lat*math.Pi/180)
+	if south == -90 || north == 90 || sinLon >= 1 {
+		return south, -180, north, 180
+	}
+	dLon := math.Asin(sinLon) * 180 / math.Pi
+	return south, wrapLon(g.lon - dLon), north, wrapLon(g.lon + dLon)
+}
+
+//wrapLon brings a longitude past the antimeridian back into -180 to 180
+func wrapLon(lon float64) float64 {
+	switch {
+	case lon < -180:
+		return lon + 360
+	case lon > 180:
+		return lon - 360
+	}
+	return lon
+}
+
+//haversine returns the great circle distance in metres between two points
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+//geohashBits returns the latitude and longitude bits of a geohash of precision
+// characters. Geohashes interleave longitude and latitude bits, longitude first
+func geohashBits(precision int) (latBits, lonBits uint) {
+	total := uint(5 * precision)
+	return total / 2, total - total/2
+}
+
+//cellIndex returns the cell of size 2^bits cells over span that v, offset from the
+// start of span, falls in
+func cellIndex(v, span float64, bits uint) uint64 {
+	n := uint64(1) << bits
+	i := uint64(math.Floor(v / span * float64(n)))
+	if i >= n {
+		i = n - 1
+	}
+	return i
+}
+
+//geohashCell returns the geohash of the cell at latIdx, lonIdx
+func geohashCell(latIdx, lonIdx uint64, precision int) string {
+	latBits, lonBits := geohashBits(precision)
+	buf := make([]byte, precision)
+	for c := range buf {
+		var v uint64
+		for b := 0; b < 5; b++ {
+			v <<= 1
+			if (c*5+b)%2 == 0 {
+				lonBits--
+				v |= lonIdx >> lonBits & 1
+			} else {
+				latBits--
+				v |= latIdx >> latBits & 1
+			}
+		}
+		buf[c] = geohashAlphabet[v]
+	}
+	return string(buf)
+}
+
+//encodeGeohash returns the geohash of the point lat, lon
+func encodeGeohash(lat, lon float64, precision int) string {
+	latBits, lonBits := geohashBits(precision)
+	return geohashCell(cellIndex(lat+90, 180, latBits), cellIndex(lon+180, 360, lonBits), precision)
+}
+
+//decodeGeohash returns the centre of the cell of a geohash
+func decodeGeohash(hash string) (lat, lon float64, ok bool) {
+	var latIdx, lonIdx uint64
+	for c := 0; c < len(hash); c++ {
+		v := strings.IndexByte(geohashAlphabet, hash[c])
+		if v < 0 {
+			return 0, 0, false
+		}
+		for b := 4; b >= 0; b-- {
+			bit := uint64(v) >> uint(b) & 1
+			if (c*5+4-b)%2 == 0 {
+				lonIdx = lonIdx<<1 | bit
+			} else {
+				latIdx = latIdx<<1 | bit
+			}
+		}
+	}
+	latBits, lonBits := geohashBits(len(hash))
+	lat = (float64(latIdx)+0.5)*180/float64(uint64(1)<<latBits) - 90
+	lon = (float64(lonIdx)+0.5)*360/float64(uint64(1)<<lonBits) - 180
+	return lat, lon, true
+}
+
+//cells returns the geohashes of the smallest cells covering the area of g in at most
+// geoMaxCells cells
+func (g *geoQuery) cells() []string {
+	south, west, north, east := g.bounds()
+	for precision := geohashPrecision; precision > 1; precision-- {
+		if cells := coverCells(south, west, north, east, precision); cells != nil {
+			return cells
+		}
+	}
+	return coverCells(south, west, north, east, 1)
+}
+
+//coverCells returns the geohashes of precision characters covering the box, or nil if
+// there are more than geoMaxCells of them. Single character cells always fit
+func coverCells(south, west, north, east float64, precision int) []string {
+	latBits, lonBits := geohashBits(precision)
+	lat0, lat1 := cellIndex(south+90, 180, latBits), cellIndex(north+90, 180, latBits)
+	//ranges of longitude cells, two when the box crosses the antimeridian
+	var lonRanges [][2]uint64
+	if west <= east {
+		lonRanges = [][2]uint64{{cellIndex(west+180, 360, lonBits), cellIndex(east+180, 360, lonBits)}}
+	} else {
+		last := uint64(1)<<lonBits - 1
+		lonRanges = [][2]uint64{{cellIndex(west+180, 360, lonBits), last}, {0, cellIndex(east+180, 360, lonBits)}}
+	}
+	count := uint64(0)
+	for _, r := range lonRanges {
+		count += (lat1 - lat0 + 1) * (r[1] - r[0] + 1)
+	}
+	if count > geoMaxCells && precision > 1 {
+		return nil
+	}
+	cells := make([]string, 0, count)
+	for latIdx := lat0; latIdx <= lat1; latIdx++ {
+		for _, r := range lonRanges {
+			for lonIdx := r[0]; lonIdx <= r[1]; lonIdx++ {
+				cells = append(cells, geohashCell(latIdx, lonIdx, precision))
+			}
+		}
+	}
+	return cells
+}
+
+//geoToken returns the geo index token of the coordinate fields of a decoded value
+func geoToken(obj map[string]interface{}, fields *sdsshared.GeoFields) (string, bool) {
+	lat, ok := coordinate(obj[fields.Lat])
+	if !ok || !validLat(lat) {
+		return "", false
+	}
+	lon, ok := coordinate(obj[fields.Lon])
+	if !ok || !validLon(lon) {
+		return "", false
+	}
+	return encodeGeohash(lat, lon, geohashPrecision), true
+}
+
+//coordinate returns a decoded field as a number
+func coordinate(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+//geoHits returns the records within the area of l's geo query that match the rest of l,
+// ranked by distance from the near point
+func geoHits(ctx context.Context, txn *badger.Txn, l lookup) ([]rankedHit, error) {
+	var allowed map[string]bool
+	if len(l.filters) > 0 {
+		allowed = make(map[string]bool)
+		for _, k := range filterKeys(txn, l.filters) {
+			allowed[string(k)] = true
+		}
+	}
+	base := len(indexPrefix + geoIndex + "/")
+	var hits []rankedHit
+	n := 0
+	for _, cell := range l.geo.cells() {
+		prefix := []byte(indexPrefix + geoIndex + "/" + cell)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if n++; n%1000 == 0 {
+				if err := ctx.Err(); err != nil {
+					it.Close()
+					return nil, err
+				}
+			}
+			entry := it.Item().Key()[base:]
+			sep := bytes.IndexByte(entry, 0)
+			if sep < 0 {
+				continue
+			}
+			lat, lon, ok := decodeGeohash(string(entry[:sep]))
+			if !ok {
+				continue
+			}
+			distance, ok := l.geo.contains(lat, lon)
+			if !ok {
+				continue
+			}
+			kvKey := entry[sep+1:]
+			if allowed != nil && !allowed[string(kvKey)] {
+				continue
+			}
+			key, timestamp, ok := sdsshared.ParseKVStoreKey(string(kvKey), keySeparator)
+			if !ok || !l.matches(key) {
+				continue
+			}
+			rec := sdsshared.Record{Key: key, Timestamp: timestamp}
+			if l.geo.near {
+				//reported to the centimetre, the precision of the index
+				d := math.Round(distance*100) / 100
+				rec.Distance = &d
+			}
+			hits = append(hits, newRankedHit(distance, false, append([]byte{}, kvKey...), rec))
+		}
+		it.Close()
+	}
+	return hits, nil
+}
+
+//scanGeo is scan for a geo query. Near queries return the nearest records first with
+// their distances; bbox queries on their own return records in key order
+func (pal *Palawan) scanGeo(ctx context.Context, txn *badger.Txn, l lookup, fn func(sdsshared.Record) error) (string, error) {
+	hits, err := geoHits(ctx, txn, l)
+	if err != nil {
+		return "", err
+	}
+	if l.geo.near {
+		return pal.scanRanked(ctx, txn, l, hits, fn)
+	}
+	keys := make([][]byte, len(hits))
+	for i, h := range hits {
+		keys[i] = h.kvKey
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return pal.scanKeys(ctx, txn, l, keys, fn)
+}
@@ -0,0 +1,222 @@
+package badgerconnector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	sdsshared "github.com/RhythmicSound/sdsshared"
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+//indexPrefix starts the keys of the secondary indexes built when a dataset is loaded.
+// Like the other meta keys it starts with '_' so it never collides with the upper case
+// record keys.
+//
+//An index entry is indexPrefix + index name + "/" + token + "\x00" + target with an empty
+// value, so the targets of a token are found with one prefix scan
+const indexPrefix = "_idx/"
+
+//indexesKey records the indexStateVersion and settings the indexes of a database were
+// built with
+const indexesKey = "_indexes"
+
+//indexStateVersion is bumped whenever the index layout changes, so that databases built
+// before are rebuilt rather than reused after a restart
+const indexStateVersion = 4
+
+//Index names
+const (
+	//normIndex maps normalised keys to record keys
+	normIndex = "norm"
+	//fuzzyIndex maps deletion variants of normalised keys to the normalised keys
+	fuzzyIndex = "fuzzy"
+	//geoIndex maps the geohashes of record coordinates, declared in the dataset's value
+	// schema, to record keys
+	geoIndex = "geo"
+	//textIndex maps the words of the search fields declared in the dataset's value
+	// schema to record keys
+	textIndex = "text"
+	//the indexes of value fields, declared in the dataset's value schema, are named by
+	// fieldIndex and map field values to record keys
+)
+
+//indexState is the value of indexesKey
+type indexState struct {
+	Version       int `json:"version"`
+	FuzzyDistance int `json:"fuzzy_distance"`
+}
+
+//currentIndexState is the indexState databases are built with under the current settings
+func currentIndexState() indexState {
+	return indexState{Version: indexStateVersion, FuzzyDistance: sdsshared.FuzzyIndexDistance}
+}
+
+//indexKey returns the index entry for target under token
+func indexKey(index, token string, target []byte) []byte {
+	key := indexTokenPrefix(index, token)
+	return append(key, target...)
+}
+
+//indexTokenPrefix returns the prefix of the index entries for token
+func indexTokenPrefix(index, token string) []byte {
+	return []byte(indexPrefix + index + "/" + token + "\x00")
+}
+
+//indexTargets returns the targets of the index entries for token, in order
+func indexTargets(txn *badger.Txn, index, token string) [][]byte {
+	prefix := indexTokenPrefix(index, token)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	var targets [][]byte
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		targets = append(targets, it.Item().KeyCopy(nil)[len(prefix):])
+	}
+	return targets
+}
+
+//buildIndexes builds the secondary indexes of the records loaded into db and records the
+// indexState they were built with. It reads every record, so it also counts them for the
+// Progress of ctx
+func buildIndexes(ctx context.Context, db *badger.DB) error {
+	state := currentIndexState()
+	schema, err := deriveSchema(db)
+	if err != nil {
+		return fmt.Errorf("Error reading value schema in badgerConnector.buildIndexes(): %v", err)
+	}
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	lastNorm := ""
+	var text textStats
+	progress := sdsshared.ProgressFromContext(ctx)
+	records := int64(0)
+	defer func() { progress.AddRecords(records) }()
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = len(schema.Indexes) > 0 || schema.Geo != nil || schema.Search != nil
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		n := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			if n++; n%10000 == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				progress.AddRecords(records)
+				records = 0
+			}
+			item := it.Item()
+			if item.Key()[0] == '_' {
+				continue
+			}
+			records++
+			key, _, ok := sdsshared.ParseKVStoreKey(string(item.Key()), keySeparator)
+			if !ok {
+				continue
+			}
+			norm := normalise(key)
+			if norm == "" {
+				continue
+			}
+			recordKey := item.KeyCopy(nil)
+			if err := wb.Set(indexKey(normIndex, norm, recordKey), nil); err != nil {
+				return err
+			}
+			if err := indexValue(wb, item, recordKey, schema, &text); err != nil {
+				return err
+			}
+			//the records of a key are next to each other so most repeats are caught here;
+			// the few missed only set the same entries again
+			if norm == lastNorm {
+				continue
+			}
+			lastNorm = norm
+			for _, variant := range deletionVariants(norm, state.FuzzyDistance) {
+				if err := wb.Set(indexKey(fuzzyIndex, variant, []byte(norm)), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error building indexes in badgerConnector.buildIndexes(): %v", err)
+	}
+	if schema.Search != nil {
+		raw, err := json.Marshal(text)
+		if err != nil {
+			return err
+		}
+		if err := wb.Set([]byte(textStatsKey), raw); err != nil {
+			return err
+		}
+	}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := wb.Set([]byte(indexesKey), raw); err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+//checkIndexes checks the indexes of db were built under the current settings
+func checkIndexes(db *badger.DB) error {
+	var state indexState
+	if err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(indexesKey))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &state)
+		})
+	}); err != nil {
+		return fmt.Errorf("could not read %s: %v", indexesKey, err)
+	}
+	if want := currentIndexState(); state != want {
+		return fmt.Errorf("indexes built with %+v, want %+v", state, want)
+	}
+	return nil
+}
+
+//indexValue adds the field, geo and search index entries of the record in item, stored
+// under recordKey, counting it in text
+func indexValue(wb *badger.WriteBatch, item *badger.Item, recordKey []byte, schema sdsshared.ValueSchema, text *textStats) error {
+	if len(schema.Indexes) == 0 && schema.Geo == nil && schema.Search == nil {
+		return nil
+	}
+	return item.Value(func(val []byte) error {
+		value, err := schema.Decode(val)
+		if err != nil {
+			//undecodable values cannot be looked up by field but are still served by key
+			return nil
+		}
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for _, field := range schema.Indexes {
+			for _, token := range fieldTokens(obj[field]) {
+				if err := wb.Set(indexKey(fieldIndex(field), token, recordKey), nil); err != nil {
+					return err
+				}
+			}
+		}
+		if schema.Geo != nil {
+			if token, ok := geoToken(obj, schema.Geo); ok {
+				if err := wb.Set(indexKey(geoIndex, token, recordKey), nil); err != nil {
+					return err
+				}
+			}
+		}
+		if schema.Search != nil {
+			return indexText(wb, obj, recordKey, schema.Search, text)
+		}
+		return nil
+	})
+}
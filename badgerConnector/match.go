@@ -0,0 +1,176 @@
+package badgerconnector
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	sdsshared "github.com/RhythmicSound/sdsshared"
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+//Match modes selected per request with the match option
+const (
+	//MatchExact finds the records of the key equal to the term. It is the default unless
+	// the Palawan is in predictive mode
+	MatchExact = "exact"
+	//MatchPrefix finds the records of every key starting with the term. It is the default
+	// in predictive mode
+	MatchPrefix = "prefix"
+	//MatchNormalised finds the records of keys equal to the term once both are
+	// normalised: upper cased with whitespace and punctuation removed, so "se12 9ta"
+	// finds SE12 9TA
+	MatchNormalised = "normalised"
+	//MatchFuzzy finds the records of keys within the edit distance given by the distance
+	// option, 1 by default, of the term once both are normalised. Insertions, deletions,
+	// substitutions and swaps of neighbouring characters each count as one edit
+	MatchFuzzy = "fuzzy"
+)
+
+//matchMode returns the match mode of q, checking the match and distance options. It
+// returns the edit distance for MatchFuzzy
+func (pal *Palawan) matchMode(q sdsshared.Query) (string, int, error) {
+	mode := strings.ToLower(q.Options["match"])
+	switch mode {
+	case "":
+		mode = MatchExact
+		if pal.predictiveMode {
+			mode = MatchPrefix
+		}
+	case "normalized":
+		mode = MatchNormalised
+	case MatchExact, MatchPrefix, MatchNormalised, MatchFuzzy:
+	default:
+		return "", 0, sdsshared.NewError(sdsshared.ErrBadRequest, "match must be %q, %q, %q or %q, got %q", MatchExact, MatchPrefix, MatchNormalised, MatchFuzzy, q.Options["match"])
+	}
+	if mode != MatchFuzzy {
+		return mode, 0, nil
+	}
+	if sdsshared.FuzzyIndexDistance < 1 {
+		return "", 0, sdsshared.NewError(sdsshared.ErrNotSupported, "fuzzy matching is turned off")
+	}
+	distance := 1
+	if v := q.Options["distance"]; v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || d < 0 || d > sdsshared.FuzzyIndexDistance {
+			return "", 0, sdsshared.NewError(sdsshared.ErrBadRequest, "distance must be a whole number from 0 to %d, got %q", sdsshared.FuzzyIndexDistance, v)
+		}
+		distance = d
+	}
+	return mode, distance, nil
+}
+
+//normalise upper cases s and strips everything but letters and digits
+func normalise(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToUpper(r))
+		}
+	}
+	return b.String()
+}
+
+//deletionVariants returns s and every distinct non empty string made by deleting up to
+// distance characters from it. Two strings within an edit distance of d share a variant
+// made with at most d deletions from each
+func deletionVariants(s string, distance int) []string {
+	seen := map[string]bool{s: true}
+	level := []string{s}
+	for d := 0; d < distance; d++ {
+		var next []string
+		for _, v := range level {
+			runes := []rune(v)
+			if len(runes) <= 1 {
+				continue
+			}
+			for i := range runes {
+				variant := string(runes[:i]) + string(runes[i+1:])
+				if !seen[variant] {
+					seen[variant] = true
+					next = append(next, variant)
+				}
+			}
+		}
+		level = next
+	}
+	variants := make([]string, 0, len(seen))
+	for v := range seen {
+		variants = append(variants, v)
+	}
+	sort.Strings(variants)
+	return variants
+}
+
+//editDistance returns the optimal string alignment distance between a and b: the
+// Levenshtein distance with swaps of neighbouring characters counted as one edit
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	//rows i-2, i-1 and i of the distance matrix
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = minInt(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+func minInt(first int, rest ...int) int {
+	for _, n := range rest {
+		if n < first {
+			first = n
+		}
+	}
+	return first
+}
+
+//normalisedKeys returns the record keys whose key normalises to the same as term
+func normalisedKeys(txn *badger.Txn, term string) [][]byte {
+	norm := normalise(term)
+	if norm == "" {
+		return nil
+	}
+	return indexTargets(txn, normIndex, norm)
+}
+
+//fuzzyKeys returns the record keys whose normalised key is within distance edits of the
+// normalised term. Candidates come from the fuzzy index, so no records are scanned
+func fuzzyKeys(txn *badger.Txn, term string, distance int) [][]byte {
+	norm := normalise(term)
+	if norm == "" {
+		return nil
+	}
+	checked := make(map[string]bool)
+	var keys [][]byte
+	for _, variant := range deletionVariants(norm, distance) {
+		for _, candidate := range indexTargets(txn, fuzzyIndex, variant) {
+			c := string(candidate)
+			if checked[c] {
+				continue
+			}
+			checked[c] = true
+			if editDistance(norm, c) <= distance {
+				keys = append(keys, indexTargets(txn, normIndex, c)...)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return keys
+}
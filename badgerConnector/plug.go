@@ -2,14 +2,19 @@ package badgerconnector
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
 	"math/rand"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	sdsshared "github.com/RhythmicSound/sdsshared"
@@ -17,14 +22,138 @@ import (
 )
 
 //Palawan (a stinky Badger specices) is the main api implementer for the Badger KV database
+//
+//Palawan is safe for concurrent use. Reads run against a reference counted handle on the
+// mounted database so an update can swap databases while reads are in flight; the old
+// database is closed once its last reader finishes.
+//
+//Each dataset is loaded into a new database generation. The last
+// sdsshared.KeepGenerations generations are kept on disk so that Rollback can return
+// to one
 type Palawan struct {
-	ResourceName         string
-	Database             *badger.DB
-	transitionalDatabase *badger.DB // to put a db whilst doing update database switchover
-	updateCount          int        //number of times UpdateDataset method
-	versioner            sdsshared.VersionManager
-	mu                   *sync.Mutex
-	predictiveMode       bool //whether or not the retieve term should be considered the full search term (false) or an incomplete typed term (true)
+	ResourceName   string
+	db             *dbHandle                //the mounted database, guarded by mu
+	open           map[int]*dbHandle        //handles not yet closed by generation, guarded by mu
+	gens           *generations             //generation metadata, guarded by mu
+	updating       int32                    //set to 1 while UpdateDataset or Rollback runs
+	versioner      sdsshared.VersionManager //guarded by mu
+	mu             *sync.RWMutex
+	predictiveMode bool //whether or not the retieve term should be considered the full search term (false) or an incomplete typed term (true)
+}
+
+//loadedKey marks a database whose dataset finished loading. Its value is the load time
+const loadedKey = "_loaded"
+
+//errClosed is returned by reads after the database has been closed
+var errClosed = errors.New("badger database is closed")
+
+//dbHandle is a reference counted badger database. Palawan holds one reference to the
+// mounted database and every read holds another while it runs
+type dbHandle struct {
+	db   *badger.DB
+	gen  int
+	refs int64
+	//schema decodes the values of db. It is set before the database is served
+	schema sdsshared.ValueSchema
+	//remove is set, under Palawan.mu, when the generation is pruned while still open
+	remove bool
+	//closed is called after the database has been closed
+	closed func(h *dbHandle)
+}
+
+//release drops a reference, closing the database if it was the last one
+func (h *dbHandle) release() error {
+	if atomic.AddInt64(&h.refs, -1) != 0 {
+		return nil
+	}
+	err := h.db.Close()
+	if h.closed != nil {
+		h.closed(h)
+	}
+	return err
+}
+
+//retain adds a reference unless the last one has already been released and the
+// database is closing, reporting whether it did
+func (h *dbHandle) retain() bool {
+	for {
+		refs := atomic.LoadInt64(&h.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&h.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+//newHandle wraps db, the database of generation gen with values described by schema, in
+// a handle holding the mount reference. The caller must hold pal.mu
+func (pal *Palawan) newHandle(db *badger.DB, gen int, schema sdsshared.ValueSchema) *dbHandle {
+	h := &dbHandle{db: db, gen: gen, refs: 1, schema: schema, closed: pal.handleClosed}
+	if pal.open == nil {
+		pal.open = make(map[int]*dbHandle)
+	}
+	pal.open[gen] = h
+	return h
+}
+
+//handleClosed forgets a closed handle and deletes its generation if it was pruned while
+// it was open
+func (pal *Palawan) handleClosed(h *dbHandle) {
+	pal.mu.Lock()
+	if pal.open[h.gen] == h {
+		delete(pal.open, h.gen)
+	}
+	remove := h.remove
+	pal.mu.Unlock()
+	if remove {
+		removeGeneration(h.gen)
+	}
+}
+
+//recordGeneration records generation gen as the one in use, adding it to the metadata
+// with the current version data if it is new, and prunes old generations. It returns
+// the pruned generations that can be deleted now; open ones are deleted when closed.
+// The caller must hold pal.mu
+func (pal *Palawan) recordGeneration(gen int) []int {
+	if pal.gens.find(gen) < 0 {
+		pal.gens.add(gen, pal.versioner)
+	}
+	pal.gens.Current = gen
+	var removable []int
+	for _, n := range pal.gens.prune(sdsshared.KeepGenerations) {
+		if h, ok := pal.open[n]; ok {
+			h.remove = true
+			continue
+		}
+		removable = append(removable, n)
+	}
+	return removable
+}
+
+//saveGenerations persists the generation metadata and deletes the pruned generations
+// returned by recordGeneration
+func (pal *Palawan) saveGenerations(removable []int) {
+	pal.mu.RLock()
+	gens := pal.gens.copy()
+	pal.mu.RUnlock()
+	if err := gens.save(); err != nil {
+		log.Printf("Error saving dataset generation metadata: %v", err)
+	}
+	for _, n := range removable {
+		removeGeneration(n)
+	}
+}
+
+//abandonGeneration deletes generation gen, started by an update that failed, and
+// forgets it was started
+func (pal *Palawan) abandonGeneration(gen int) {
+	removeGeneration(gen)
+	pal.mu.Lock()
+	pal.gens.finish(gen)
+	pal.mu.Unlock()
+	pal.saveGenerations(nil)
 }
 
 //New creates a new BadgerDB Palawan instance that implements DataResource
@@ -33,8 +162,7 @@ func New(resourceName, datasetDownloadLoc string, predictiveMode bool) *Palawan
 	return &Palawan{
 		ResourceName:   resourceName,
 		predictiveMode: predictiveMode,
-		mu:             &sync.Mutex{},
-		updateCount:    0,
+		mu:             &sync.RWMutex{},
 		versioner: sdsshared.VersionManager{
 			Repo:           datasetDownloadLoc,
 			LastUpdated:    "",
@@ -57,25 +185,107 @@ func (pal Palawan) Open(databaseLocation string) (*badger.DB, error) {
 	return db, nil
 }
 
-//Close closes the database. Must be done prior to closing the application
+//Close closes the database. Must be done prior to closing the application. Reads still
+// in flight finish first; later reads fail
 func (pal *Palawan) Close() error {
-	return pal.Database.Close()
+	pal.mu.Lock()
+	h := pal.db
+	pal.db = nil
+	pal.mu.Unlock()
+	if h == nil {
+		return nil
+	}
+	return h.release()
+}
+
+//acquire takes a reference on the mounted database along with the version data that
+// goes with it. The caller must release the handle when done
+func (pal *Palawan) acquire() (*dbHandle, sdsshared.VersionManager, error) {
+	pal.mu.RLock()
+	defer pal.mu.RUnlock()
+	if pal.db == nil {
+		return nil, sdsshared.VersionManager{}, errClosed
+	}
+	atomic.AddInt64(&pal.db.refs, 1)
+	return pal.db, pal.versioner, nil
+}
+
+//releaseHandle releases a handle taken by acquire, logging any error closing a database
+// that was swapped out while it was held
+func releaseHandle(h *dbHandle) {
+	if err := h.release(); err != nil {
+		log.Printf("Error closing replaced badger database: %v", err)
+	}
+}
+
+//View runs fn in a read-only transaction on the mounted database. The database is not
+// closed by a concurrent update until fn returns
+func (pal *Palawan) View(fn func(txn *badger.Txn) error) error {
+	h, _, err := pal.acquire()
+	if err != nil {
+		return err
+	}
+	defer releaseHandle(h)
+	return h.db.View(fn)
+}
+
+//version returns a copy of the version data of the mounted dataset
+func (pal *Palawan) version() sdsshared.VersionManager {
+	pal.mu.RLock()
+	defer pal.mu.RUnlock()
+	return pal.versioner
 }
 
 //Startup script function prior to receiving data access requests
 func (pal *Palawan) Startup() error {
-	if db, err := pal.Open(fmt.Sprintf("%s%d", sdsshared.DBURI, pal.updateCount)); err != nil {
+	return pal.StartupContext(context.Background())
+}
+
+//StartupContext is Startup with a context that can cancel the initial dataset download
+//
+//If the generation in use before a restart finished loading and still holds the recorded
+// dataset version it is served again straight away rather than downloading and loading
+// the dataset again. Debug mode always builds a new generation of test data
+func (pal *Palawan) StartupContext(ctx context.Context) error {
+	gens, err := loadGenerations()
+	if err != nil {
+		return fmt.Errorf("Error loading dataset generations in badgerConnector.Startup(): %v", err)
+	}
+	gens.removeStaleGenerations()
+	if !sdsshared.DebugMode && pal.reuseGeneration(gens) {
+		pal.saveGenerations(nil)
+		return nil
+	}
+	gen := gens.start()
+	if err := gens.save(); err != nil {
+		return fmt.Errorf("Error saving dataset generations in badgerConnector.Startup(): %v", err)
+	}
+	if db, err := pal.Open(generationPath(gen)); err != nil {
 		return fmt.Errorf("Error opening database in badgerConnector.Startup(): %v", err)
 	} else {
-		pal.Database = db
+		pal.mu.Lock()
+		pal.gens = gens
+		//the schema is read once the dataset has loaded
+		pal.db = pal.newHandle(db, gen, sdsshared.ValueSchema{Codec: sdsshared.CodecAuto})
+		pal.mu.Unlock()
 	}
 
 	//download and deploy dataset to database and run as datasource
+	revision := ""
 	if !sdsshared.DebugMode {
-		if err := pal.fetchDataset(pal.versioner.Repo, true); err != nil {
-			return fmt.Errorf("Error fetching dataset in badgerConnector.Startup(): %v", err)
+		src, err := sdsshared.NewDatasetSource(pal.version().Repo)
+		if err != nil {
+			return fmt.Errorf("Error fetching dataset in badgerConnector.Startup(): %w", err)
 		}
-		if _, err := pal.loadDataset(nil); err != nil {
+		//record the source revision so the next update can tell if anything changed
+		if probe, err := sdsshared.ProbeDataset(ctx, src); err == nil {
+			revision = probe.Revision
+		}
+		archive, err := pal.fetchDataset(ctx, src)
+		if err != nil {
+			return fmt.Errorf("Error fetching dataset in badgerConnector.Startup(): %w", err)
+		}
+		if _, err := pal.loadDataset(ctx, archive, nil); err != nil {
 			return fmt.Errorf("Error loading dataset in badgerConnector.Startup(): %v", err)
 		}
 	}
@@ -89,17 +299,19 @@ func (pal *Palawan) Startup() error {
 	}
 
 	//Get versioner meta info from downloaded database
-	if err := pal.Database.View(func(txn *badger.Txn) error {
+	if err := pal.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("_version"))
 		if err != nil {
 			return fmt.Errorf("Error getting version data from loaded database in badgerConnector.Startup(). Must contain key '_version': %v", err)
 		}
 		if err := item.Value(func(val []byte) error {
-			vs := &sdsshared.VersionManager{}
-			if err := json.Unmarshal(val, vs); err != nil {
+			vs := sdsshared.VersionManager{}
+			if err := json.Unmarshal(val, &vs); err != nil {
 				return fmt.Errorf("Error unmarshalling version data in badgerConnector.Startup(): %v", err)
 			}
-			pal.versioner = *vs
+			pal.mu.Lock()
+			pal.setVersioner(vs)
+			pal.mu.Unlock()
 			return nil
 		}); err != nil {
 			return err
@@ -128,6 +340,11 @@ func (pal *Palawan) Startup() error {
 	}); err != nil {
 		return err
 	}
+	pal.mu.Lock()
+	pal.versioner.Revision = revision
+	removable := pal.recordGeneration(gen)
+	pal.mu.Unlock()
+	pal.saveGenerations(removable)
 
 	return nil
 }
@@ -137,95 +354,493 @@ func (pal *Palawan) Shutdown() error {
 	return pal.Close()
 }
 
+//ShutdownContext is Shutdown with a context. Closing the database is not interruptible
+// so the context is only checked before starting
+func (pal *Palawan) ShutdownContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pal.Shutdown()
+}
+
 //Retrieve is run each time the server receives a search term to query the db for
 func (pal *Palawan) Retrieve(toFind string, options map[string]string) (sdsshared.SimpleData, error) {
-	out := sdsshared.SimpleData{
-		Meta: sdsshared.Meta{
-			LastUpdated: pal.versioner.LastUpdated,
-			DataSources: pal.versioner.DataSources,
-			Resource:    pal.ResourceName,
-		}, RequestOptions: options,
-	}
-	//normalise to all uppercase keys
-	toFind = strings.ToUpper(toFind)
-	//seperator used in CreateKVStoreKey function
-	keySeperator := "/"
-	//standardise and optimise for time sorting
-	value := make(map[string]string, 0)
-
-	err := pal.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		if pal.predictiveMode {
-			opts.PrefetchValues = false
-		}
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		prefix := []byte(toFind + keySeperator)
-		if pal.predictiveMode {
-			prefix = []byte(toFind)
+	return pal.RetrieveContext(context.Background(), toFind, options)
+}
+
+//RetrieveContext is Retrieve with a context. The database scan stops early with
+// the context error if ctx is done before it completes
+//
+//options are parsed as a sdsshared.Query and honoured as by RetrieveQuery, but values are
+// returned in their original map form: timestamp to value decoded as by RetrieveQuery, or
+// in predictive mode key to comma separated timestamps
+func (pal *Palawan) RetrieveContext(ctx context.Context, toFind string, options map[string]string) (sdsshared.SimpleData, error) {
+	q, err := sdsshared.NewQuery(toFind, options)
+	if err != nil {
+		return sdsshared.SimpleData{}, err
+	}
+	out, err := pal.RetrieveQuery(ctx, q)
+	if err != nil {
+		return sdsshared.SimpleData{}, err
+	}
+	records := out.Data.Values.([]sdsshared.Record)
+	//If predictiveMode is on, only a list of matching keys are required without timestamp
+	if pal.predictiveMode {
+		keys := make(map[string]string, len(records))
+		for _, rec := range records {
+			timestamp := strconv.FormatInt(rec.Timestamp, 10)
+			if _, ok := keys[rec.Key]; ok {
+				keys[rec.Key] = strings.Join([]string{keys[rec.Key], timestamp}, ",")
+			} else {
+				keys[rec.Key] = timestamp
+			}
 		}
+		out.Data.Values = keys
+		out.ResultCount = len(keys)
+		return out, nil
+	}
+	value := make(map[string]interface{}, len(records))
+	for _, rec := range records {
+		value[strconv.FormatInt(rec.Timestamp, 10)] = rec.Value
+	}
+	out.Data.Values = value
+	out.ResultCount = len(value)
+	return out, nil
+}
 
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			keyComposite := strings.Split(string(item.Key()), keySeperator)
-			//If predictiveMode is on, only a list of matching keys are required without timestamp
-			if pal.predictiveMode {
-				if _, ok := value[keyComposite[0]]; ok {
-					value[keyComposite[0]] = strings.Join([]string{value[keyComposite[0]], keyComposite[1]}, ",")
-				} else {
-					value[keyComposite[0]] = keyComposite[1]
-				}
+//RetrieveQuery returns the records matching q as a []sdsshared.Record in
+// SimpleData.Data.Values. If there are more than q.Limit, SimpleData.NextCursor continues
+// from the last one returned.
+//
+//Records are found by key in the match mode given by the match option: MatchExact,
+// MatchPrefix, MatchNormalised or MatchFuzzy. In predictive mode prefix matching is the
+// default and only keys and timestamps are returned
+func (pal *Palawan) RetrieveQuery(ctx context.Context, q sdsshared.Query) (sdsshared.SimpleData, error) {
+	c := &collector{records: make([]sdsshared.Record, 0)}
+	nextCursor, err := pal.StreamQuery(ctx, q, c)
+	if err != nil {
+		return sdsshared.SimpleData{}, err
+	}
+	return c.data(q, nextCursor), nil
+}
+
+//StreamQuery passes the records matching q to stream as they are read from the
+// database, finding them as RetrieveQuery does. The database handle stays in use until
+// it returns, so a slow client holds on to a generation that has been swapped out
+func (pal *Palawan) StreamQuery(ctx context.Context, q sdsshared.Query, stream sdsshared.RecordStream) (string, error) {
+	h, versioner, err := pal.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer releaseHandle(h)
+	l, err := pal.prepare(q, h.schema)
+	if err != nil {
+		return "", err
+	}
+	if err := stream.Header(pal.meta(versioner)); err != nil {
+		return "", err
+	}
+	var nextCursor string
+	err = h.db.View(func(txn *badger.Txn) error {
+		nextCursor, err = pal.scan(ctx, txn, l, stream.Record)
+		return err
+	})
+	return nextCursor, err
+}
+
+//RetrieveBatch returns the results of each query as RetrieveQuery would, all read in one
+// transaction from the same database. A query that is invalid or fails has its error in
+// its result and the others are still run
+func (pal *Palawan) RetrieveBatch(ctx context.Context, queries []sdsshared.Query) ([]sdsshared.BatchResult, error) {
+	h, versioner, err := pal.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseHandle(h)
+	meta := pal.meta(versioner)
+	results := make([]sdsshared.BatchResult, len(queries))
+	err = h.db.View(func(txn *badger.Txn) error {
+		for i, q := range queries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			l, err := pal.prepare(q, h.schema)
+			if err != nil {
+				results[i].Err = err
 				continue
 			}
-			err := item.Value(func(val []byte) error {
-				// This func with val would only be called if item.Value encounters no error.
-				timestamp := keyComposite[1]
-				value[timestamp] = string(val)
-				return nil
-			})
+			c := &collector{meta: meta, records: make([]sdsshared.Record, 0)}
+			nextCursor, err := pal.scan(ctx, txn, l, c.Record)
 			if err != nil {
-				return err
+				results[i].Err = err
+				continue
 			}
+			results[i].Data = c.data(q, nextCursor)
 		}
-
-		return nil
+		//a query cut short by a dropped request fails the batch
+		return ctx.Err()
 	})
 	if err != nil {
-		return sdsshared.SimpleData{}, err
+		return nil, err
 	}
-	out.Data.Values = value
-	out.ResultCount = len(value)
+	return results, nil
+}
 
-	return out, nil
+//meta returns the response metadata of the dataset versioner describes
+func (pal *Palawan) meta(versioner sdsshared.VersionManager) sdsshared.Meta {
+	return sdsshared.Meta{
+		LastUpdated: versioner.LastUpdated,
+		DataSources: versioner.DataSources,
+		Resource:    pal.ResourceName,
+	}
+}
+
+//collector is a sdsshared.RecordStream keeping everything passed to it
+type collector struct {
+	meta    sdsshared.Meta
+	records []sdsshared.Record
+}
+
+func (c *collector) Header(meta sdsshared.Meta) error {
+	c.meta = meta
+	return nil
+}
+
+func (c *collector) Record(rec sdsshared.Record) error {
+	c.records = append(c.records, rec)
+	return nil
+}
+
+//data returns the collected records as the response to q
+func (c *collector) data(q sdsshared.Query, nextCursor string) sdsshared.SimpleData {
+	return sdsshared.SimpleData{
+		Meta:           c.meta,
+		RequestOptions: q.Options,
+		Data:           sdsshared.DataOutput{Values: c.records},
+		ResultCount:    len(c.records),
+		NextCursor:     nextCursor,
+	}
+}
+
+//keySeparator is the separator used in CreateKVStoreKey keys
+const keySeparator = "/"
+
+//lookup is a query checked and prepared for scan
+type lookup struct {
+	q sdsshared.Query
+	//term is the upper cased term
+	term string
+	//mode and distance are the match mode and fuzzy match distance
+	mode     string
+	distance int
+	//filters are the indexed field filters, field to indexed value
+	filters map[string]string
+	//geo is the area of a near or bbox query
+	geo *geoQuery
+	//text is the full text search of a q query
+	text *textQuery
+	//schema decodes values
+	schema sdsshared.ValueSchema
+}
+
+//prepare checks q against a dataset with values described by schema
+func (pal *Palawan) prepare(q sdsshared.Query, schema sdsshared.ValueSchema) (lookup, error) {
+	mode, distance, err := pal.matchMode(q)
+	if err != nil {
+		return lookup{}, err
+	}
+	l := lookup{q: q, term: strings.ToUpper(q.Term), mode: mode, distance: distance, filters: fieldFilters(q, schema), schema: schema}
+	if l.geo, err = parseGeo(q); err != nil {
+		return lookup{}, err
+	}
+	if l.geo != nil && schema.Geo == nil {
+		return lookup{}, sdsshared.NewError(sdsshared.ErrNotSupported, "%s has no geo fields in its value schema", pal.ResourceName)
+	}
+	if l.text, err = parseSearch(q, schema, pal.ResourceName); err != nil {
+		return lookup{}, err
+	}
+	if l.text != nil && l.geo != nil {
+		return lookup{}, sdsshared.NewError(sdsshared.ErrBadRequest, "q cannot be combined with near or bbox")
+	}
+	if l.term == "" && len(l.filters) == 0 && l.geo == nil && l.text == nil {
+		return lookup{}, sdsshared.NewError(sdsshared.ErrBadRequest, "a fetch term, a q search, a filter on an indexed field or a near or bbox area is required")
+	}
+	if prefix := l.prefix(); q.After != nil && prefix != nil && !bytes.HasPrefix(q.After, prefix) {
+		return lookup{}, sdsshared.NewError(sdsshared.ErrBadRequest, "cursor is for a different term")
+	}
+	return l, nil
+}
+
+//prefix returns the key prefix of every record matching l, or nil if l is looked up in
+// an index
+func (l lookup) prefix() []byte {
+	switch {
+	case len(l.filters) > 0 || l.geo != nil || l.text != nil:
+		return nil
+	case l.mode == MatchExact:
+		return []byte(l.term + keySeparator)
+	case l.mode == MatchPrefix:
+		return []byte(l.term)
+	}
+	return nil
+}
+
+//matches reports whether the record key key matches the term of l in its match mode
+func (l lookup) matches(key string) bool {
+	switch {
+	case l.term == "":
+		return true
+	case l.mode == MatchExact:
+		return key == l.term
+	case l.mode == MatchPrefix:
+		return strings.HasPrefix(key, l.term)
+	case l.mode == MatchNormalised:
+		return normalise(key) == normalise(l.term)
+	}
+	return editDistance(normalise(key), normalise(l.term)) <= l.distance
+}
+
+//scan calls fn with each record matching l in order, after applying the cursor, time
+// range, offset and limit of its query. Keys are stored in upper case so the term is too.
+//
+//Exact and prefix matches without field filters, an area or a search are read straight
+// from the records; other lookups go through the indexes built by buildIndexes.
+//
+//If the limit cut the results short it returns the cursor continuing after the last
+// record passed to fn
+func (pal *Palawan) scan(ctx context.Context, txn *badger.Txn, l lookup, fn func(sdsshared.Record) error) (string, error) {
+	prefix := l.prefix()
+	switch {
+	case l.geo != nil:
+		return pal.scanGeo(ctx, txn, l, fn)
+	case l.text != nil:
+		return pal.scanText(ctx, txn, l, fn)
+	case len(l.filters) > 0:
+		var keys [][]byte
+		for _, k := range filterKeys(txn, l.filters) {
+			if key, _, ok := sdsshared.ParseKVStoreKey(string(k), keySeparator); ok && l.matches(key) {
+				keys = append(keys, k)
+			}
+		}
+		return pal.scanKeys(ctx, txn, l, keys, fn)
+	case l.mode == MatchNormalised:
+		return pal.scanKeys(ctx, txn, l, normalisedKeys(txn, l.term), fn)
+	case l.mode == MatchFuzzy:
+		return pal.scanKeys(ctx, txn, l, fuzzyKeys(txn, l.term, l.distance), fn)
+	}
+
+	q := l.q
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = !pal.predictiveMode
+	opts.Reverse = q.Order == sdsshared.OrderNewest
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	start := prefix
+	if q.After != nil {
+		start = q.After
+	} else if opts.Reverse {
+		//in reverse, seek past every key with the prefix
+		start = append(append([]byte{}, prefix...), 0xFF)
+	}
+
+	p := pager{q: q}
+	for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		item := it.Item()
+		if q.After != nil && bytes.Equal(item.Key(), q.After) {
+			continue
+		}
+		key, timestamp, ok := sdsshared.ParseKVStoreKey(string(item.Key()), keySeparator)
+		if !ok || !l.matches(key) {
+			continue
+		}
+		if err := pal.emit(item, item.Key(), sdsshared.Record{Key: key, Timestamp: timestamp}, l, &p, fn); err != nil || p.cursor != "" {
+			return p.cursor, err
+		}
+	}
+	return "", nil
+}
+
+//scanKeys is scan for a sorted list of matching record keys found through an index
+func (pal *Palawan) scanKeys(ctx context.Context, txn *badger.Txn, l lookup, keys [][]byte, fn func(sdsshared.Record) error) (string, error) {
+	q := l.q
+	newest := q.Order == sdsshared.OrderNewest
+	p := pager{q: q}
+	for n := range keys {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		k := keys[n]
+		if newest {
+			k = keys[len(keys)-1-n]
+		}
+		if q.After != nil {
+			if c := bytes.Compare(k, q.After); (!newest && c <= 0) || (newest && c >= 0) {
+				continue
+			}
+		}
+		key, timestamp, ok := sdsshared.ParseKVStoreKey(string(k), keySeparator)
+		if !ok {
+			continue
+		}
+		item, err := txn.Get(k)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := pal.emit(item, item.Key(), sdsshared.Record{Key: key, Timestamp: timestamp}, l, &p, fn); err != nil || p.cursor != "" {
+			return p.cursor, err
+		}
+	}
+	return "", nil
+}
+
+//pager applies the time range, offset and limit of a query to the records matching it,
+// in order
+type pager struct {
+	q                 sdsshared.Query
+	skipped, returned int
+	lastKey           []byte
+	//cursor is set once the limit is reached and there is another record
+	cursor string
+}
+
+//admit reports whether the record stored at timestamp is returned, given the key its
+// results are ordered by: its database key, or for ranked results its rankedHit.orderKey. Once
+// the limit has been reached it sets p.cursor instead
+func (p *pager) admit(orderKey []byte, timestamp int64) bool {
+	if !p.q.InRange(timestamp) {
+		return false
+	}
+	if p.q.Limit > 0 && p.returned >= p.q.Limit {
+		//there is at least one more record so the results continue after the last one
+		p.cursor = sdsshared.EncodeCursor(p.lastKey, p.q.Order)
+		return false
+	}
+	if p.skipped < p.q.Offset {
+		p.skipped++
+		return false
+	}
+	p.returned++
+	p.lastKey = append(p.lastKey[:0], orderKey...)
+	return true
+}
+
+//emit passes rec, with the value of item, to fn if p admits it at orderKey. In
+// predictive mode only the key, timestamp and distance are passed
+func (pal *Palawan) emit(item *badger.Item, orderKey []byte, rec sdsshared.Record, l lookup, p *pager, fn func(sdsshared.Record) error) error {
+	if !p.admit(orderKey, rec.Timestamp) {
+		return nil
+	}
+	if !pal.predictiveMode {
+		if err := item.Value(func(val []byte) error {
+			// This func with val would only be called if item.Value encounters no error.
+			value, err := l.schema.Decode(val)
+			if err != nil {
+				return fmt.Errorf("Error decoding value of %s in badgerConnector.scan(): %v", item.Key(), err)
+			}
+			rec.Value = l.q.Select(value)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return fn(rec)
 }
 
 //UpdateDataset function loads data from source and updates db in use
 func (pal *Palawan) UpdateDataset() (sdsshared.VersionManager, error) {
-	//Open new blank db
-	pal.updateCount += 1
-	db, err := pal.Open(fmt.Sprintf("%s%d", sdsshared.DBURI, pal.updateCount))
+	return pal.UpdateDatasetContext(context.Background())
+}
+
+//UpdateDatasetContext is UpdateDataset with a context that can cancel the dataset download
+//
+//The latest available dataset is probed first. If it is no newer than the dataset in use
+// the current version is returned with sdsshared.ErrUpToDate and nothing is downloaded,
+// unless ctx was created with sdsshared.WithForceUpdate
+//
+//Only one update runs at a time. A call made while an update is running returns an
+// error matching sdsshared.ErrUpdating
+//
+//Progress through the download, verification, loading and mounting phases is reported
+// to the sdsshared.Progress carried by ctx
+func (pal *Palawan) UpdateDatasetContext(ctx context.Context) (sdsshared.VersionManager, error) {
+	if !atomic.CompareAndSwapInt32(&pal.updating, 0, 1) {
+		return sdsshared.VersionManager{}, sdsshared.NewError(sdsshared.ErrUpdating, "an update of %s is already running", pal.ResourceName)
+	}
+	defer atomic.StoreInt32(&pal.updating, 0)
+	current := pal.version()
+	src, err := sdsshared.NewDatasetSource(current.Repo)
+	if err != nil {
+		return sdsshared.VersionManager{}, err
+	}
+	//Check whether there is anything new to load
+	probe, err := sdsshared.ProbeDataset(ctx, src)
+	if err != nil {
+		log.Printf("Could not probe latest dataset version, updating anyway: %v", err)
+	} else if !sdsshared.ForceUpdate(ctx) {
+		if !probe.NeedsUpdate(current) {
+			return current, sdsshared.ErrUpToDate
+		}
+		//don't undo a rollback by loading the dataset that was rolled back from
+		pal.mu.RLock()
+		skipped, rolledBack := pal.gens.rolledBackFrom(probe)
+		pal.mu.RUnlock()
+		if rolledBack {
+			log.Printf("Latest dataset is no newer than generation %d which was rolled back from, not updating", skipped.Generation)
+			return current, sdsshared.ErrUpToDate
+		}
+	}
+	//Download and verify new data before touching any database so a bad archive leaves
+	// the mounted database in place
+	archive, err := pal.fetchDataset(ctx, src)
 	if err != nil {
 		return sdsshared.VersionManager{}, err
 	}
-	//Download new data
-	if err := pal.fetchDataset(pal.versioner.Repo, true); err != nil {
+	//Open new blank db as the next generation. A generation that fails to build is
+	// deleted so it never takes up space or gets mistaken for a good one
+	pal.mu.Lock()
+	gen := pal.gens.start()
+	pal.mu.Unlock()
+	pal.saveGenerations(nil)
+	db, err := pal.Open(generationPath(gen))
+	if err != nil {
+		pal.abandonGeneration(gen)
 		return sdsshared.VersionManager{}, err
 	}
 	//Load in new data
-	if _, err := pal.loadDataset(db); err != nil {
+	progress := sdsshared.ProgressFromContext(ctx)
+	progress.SetPhase(sdsshared.PhaseLoading)
+	if _, err := pal.loadDataset(ctx, archive, db); err != nil {
+		db.Close()
+		pal.abandonGeneration(gen)
 		return sdsshared.VersionManager{}, err
 	}
-	//Make new db the in use pal.Database
-	if err = pal.mount(db); err != nil {
+	//Make new db the in use database
+	progress.SetPhase(sdsshared.PhaseMounting)
+	if err = pal.mount(db, gen, probe.Revision); err != nil {
+		db.Close()
+		pal.abandonGeneration(gen)
 		return sdsshared.VersionManager{}, err
 	}
 
-	return pal.versioner, nil
+	return pal.version(), nil
 }
 
-//AddTestData adds [num] items of randomised test data to the database
+//AddTestData adds [num] items of randomised test data to the database and rebuilds its
+// indexes
 func (pal *Palawan) AddTestData(num int) error {
-	if err := pal.Database.Update(func(txn *badger.Txn) error {
+	h, _, err := pal.acquire()
+	if err != nil {
+		return err
+	}
+	defer releaseHandle(h)
+	if err := h.db.Update(func(txn *badger.Txn) error {
 		version := sdsshared.VersionManager{
 			CurrentVersion: "1.0.0",
 			LastUpdated:    time.Now().Format(time.RFC3339),
@@ -250,7 +865,7 @@ func (pal *Palawan) AddTestData(num int) error {
 					if err != nil {
 						return err
 					}
-					txn = pal.Database.NewTransaction(true)
+					txn = h.db.NewTransaction(true)
 					err = txn.SetEntry(e)
 				}
 				if err != nil {
@@ -279,10 +894,14 @@ func (pal *Palawan) AddTestData(num int) error {
 	}); err != nil {
 		return err
 	}
+	//index the test data so every match mode works against it
+	if err := buildIndexes(context.Background(), h.db); err != nil {
+		return err
+	}
 
 	//GC
 	for {
-		if err := pal.Database.RunValueLogGC(0.7); err != nil {
+		if err := h.db.RunValueLogGC(0.7); err != nil {
 			break
 		}
 
@@ -291,51 +910,36 @@ func (pal *Palawan) AddTestData(num int) error {
 	return nil
 }
 
-//fetchDataset downloads the dataset archive from given location to the local downloads location
+//fetchDataset downloads the dataset archive from src to the local downloads location
+// and returns the path of the archive
 //
-//Mark gcp as true if downloading from a private GCP bucket. Requires GCP Authentication
-func (pal Palawan) fetchDataset(datasetURL string, gcp bool) error {
-
-	//If downloading from GCP cloud storage that requires authentication
-	if gcp {
-		return sdsshared.GCPDownload(sdsshared.DatasetBucketName, sdsshared.DatasetObjectName)
-	}
-
-	//Else download from URL---
-	if datasetURL == "" {
-		datasetURL = pal.versioner.Repo
-	}
-	//Open download location dir
-	if err := os.MkdirAll(sdsshared.LocalDownloadDir, 0755); err != nil {
-		return err
-	}
-	//Download
-	client := sdsshared.NewHTTPClient()
-	resp, err := client.Get(datasetURL)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	//create file in download folder
-	file, err := os.Create(path.Join(sdsshared.LocalDownloadDir, "datasetupdate.zip"))
-	defer file.Close()
-	if err != nil {
-		return err
-	}
-	io.Copy(file, resp.Body)
-
-	return nil
+//The archive is verified against its manifest, see sdsshared.DownloadVerifiedDataset.
+// An archive failing verification is removed and a *sdsshared.VerificationError returned
+//
+//The download is abandoned when ctx is done
+func (pal *Palawan) fetchDataset(ctx context.Context, src sdsshared.DatasetSource) (string, error) {
+	archive, _, err := sdsshared.DownloadVerifiedDataset(ctx, src)
+	return archive, err
 }
 
-//loadDataset loads a dataset from a zip archive containing .bak files to an open badgerdb instance
+//loadDataset loads a dataset from the zip archive at fileLoc containing .bak files to an open
+// badgerdb instance
+//
+//If dbToLoad is nil, it loads the data directly into the mounted database, holding the
+// write lock so reads wait until the load is complete
 //
-//If dbToLoad is nil, it loads the data directly into the pal.Database instance
-func (pal *Palawan) loadDataset(dbToLoad *badger.DB) (*badger.DB, error) {
-	fileLoc := path.Join(sdsshared.LocalDownloadDir, "datasetupdate.zip")
+//The number of records loaded is reported to the sdsshared.Progress carried by ctx
+func (pal *Palawan) loadDataset(ctx context.Context, fileLoc string, dbToLoad *badger.DB) (*badger.DB, error) {
 	lockFirst := false
 	//get usable target database
 	if dbToLoad == nil {
-		dbToLoad = pal.Database
+		pal.mu.RLock()
+		if pal.db == nil {
+			pal.mu.RUnlock()
+			return nil, errClosed
+		}
+		dbToLoad = pal.db.db
+		pal.mu.RUnlock()
 		lockFirst = true
 	}
 	//open zip
@@ -345,8 +949,10 @@ func (pal *Palawan) loadDataset(dbToLoad *badger.DB) (*badger.DB, error) {
 	}
 	//load backup file(s)
 	files := zipR.File
+	progress := sdsshared.ProgressFromContext(ctx)
 	if lockFirst {
 		pal.mu.Lock()
+		defer pal.mu.Unlock()
 	}
 	for _, file := range files {
 		if path.Ext(file.Name) == ".bak" {
@@ -362,12 +968,28 @@ func (pal *Palawan) loadDataset(dbToLoad *badger.DB) (*badger.DB, error) {
 			}
 		}
 	}
+	//badger does not report what Load wrote, so records are counted as they are indexed
+	progress.SetPhase(sdsshared.PhaseIndexing)
+	if err := buildIndexes(ctx, dbToLoad); err != nil {
+		return nil, err
+	}
+	//mark the load complete so a restart can reuse the database
+	if err := dbToLoad.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(loadedKey), []byte(time.Now().Format(time.RFC3339)))
+	}); err != nil {
+		return nil, err
+	}
 	if lockFirst {
-		pal.versioner, err = deriveVersioner(dbToLoad)
+		vs, err := deriveVersioner(dbToLoad)
 		if err != nil {
 			return nil, fmt.Errorf("Error could not deriver versioner in badgerconnect.loadDataset(): %v", err)
 		}
-		pal.mu.Unlock()
+		schema, err := deriveSchema(dbToLoad)
+		if err != nil {
+			return nil, fmt.Errorf("Error could not read value schema in badgerconnect.loadDataset(): %v", err)
+		}
+		pal.setVersioner(vs)
+		pal.db.schema = schema
 	}
 	if err := zipR.Close(); err != nil {
 		return nil, err
@@ -380,28 +1002,73 @@ func (pal *Palawan) loadDataset(dbToLoad *badger.DB) (*badger.DB, error) {
 	return dbToLoad, nil
 }
 
-//mount loads the given badger DB instance to the Palwan instance and closes the existing instance.
+//mount makes the given badger DB instance, the database of generation gen, the database
+// in use and records its version data, tagged with the source revision it was loaded
+// from. The generation metadata is updated and saved.
 //
-//this uses the transitional db field as a crossover point.
-func (pal *Palawan) mount(dbToMount *badger.DB) error {
-	var err error
-	pal.mu.Lock()
-	pal.transitionalDatabase = pal.Database
-	pal.Database = dbToMount
-	//Update pal.versioner
-	pal.versioner, err = deriveVersioner(dbToMount)
+//The previous database is released rather than closed outright: reads already running
+// against it finish first and the last of them closes it
+func (pal *Palawan) mount(dbToMount *badger.DB, gen int, revision string) error {
+	vs, err := deriveVersioner(dbToMount)
 	if err != nil {
 		return err
 	}
-	pal.mu.Unlock()
-	//close old db
-	err = pal.transitionalDatabase.Close()
+	vs.Revision = revision
+	schema, err := deriveSchema(dbToMount)
 	if err != nil {
 		return err
 	}
-	//todo ...
+	pal.mu.Lock()
+	h := pal.newHandle(dbToMount, gen, schema)
+	pal.mu.Unlock()
+	return pal.swap(h, vs)
+}
 
-	return nil
+//swap makes h, holding a reference for the mount, the database in use with version data
+// vs, then saves the generation metadata and releases the previous database
+func (pal *Palawan) swap(h *dbHandle, vs sdsshared.VersionManager) error {
+	pal.mu.Lock()
+	old := pal.db
+	pal.db = h
+	pal.setVersioner(vs)
+	removable := pal.recordGeneration(h.gen)
+	pal.mu.Unlock()
+	pal.saveGenerations(removable)
+	if old == nil {
+		return nil
+	}
+	//close old db once its readers are done
+	return old.release()
+}
+
+//setVersioner replaces pal.versioner with the version data of a loaded dataset. The
+// configured dataset location is kept, falling back to the dataset's own Repo if none
+// was configured. The caller must hold pal.mu
+func (pal *Palawan) setVersioner(vs sdsshared.VersionManager) {
+	if pal.versioner.Repo != "" {
+		vs.Repo = pal.versioner.Repo
+	}
+	pal.versioner = vs
+}
+
+//deriveSchema reads the value schema of the dataset in db. Datasets without one get
+// sdsshared.CodecAuto
+func deriveSchema(db *badger.DB) (sdsshared.ValueSchema, error) {
+	schema := sdsshared.ValueSchema{Codec: sdsshared.CodecAuto}
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(sdsshared.SchemaKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			schema, err = sdsshared.ParseValueSchema(val)
+			return err
+		})
+	})
+	return schema, err
 }
 
 //deriveVersioner creates the Versioner based on the meta fields of the database
@@ -0,0 +1,1008 @@
+package badgerconnector
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdsshared "github.com/RhythmicSound/sdsshared"
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+//newTestPalawan builds a dataset archive of records keys and starts a Palawan serving it
+// from a temporary directory
+func newTestPalawan(t *testing.T, records int) *Palawan {
+	t.Helper()
+	dir := t.TempDir()
+	sdsshared.DebugMode = false
+	sdsshared.DBURI = filepath.Join(dir, "db") + string(filepath.Separator)
+	sdsshared.LocalDownloadDir = filepath.Join(dir, "downloads")
+
+	archive := filepath.Join(dir, "dataset.zip")
+	writeTestArchive(t, filepath.Join(dir, "source"), archive, "1.0.0", records)
+
+	pal := New("test", archive, false)
+	if err := pal.Startup(); err != nil {
+		t.Fatalf("Startup: %v", err)
+	}
+	return pal
+}
+
+//writeTestArchive writes a zip holding a badger backup of records keys and the dataset
+// version to archive
+func writeTestArchive(t *testing.T, dbDir, archive, version string, records int) {
+	t.Helper()
+	entries := make(map[string]string, records)
+	for i := 0; i < records; i++ {
+		entries[fmt.Sprintf("KEY%d/%d", i, i)] = fmt.Sprintf("value%d", i)
+	}
+	writeArchiveEntries(t, dbDir, archive, version, entries)
+}
+
+//writeArchiveEntries writes a zip holding a badger backup of entries and the dataset
+// version to archive
+func writeArchiveEntries(t *testing.T, dbDir, archive, version string, entries map[string]string) {
+	t.Helper()
+	db, err := badger.Open(badger.DefaultOptions(dbDir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Update(func(txn *badger.Txn) error {
+		meta, err := json.Marshal(sdsshared.VersionManager{CurrentVersion: version, LastUpdated: "2021-12-08T21:07:33Z"})
+		if err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("_version"), meta); err != nil {
+			return err
+		}
+		for k, v := range entries {
+			if err := txn.Set([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("dataset.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Backup(w, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//TestRetrieveDuringUpdate reads continuously while updates swap the database. Run it
+// with -race
+func TestRetrieveDuringUpdate(t *testing.T) {
+	pal := newTestPalawan(t, 200)
+	defer pal.Close()
+
+	stop := make(chan struct{})
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%d", (r*31+i)%200)
+				data, err := pal.Retrieve(key, nil)
+				if err != nil {
+					errs <- fmt.Errorf("Retrieve(%q): %v", key, err)
+					return
+				}
+				if data.ResultCount != 1 {
+					errs <- fmt.Errorf("Retrieve(%q) returned %d results, want 1", key, data.ResultCount)
+					return
+				}
+			}
+		}(r)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := pal.UpdateDatasetContext(sdsshared.WithForceUpdate(context.Background())); err != nil {
+			t.Errorf("update %d: %v", i, err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+//TestMountFailureReleasesLock checks a database that cannot be mounted leaves the current
+// one in service
+func TestMountFailureReleasesLock(t *testing.T) {
+	pal := newTestPalawan(t, 10)
+	defer pal.Close()
+
+	empty, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if err := pal.mount(empty, 99, ""); err == nil {
+		t.Fatal("mount of a database without _version succeeded")
+	}
+	if _, err := pal.Retrieve("key1", nil); err != nil {
+		t.Fatalf("Retrieve after failed mount: %v", err)
+	}
+}
+
+func TestRetrieveAfterClose(t *testing.T) {
+	pal := newTestPalawan(t, 10)
+	if err := pal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pal.Retrieve("key1", nil); err != errClosed {
+		t.Fatalf("Retrieve after Close returned %v, want %v", err, errClosed)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	pal := newTestPalawan(t, 10)
+	defer pal.Close()
+	sdsshared.KeepGenerations = 2
+	defer func() { sdsshared.KeepGenerations = 3 }()
+
+	repo := pal.version().Repo
+	for i, version := range []string{"2.0.0", "3.0.0"} {
+		writeTestArchive(t, filepath.Join(t.TempDir(), "source"), repo, version, 10)
+		if _, err := pal.UpdateDataset(); err != nil {
+			t.Fatalf("update %d: %v", i, err)
+		}
+	}
+	gens := pal.Generations()
+	if len(gens) != 2 || gens[0].Dataset.CurrentVersion != "2.0.0" || !gens[1].Current {
+		t.Fatalf("Generations() = %+v, want 2.0.0 and current 3.0.0", gens)
+	}
+	if _, err := os.Stat(generationPath(0)); !os.IsNotExist(err) {
+		t.Errorf("pruned generation 0 still on disk: %v", err)
+	}
+
+	vm, err := pal.Rollback(context.Background(), -1)
+	if err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if vm.CurrentVersion != "2.0.0" {
+		t.Fatalf("Rollback mounted version %q, want 2.0.0", vm.CurrentVersion)
+	}
+	if _, err := pal.Retrieve("key1", nil); err != nil {
+		t.Fatalf("Retrieve after Rollback: %v", err)
+	}
+	if _, err := pal.Rollback(context.Background(), -1); err == nil {
+		t.Fatal("Rollback past the oldest kept generation succeeded")
+	}
+	//the archive is still the 3.0.0 dataset that was rolled back from
+	if _, err := pal.UpdateDataset(); !errors.Is(err, sdsshared.ErrUpToDate) {
+		t.Fatalf("update after Rollback returned %v, want ErrUpToDate", err)
+	}
+
+	//the rolled back generation is what a restart finds current
+	saved, err := loadGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Current != gens[0].Generation || saved.Next != 3 {
+		t.Fatalf("saved generations = %+v, want current %d and next 3", saved, gens[0].Generation)
+	}
+}
+
+//TestRollbackToOpenGeneration rolls back to a generation a slow reader still has open,
+// which badger's directory lock stops being opened a second time
+func TestRollbackToOpenGeneration(t *testing.T) {
+	pal := newTestPalawan(t, 10)
+	defer pal.Close()
+
+	reader, _, err := pal.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestArchive(t, filepath.Join(t.TempDir(), "source"), pal.version().Repo, "2.0.0", 10)
+	if _, err := pal.UpdateDataset(); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	vm, err := pal.Rollback(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("Rollback to a generation still open: %v", err)
+	}
+	if vm.CurrentVersion != "1.0.0" {
+		t.Fatalf("Rollback mounted version %q, want 1.0.0", vm.CurrentVersion)
+	}
+	//the slow reader finishing must not close the database now in use again
+	releaseHandle(reader)
+	if _, err := pal.Retrieve("key1", nil); err != nil {
+		t.Fatalf("Retrieve after the reader finished: %v", err)
+	}
+	if _, err := pal.Rollback(context.Background(), 1); err != nil {
+		t.Fatalf("Rollback forward: %v", err)
+	}
+	if _, err := pal.Retrieve("key1", nil); err != nil {
+		t.Fatalf("Retrieve after rolling forward: %v", err)
+	}
+}
+
+//TestStartupRemovesOnlyStartedGenerations checks startup only sweeps generations the
+// metadata recorded as started, leaving other directories alone
+func TestStartupRemovesOnlyStartedGenerations(t *testing.T) {
+	pal := newTestPalawan(t, 10)
+	repo := pal.version().Repo
+	if err := pal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gens, err := loadGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a generation whose update crashed after creating its directory
+	started := gens.start()
+	if err := gens.save(); err != nil {
+		t.Fatal(err)
+	}
+	unknown := generationPath(started + 10)
+	for _, dir := range []string{generationPath(started), unknown} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted := New("test", repo, false)
+	if err := restarted.Startup(); err != nil {
+		t.Fatalf("Startup: %v", err)
+	}
+	defer restarted.Close()
+	if _, err := os.Stat(generationPath(started)); !os.IsNotExist(err) {
+		t.Errorf("started generation %d was not removed: %v", started, err)
+	}
+	if _, err := os.Stat(unknown); err != nil {
+		t.Errorf("directory the metadata never recorded was removed: %v", err)
+	}
+	saved, err := loadGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Started) != 0 {
+		t.Errorf("saved started generations = %v, want none", saved.Started)
+	}
+}
+
+func TestStartupReusesGeneration(t *testing.T) {
+	pal := newTestPalawan(t, 10)
+	repo := pal.version().Repo
+	if err := pal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//with the archive gone the restart can only succeed by reusing the loaded database
+	if err := os.Remove(repo); err != nil {
+		t.Fatal(err)
+	}
+	restarted := New("test", repo, false)
+	if err := restarted.Startup(); err != nil {
+		t.Fatalf("Startup after restart: %v", err)
+	}
+	defer restarted.Close()
+	if gens := restarted.Generations(); len(gens) != 1 || gens[0].Generation != 0 {
+		t.Fatalf("Generations() = %+v, want generation 0 only", gens)
+	}
+	if vm := restarted.version(); vm.CurrentVersion != "1.0.0" {
+		t.Fatalf("restarted with version %q, want 1.0.0", vm.CurrentVersion)
+	}
+	if _, err := restarted.Retrieve("key1", nil); err != nil {
+		t.Fatalf("Retrieve after restart: %v", err)
+	}
+}
+
+func TestRetrieveQuery(t *testing.T) {
+	pal := newTestPalawan(t, 0)
+	defer pal.Close()
+	h, _, err := pal.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.Update(func(txn *badger.Txn) error {
+		for _, ts := range []int{1000, 2000, 3000, 4000} {
+			value := fmt.Sprintf(`{"n":%d,"name":"x%d","other":true}`, ts, ts)
+			if err := txn.Set([]byte(fmt.Sprintf("ITEM/%d", ts)), []byte(value)); err != nil {
+				return err
+			}
+		}
+		//a longer key sharing the prefix is not an exact match
+		return txn.Set([]byte("ITEM/SUB/5000"), []byte("{}"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	releaseHandle(h)
+
+	tests := []struct {
+		options map[string]string
+		want    []int64
+	}{
+		{map[string]string{}, []int64{1000, 2000, 3000, 4000}},
+		{map[string]string{"order": "newest"}, []int64{4000, 3000, 2000, 1000}},
+		{map[string]string{"order": "newest", "limit": "2", "offset": "1"}, []int64{3000, 2000}},
+		{map[string]string{"since": "2000", "until": "4000"}, []int64{2000, 3000}},
+	}
+	for _, tt := range tests {
+		q, err := sdsshared.NewQuery("item", tt.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := pal.RetrieveQuery(context.Background(), q)
+		if err != nil {
+			t.Fatalf("RetrieveQuery(%v): %v", tt.options, err)
+		}
+		var got []int64
+		for _, rec := range data.Data.Values.([]sdsshared.Record) {
+			got = append(got, rec.Timestamp)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("RetrieveQuery(%v) timestamps = %v, want %v", tt.options, got, tt.want)
+		}
+	}
+
+	q, err := sdsshared.NewQuery("item", map[string]string{"fields": "name", "limit": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := pal.RetrieveQuery(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projected, err := json.Marshal(data.Data.Values.([]sdsshared.Record)[0].Value)
+	if err != nil || string(projected) != `{"name":"x1000"}` {
+		t.Errorf("projected value = %s, %v, want {\"name\":\"x1000\"}", projected, err)
+	}
+}
+
+//TestRetrievePages pages through a predictive lookup matching every key
+func TestRetrievePages(t *testing.T) {
+	pal := newTestPalawan(t, 25)
+	defer pal.Close()
+	pal.predictiveMode = true
+
+	for _, order := range []string{sdsshared.OrderOldest, sdsshared.OrderNewest} {
+		seen := make(map[string]bool)
+		options := map[string]string{"limit": "10", "order": order}
+		for pages := 1; ; pages++ {
+			q, err := sdsshared.NewQuery("key", options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := pal.RetrieveQuery(context.Background(), q)
+			if err != nil {
+				t.Fatalf("%s page %d: %v", order, pages, err)
+			}
+			for _, rec := range data.Data.Values.([]sdsshared.Record) {
+				if seen[rec.Key] {
+					t.Fatalf("%s page %d repeated %s", order, pages, rec.Key)
+				}
+				seen[rec.Key] = true
+			}
+			if data.NextCursor == "" {
+				if pages != 3 || len(seen) != 25 {
+					t.Fatalf("%s: %d records over %d pages, want 25 over 3", order, len(seen), pages)
+				}
+				break
+			}
+			options["cursor"] = data.NextCursor
+		}
+	}
+
+	q, err := sdsshared.NewQuery("key", map[string]string{"limit": "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := pal.RetrieveQuery(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sdsshared.NewQuery("key", map[string]string{"cursor": data.NextCursor, "order": "newest"}); !errors.Is(err, sdsshared.ErrBadRequest) {
+		t.Errorf("cursor used with the other order gave %v, want ErrBadRequest", err)
+	}
+	q, err = sdsshared.NewQuery("other", map[string]string{"cursor": data.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pal.RetrieveQuery(context.Background(), q); !errors.Is(err, sdsshared.ErrBadRequest) {
+		t.Errorf("cursor used with another term gave %v, want ErrBadRequest", err)
+	}
+}
+
+//stopAfter is a RecordStream failing once it has n records, like a client going away
+type stopAfter struct {
+	collector
+	n int
+}
+
+func (s *stopAfter) Record(rec sdsshared.Record) error {
+	if len(s.records) == s.n {
+		return errors.New("client gone")
+	}
+	return s.collector.Record(rec)
+}
+
+func TestStreamQuery(t *testing.T) {
+	pal := newTestPalawan(t, 25)
+	defer pal.Close()
+	pal.predictiveMode = true
+
+	q, err := sdsshared.NewQuery("key", map[string]string{"limit": "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &collector{}
+	next, err := pal.StreamQuery(context.Background(), q, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.meta.Resource != pal.ResourceName || len(c.records) != 10 || next == "" {
+		t.Errorf("got resource %q, %d records, cursor %q; want %q, 10 and a cursor", c.meta.Resource, len(c.records), next, pal.ResourceName)
+	}
+
+	q, err = sdsshared.NewQuery("key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stopAfter{n: 3}
+	if _, err := pal.StreamQuery(context.Background(), q, s); err == nil || len(s.records) != 3 {
+		t.Errorf("stream error gave %v after %d records, want the error after 3", err, len(s.records))
+	}
+}
+
+func TestValueSchema(t *testing.T) {
+	pal := newTestPalawan(t, 0)
+	defer pal.Close()
+
+	tests := []struct {
+		schema string
+		value  string
+		want   string
+	}{
+		//datasets without a schema have JSON objects decoded and other values left as they are
+		{"", `{"lat":"51.45"}`, `{"lat":"51.45"}`},
+		{"", `plain`, `"plain"`},
+		{`{"codec":"raw"}`, `{"lat":"51.45"}`, `"{\"lat\":\"51.45\"}"`},
+		{`{"codec":"json","fields":{"lat":"number","pop":"integer","ok":"bool"}}`, `{"lat":"51.45","pop":"12","ok":"true","name":"x"}`, `{"lat":51.45,"name":"x","ok":true,"pop":12}`},
+		{`{"codec":"msgpack"}`, "\x82\xa1a\x01\xa1b\x92\xc3\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00", `{"a":1,"b":[true,1.5]}`},
+	}
+	repo := pal.version().Repo
+	for i, tt := range tests {
+		entries := map[string]string{"ITEM/1000": tt.value}
+		if tt.schema != "" {
+			entries[sdsshared.SchemaKey] = tt.schema
+		}
+		writeArchiveEntries(t, filepath.Join(t.TempDir(), "source"), repo, fmt.Sprintf("%d.0.0", i+2), entries)
+		if _, err := pal.UpdateDataset(); err != nil {
+			t.Fatalf("update with schema %s: %v", tt.schema, err)
+		}
+		data, err := pal.Retrieve("item", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(data.Data.Values.(map[string]interface{})["1000"])
+		if err != nil || string(got) != tt.want {
+			t.Errorf("schema %s: value = %s, %v, want %s", tt.schema, got, err, tt.want)
+		}
+	}
+}
+
+func TestMatchModes(t *testing.T) {
+	pal := newTestPalawan(t, 0)
+	defer pal.Close()
+	writeArchiveEntries(t, filepath.Join(t.TempDir(), "source"), pal.version().Repo, "2.0.0", map[string]string{
+		"SE12 9TA/1000": "a",
+		"SE12 9TB/2000": "b",
+		"SE1 2AA/3000":  "c",
+		"N1 1AA/4000":   "d",
+	})
+	if _, err := pal.UpdateDataset(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		term    string
+		options map[string]string
+		want    string
+	}{
+		{"se12 9ta", nil, "[SE12 9TA]"},
+		{"se129ta", nil, "[]"},
+		{"se129ta", map[string]string{"match": "normalised"}, "[SE12 9TA]"},
+		{" Se-12 9tA ", map[string]string{"match": "normalised"}, "[SE12 9TA]"},
+		{"SE12", map[string]string{"match": "prefix"}, "[SE12 9TA SE12 9TB]"},
+		{"se129tx", map[string]string{"match": "fuzzy"}, "[SE12 9TA SE12 9TB]"},
+		{"se12t9a", map[string]string{"match": "fuzzy"}, "[SE12 9TA]"},
+		{"se129ta", map[string]string{"match": "fuzzy", "distance": "0"}, "[SE12 9TA]"},
+		{"se129tx", map[string]string{"match": "fuzzy", "order": "newest"}, "[SE12 9TB SE12 9TA]"},
+		{"n11ab", map[string]string{"match": "fuzzy"}, "[N1 1AA]"},
+	}
+	for _, tt := range tests {
+		q, err := sdsshared.NewQuery(tt.term, tt.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := pal.RetrieveQuery(context.Background(), q)
+		if err != nil {
+			t.Errorf("%q %v: %v", tt.term, tt.options, err)
+			continue
+		}
+		keys := []string{}
+		for _, rec := range data.Data.Values.([]sdsshared.Record) {
+			keys = append(keys, rec.Key)
+		}
+		if got := fmt.Sprint(keys); got != tt.want {
+			t.Errorf("%q %v found %s, want %s", tt.term, tt.options, got, tt.want)
+		}
+	}
+
+	//fuzzy matches page like any other
+	q, err := sdsshared.NewQuery("se129tx", map[string]string{"match": "fuzzy", "limit": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := pal.RetrieveQuery(context.Background(), q)
+	if err != nil || first.NextCursor == "" {
+		t.Fatalf("first page: %v, cursor %q", err, first.NextCursor)
+	}
+	q, err = sdsshared.NewQuery("se129tx", map[string]string{"match": "fuzzy", "limit": "1", "cursor": first.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pal.RetrieveQuery(context.Background(), q)
+	if err != nil || second.NextCursor != "" || second.Data.Values.([]sdsshared.Record)[0].Key != "SE12 9TB" {
+		t.Errorf("second page = %+v, %v, want SE12 9TB and no cursor", second.Data.Values, err)
+	}
+
+	for _, options := range []map[string]string{{"match": "sounds-like"}, {"match": "fuzzy", "distance": "2"}} {
+		q, err := sdsshared.NewQuery("se129ta", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pal.RetrieveQuery(context.Background(), q); !errors.Is(err, sdsshared.ErrBadRequest) {
+			t.Errorf("%v gave %v, want ErrBadRequest", options, err)
+		}
+	}
+}
+
+func TestFieldIndexes(t *testing.T) {
+	pal := newTestPalawan(t, 0)
+	defer pal.Close()
+	writeArchiveEntries(t, filepath.Join(t.TempDir(), "source"), pal.version().Repo, "2.0.0", map[string]string{
+		sdsshared.SchemaKey: `{"codec":"json","indexes":["district","tags","limit"]}`,
+		"SE12 9TA/1000":     `{"district":"Lewisham","region":"London","tags":["a","b"]}`,
+		"SE12 9TB/2000":     `{"district":"lewisham ","tags":["b"],"limit":"x"}`,
+		"N1 1AA/3000":       `{"district":"Islington","tags":["a"]}`,
+	})
+	if _, err := pal.UpdateDataset(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		term    string
+		options map[string]string
+		want    string
+	}{
+		{"", map[string]string{"district": "LEWISHAM"}, "[SE12 9TA SE12 9TB]"},
+		{"", map[string]string{"district": "lewisham", "tags": "a"}, "[SE12 9TA]"},
+		{"", map[string]string{"district": "lewisham", "order": "newest"}, "[SE12 9TB SE12 9TA]"},
+		{"", map[string]string{"district": "Camden"}, "[]"},
+		{"n1 1aa", map[string]string{"tags": "a"}, "[N1 1AA]"},
+		{"SE12", map[string]string{"match": "prefix", "tags": "a"}, "[SE12 9TA]"},
+		{"se129tx", map[string]string{"match": "fuzzy", "tags": "b"}, "[SE12 9TA SE12 9TB]"},
+	}
+	for _, tt := range tests {
+		q, err := sdsshared.NewQuery(tt.term, tt.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := pal.RetrieveQuery(context.Background(), q)
+		if err != nil {
+			t.Errorf("%q %v: %v", tt.term, tt.options, err)
+			continue
+		}
+		keys := []string{}
+		for _, rec := range data.Data.Values.([]sdsshared.Record) {
+			keys = append(keys, rec.Key)
+		}
+		if got := fmt.Sprint(keys); got != tt.want {
+			t.Errorf("%q %v found %s, want %s", tt.term, tt.options, got, tt.want)
+		}
+	}
+
+	//fields that are not indexed, and indexed fields named like a reserved option, are
+	// not filters
+	for _, options := range []map[string]string{{"region": "London"}, {"limit": "1"}} {
+		q, err := sdsshared.NewQuery("", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pal.RetrieveQuery(context.Background(), q); !errors.Is(err, sdsshared.ErrBadRequest) {
+			t.Errorf("%v without a term gave %v, want ErrBadRequest", options, err)
+		}
+	}
+}
+
+func TestGeoLookup(t *testing.T) {
+	pal := newTestPalawan(t, 0)
+	defer pal.Close()
+	writeArchiveEntries(t, filepath.Join(t.TempDir(), "source"), pal.version().Repo, "2.0.0", map[string]string{
+		sdsshared.SchemaKey: `{"codec":"json","geo":{"lat":"lat","lon":"lng"}}`,
+		"SW1A 0AA/1000":     `{"lat":51.4998,"lng":-0.1247}`,
+		"SE1 7PB/2000":      `{"lat":"51.5033","lng":"-0.1196"}`,
+		"EC3N 4AB/3000":     `{"lat":51.5081,"lng":-0.0759}`,
+		"M1 1AE/4000":       `{"lat":53.4808,"lng":-2.2426}`,
+		"ZZ1 1ZZ/5000":      `{"name":"nowhere"}`,
+	})
+	if _, err := pal.UpdateDataset(); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(term string, options map[string]string) ([]sdsshared.Record, string, error) {
+		q, err := sdsshared.NewQuery(term, options)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := pal.RetrieveQuery(context.Background(), q)
+		if err != nil {
+			return nil, "", err
+		}
+		return data.Data.Values.([]sdsshared.Record), data.NextCursor, nil
+	}
+	keys := func(records []sdsshared.Record) string {
+		out := []string{}
+		for _, rec := range records {
+			out = append(out, rec.Key)
+		}
+		return fmt.Sprint(out)
+	}
+
+	tests := []struct {
+		term    string
+		options map[string]string
+		want    string
+	}{
+		{"", map[string]string{"near": "51.4998,-0.1247"}, "[SW1A 0AA SE1 7PB]"},
+		{"", map[string]string{"near": "51.4998,-0.1247", "radius": "5000"}, "[SW1A 0AA SE1 7PB EC3N 4AB]"},
+		{"", map[string]string{"near": "51.5081,-0.0759", "radius": "5000"}, "[EC3N 4AB SE1 7PB SW1A 0AA]"},
+		{"", map[string]string{"bbox": "51.49,-0.13,51.51,-0.1"}, "[SE1 7PB SW1A 0AA]"},
+		{"", map[string]string{"bbox": "50,-3,54,0", "near": "53,-2", "radius": "100000"}, "[M1 1AE]"},
+		{"SE1", map[string]string{"match": "prefix", "near": "51.4998,-0.1247", "radius": "5000"}, "[SE1 7PB]"},
+	}
+	for _, tt := range tests {
+		records, _, err := fetch(tt.term, tt.options)
+		if err != nil {
+			t.Errorf("%q %v: %v", tt.term, tt.options, err)
+			continue
+		}
+		if got := keys(records); got != tt.want {
+			t.Errorf("%q %v found %s, want %s", tt.term, tt.options, got, tt.want)
+		}
+	}
+
+	//near results carry their distance and page nearest first
+	options := map[string]string{"near": "51.4998,-0.1247", "radius": "5000", "limit": "2"}
+	records, cursor, err := fetch("", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Distance == nil || *records[0].Distance > 1 || records[1].Distance == nil || *records[1].Distance < 400 || *records[1].Distance > 600 {
+		t.Errorf("unexpected distances %v, %v", records[0].Distance, records[1].Distance)
+	}
+	if cursor == "" {
+		t.Fatal("no next_cursor for a cut short near query")
+	}
+	options["cursor"] = cursor
+	if records, _, err = fetch("", options); err != nil || keys(records) != "[EC3N 4AB]" {
+		t.Errorf("second page found %s, %v, want [EC3N 4AB]", keys(records), err)
+	}
+
+	for _, options := range []map[string]string{
+		{"near": "91,0"},
+		{"near": "51.5"},
+		{"near": "51.5,0", "radius": "0"},
+		{"radius": "100"},
+		{"bbox": "52,0,51,1"},
+	} {
+		if _, _, err := fetch("", options); !errors.Is(err, sdsshared.ErrBadRequest) {
+			t.Errorf("%v gave %v, want ErrBadRequest", options, err)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	pal := newTestPalawan(t, 0)
+	defer pal.Close()
+	writeArchiveEntries(t, filepath.Join(t.TempDir(), "source"), pal.version().Repo, "2.0.0", map[string]string{
+		sdsshared.SchemaKey: `{"codec":"json","indexes":["district"],"search":{"fields":["name","tags"],"stem":true}}`,
+		"SE1 7PB/1000":      `{"name":"Waterloo Station","tags":["railway","trains"],"district":"Lambeth"}`,
+		"SE1 8SW/2000":      `{"name":"Waterloo East","tags":["railway"],"district":"Southwark"}`,
+		"SE1 9SG/3000":      `{"name":"London Bridge Station","district":"Southwark"}`,
+		"N1C 4QL/4000":      `{"name":"Kings Cross, the station of stations","district":"Camden"}`,
+		"ZZ1 1ZZ/5000":      `{"district":"Camden"}`,
+	})
+	if _, err := pal.UpdateDataset(); err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(term string, options map[string]string) ([]sdsshared.Record, string, error) {
+		q, err := sdsshared.NewQuery(term, options)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := pal.RetrieveQuery(context.Background(), q)
+		if err != nil {
+			return nil, "", err
+		}
+		return data.Data.Values.([]sdsshared.Record), data.NextCursor, nil
+	}
+	keys := func(records []sdsshared.Record) string {
+		out := []string{}
+		for _, rec := range records {
+			out = append(out, rec.Key)
+		}
+		return fmt.Sprint(out)
+	}
+
+	tests := []struct {
+		term    string
+		options map[string]string
+		want    string
+	}{
+		//repeats and shorter values rank higher
+		{"", map[string]string{"q": "stations"}, "[N1C 4QL SE1 9SG SE1 7PB]"},
+		{"", map[string]string{"q": "Waterloo station"}, "[SE1 7PB]"},
+		{"", map[string]string{"q": "waterloo station", "op": "or"}, "[SE1 7PB SE1 8SW N1C 4QL SE1 9SG]"},
+		{"", map[string]string{"q": "railways"}, "[SE1 8SW SE1 7PB]"},
+		{"", map[string]string{"q": "train"}, "[SE1 7PB]"},
+		{"", map[string]string{"q": "station", "district": "southwark"}, "[SE1 9SG]"},
+		{"SE1", map[string]string{"match": "prefix", "q": "station"}, "[SE1 9SG SE1 7PB]"},
+		{"", map[string]string{"q": "paddington"}, "[]"},
+	}
+	for _, tt := range tests {
+		records, _, err := fetch(tt.term, tt.options)
+		if err != nil {
+			t.Errorf("%q %v: %v", tt.term, tt.options, err)
+			continue
+		}
+		if got := keys(records); got != tt.want {
+			t.Errorf("%q %v found %s, want %s", tt.term, tt.options, got, tt.want)
+		}
+	}
+
+	//results carry their scores and page most relevant first
+	options := map[string]string{"q": "station", "limit": "2"}
+	records, cursor, err := fetch("", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Score == nil || records[1].Score == nil || *records[0].Score < *records[1].Score {
+		t.Errorf("unexpected scores %v, %v", records[0].Score, records[1].Score)
+	}
+	options["cursor"] = cursor
+	if records, _, err = fetch("", options); err != nil || keys(records) != "[SE1 7PB]" {
+		t.Errorf("second page found %s, %v, want [SE1 7PB]", keys(records), err)
+	}
+
+	for _, options := range []map[string]string{
+		{"q": "..."},
+		{"q": "station", "op": "xor"},
+		{"op": "or"},
+	} {
+		if _, _, err := fetch("", options); !errors.Is(err, sdsshared.ErrBadRequest) {
+			t.Errorf("%v gave %v, want ErrBadRequest", options, err)
+		}
+	}
+}
+
+func TestRetrieveBatch(t *testing.T) {
+	pal := newTestPalawan(t, 5)
+	defer pal.Close()
+
+	var queries []sdsshared.Query
+	for _, options := range []map[string]string{
+		{"fetch": "key1"},
+		{"fetch": "KEY", "match": "prefix", "limit": "2"},
+		{"fetch": "KEY3", "match": "bogus"},
+		{"fetch": "missing"},
+	} {
+		q, err := sdsshared.NewQuery(options["fetch"], options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, q)
+	}
+	results, err := pal.RetrieveBatch(context.Background(), queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(queries) {
+		t.Fatalf("got %d results for %d queries", len(results), len(queries))
+	}
+	want := []string{"[KEY1]", "[KEY0 KEY1]", "", "[]"}
+	for i, res := range results {
+		if i == 2 {
+			if !errors.Is(res.Err, sdsshared.ErrBadRequest) {
+				t.Errorf("query %d gave %v, want ErrBadRequest", i, res.Err)
+			}
+			continue
+		}
+		if res.Err != nil {
+			t.Errorf("query %d: %v", i, res.Err)
+			continue
+		}
+		keys := []string{}
+		for _, rec := range res.Data.Data.Values.([]sdsshared.Record) {
+			keys = append(keys, rec.Key)
+		}
+		if got := fmt.Sprint(keys); got != want[i] {
+			t.Errorf("query %d found %s, want %s", i, got, want[i])
+		}
+		if res.Data.Meta.Resource != "test" {
+			t.Errorf("query %d has meta %+v", i, res.Data.Meta)
+		}
+	}
+	if results[1].Data.NextCursor == "" {
+		t.Error("no next_cursor for a batch query cut short by its limit")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pal.RetrieveBatch(ctx, queries); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled batch gave %v, want context.Canceled", err)
+	}
+}
+
+//TestRefusedUpdateKeepsDatabase checks an archive failing verification leaves the mounted
+// database in service
+func TestRefusedUpdateKeepsDatabase(t *testing.T) {
+	pal := newTestPalawan(t, 10)
+	defer pal.Close()
+
+	repo := pal.version().Repo
+	writeTestArchive(t, filepath.Join(t.TempDir(), "source"), repo, "2.0.0", 20)
+	manifest := `{"version":"2.0.0","sha256":"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}`
+	if err := os.WriteFile(repo+sdsshared.ManifestSuffix, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := pal.UpdateDatasetContext(sdsshared.WithForceUpdate(context.Background()))
+	if !errors.Is(err, sdsshared.ErrVerificationFailed) {
+		t.Fatalf("update with a mismatched manifest returned %v, want ErrVerificationFailed", err)
+	}
+	if v := pal.version().CurrentVersion; v != "1.0.0" {
+		t.Errorf("version after refused update = %q, want 1.0.0", v)
+	}
+	if _, err := pal.Retrieve("key1", nil); err != nil {
+		t.Errorf("Retrieve after refused update: %v", err)
+	}
+	if data, err := pal.Retrieve("key15", nil); err == nil && data.ResultCount != 0 {
+		t.Errorf("refused dataset is being served: %+v", data)
+	}
+	if gens := pal.Generations(); len(gens) != 1 {
+		t.Errorf("refused update left generations %+v", gens)
+	}
+}
+
+//countingProgress records the progress reported by an update
+type countingProgress struct {
+	mu      sync.Mutex
+	phases  []string
+	records int64
+}
+
+func (cp *countingProgress) SetPhase(phase string) {
+	cp.mu.Lock()
+	cp.phases = append(cp.phases, phase)
+	cp.mu.Unlock()
+}
+func (cp *countingProgress) SetBytesTotal(int64) {}
+func (cp *countingProgress) AddBytes(int64)      {}
+func (cp *countingProgress) AddRecords(n int64) {
+	cp.mu.Lock()
+	cp.records += n
+	cp.mu.Unlock()
+}
+
+func TestUpdateProgress(t *testing.T) {
+	pal := newTestPalawan(t, 10)
+	defer pal.Close()
+
+	writeTestArchive(t, filepath.Join(t.TempDir(), "source"), pal.version().Repo, "2.0.0", 25)
+	cp := &countingProgress{}
+	if _, err := pal.UpdateDatasetContext(sdsshared.WithProgress(context.Background(), cp)); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if cp.records != 25 {
+		t.Errorf("update reported %d records loaded, want 25", cp.records)
+	}
+	//jobs start in PhaseChecking without it being reported
+	want := []string{sdsshared.PhaseDownloading, sdsshared.PhaseVerifying, sdsshared.PhaseLoading, sdsshared.PhaseIndexing, sdsshared.PhaseMounting}
+	if fmt.Sprint(cp.phases) != fmt.Sprint(want) {
+		t.Errorf("update phases %v, want %v", cp.phases, want)
+	}
+}
+
+//TestUpdateSkipsUnchangedDataset serves the archive over HTTP and checks an update only
+// downloads it once its Last-Modified revision changes
+func TestUpdateSkipsUnchangedDataset(t *testing.T) {
+	dir := t.TempDir()
+	sdsshared.DebugMode = false
+	sdsshared.DBURI = filepath.Join(dir, "db") + string(filepath.Separator)
+	sdsshared.LocalDownloadDir = filepath.Join(dir, "downloads")
+	served := filepath.Join(dir, "served")
+	if err := os.Mkdir(served, 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(served, "dataset.zip")
+	writeTestArchive(t, filepath.Join(t.TempDir(), "source"), archive, "1.0.0", 10)
+
+	var downloads int32
+	fs := http.FileServer(http.Dir(served))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/dataset.zip" {
+			atomic.AddInt32(&downloads, 1)
+		}
+		fs.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	pal := New("test", srv.URL+"/dataset.zip", false)
+	if err := pal.Startup(); err != nil {
+		t.Fatalf("Startup: %v", err)
+	}
+	defer pal.Close()
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Fatalf("Startup downloaded the archive %d times, want 1", n)
+	}
+
+	if _, err := pal.UpdateDatasetContext(context.Background()); !errors.Is(err, sdsshared.ErrUpToDate) {
+		t.Fatalf("update of an unchanged dataset returned %v, want ErrUpToDate", err)
+	}
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("update of an unchanged dataset downloaded it, %d downloads", n)
+	}
+
+	writeTestArchive(t, filepath.Join(t.TempDir(), "source"), archive, "2.0.0", 20)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(archive, later, later); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := pal.UpdateDatasetContext(context.Background())
+	if err != nil {
+		t.Fatalf("update of a changed dataset: %v", err)
+	}
+	if vm.CurrentVersion != "2.0.0" {
+		t.Errorf("version after update = %q, want 2.0.0", vm.CurrentVersion)
+	}
+	if n := atomic.LoadInt32(&downloads); n != 2 {
+		t.Errorf("update of a changed dataset made %d downloads in total, want 2", n)
+	}
+}
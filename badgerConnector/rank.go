@@ -0,0 +1,63 @@
+package badgerconnector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+
+	sdsshared "github.com/RhythmicSound/sdsshared"
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+//rankedHit is a record found through an index whose results are ranked rather than in
+// key order, such as by distance or relevance
+type rankedHit struct {
+	kvKey []byte
+	//orderKey is the rank followed by kvKey, so that equal ranks go in key order. Cursors
+	// of ranked results continue after the orderKey of the last record
+	orderKey []byte
+	//rec is the record without its value
+	rec sdsshared.Record
+}
+
+//newRankedHit returns the hit for the record stored under kvKey with a rank of at least
+// 0, ordered lowest rank first or, if descending, highest first
+func newRankedHit(rank float64, descending bool, kvKey []byte, rec sdsshared.Record) rankedHit {
+	//the bits of non negative floats sort in the same order as the floats
+	bits := math.Float64bits(rank)
+	if descending {
+		bits = ^bits
+	}
+	orderKey := make([]byte, 8, 8+len(kvKey))
+	binary.BigEndian.PutUint64(orderKey, bits)
+	return rankedHit{kvKey: kvKey, orderKey: append(orderKey, kvKey...), rec: rec}
+}
+
+//scanRanked is scan for ranked hits. Records are passed in rank order whatever the
+// order option
+func (pal *Palawan) scanRanked(ctx context.Context, txn *badger.Txn, l lookup, hits []rankedHit, fn func(sdsshared.Record) error) (string, error) {
+	sort.Slice(hits, func(i, j int) bool { return bytes.Compare(hits[i].orderKey, hits[j].orderKey) < 0 })
+	p := pager{q: l.q}
+	for _, h := range hits {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if l.q.After != nil && bytes.Compare(h.orderKey, l.q.After) <= 0 {
+			continue
+		}
+		item, err := txn.Get(h.kvKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if err := pal.emit(item, h.orderKey, h.rec, l, &p, fn); err != nil || p.cursor != "" {
+			return p.cursor, err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,307 @@
+package badgerconnector
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"unicode"
+
+	sdsshared "github.com/RhythmicSound/sdsshared"
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+//textStatsKey records the textStats of the search index
+const textStatsKey = indexPrefix + "textstats"
+
+//maxWordLen is the longest word, in bytes, that is indexed for search. Longer runs of
+// letters are rarely words and would only bloat the index
+const maxWordLen = 64
+
+//BM25 ranking parameters: bm25K1 limits how much repeating a word raises a score and
+// bm25B how much long values are penalised
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+//Search operators selected with the op option
+const (
+	//SearchAnd finds records containing every word of the search. It is the default
+	SearchAnd = "and"
+	//SearchOr finds records containing any word of the search
+	SearchOr = "or"
+)
+
+//textStats describes the values indexed for search, for ranking
+type textStats struct {
+	//Docs is the number of records indexed and Words the number of words in them
+	Docs  int64 `json:"docs"`
+	Words int64 `json:"words"`
+}
+
+//textQuery is the search of the q and op options
+type textQuery struct {
+	//words are the distinct indexed forms of the words searched for
+	words []string
+	or    bool
+}
+
+//parseSearch returns the search of q, or nil if it has none
+func parseSearch(q sdsshared.Query, schema sdsshared.ValueSchema, resourceName string) (*textQuery, error) {
+	text, op := q.Options["q"], strings.ToLower(q.Options["op"])
+	if text == "" {
+		if op != "" {
+			return nil, sdsshared.NewError(sdsshared.ErrBadRequest, "op needs a q search")
+		}
+		return nil, nil
+	}
+	if schema.Search == nil {
+		return nil, sdsshared.NewError(sdsshared.ErrNotSupported, "%s has no search fields in its value schema", resourceName)
+	}
+	t := &textQuery{}
+	switch op {
+	case "", SearchAnd:
+	case SearchOr:
+		t.or = true
+	default:
+		return nil, sdsshared.NewError(sdsshared.ErrBadRequest, "op must be %q or %q, got %q", SearchAnd, SearchOr, q.Options["op"])
+	}
+	seen := make(map[string]bool)
+	for _, w := range indexWords(text, schema.Search.Stem) {
+		if !seen[w] {
+			seen[w] = true
+			t.words = append(t.words, w)
+		}
+	}
+	if len(t.words) == 0 {
+		return nil, sdsshared.NewError(sdsshared.ErrBadRequest, "q has no words to search for")
+	}
+	return t, nil
+}
+
+//indexWords splits text into lower cased words of letters and digits, stemmed if stemming
+// is set, as they are indexed
+func indexWords(text string, stemming bool) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	out := words[:0]
+	for _, w := range words {
+		if len(w) > maxWordLen {
+			continue
+		}
+		if stemming {
+			w = stem(w)
+		}
+		out = append(out, w)
+	}
+	return out
+}
+
+//stem reduces an English word to its stem by removing common plural, verb and adverb
+// endings. It is deliberately light: the forms of a word share a stem, but the stem is
+// not always a word itself. Words that are not plain ASCII letters are left alone
+func stem(w string) string {
+	for i := 0; i < len(w); i++ {
+		if w[i] < 'a' || w[i] > 'z' {
+			return w
+		}
+	}
+	if len(w) <= 3 {
+		return w
+	}
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ies") && len(w) > 4:
+		w = w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") && !strings.HasSuffix(w, "us") && !strings.HasSuffix(w, "is"):
+		w = w[:len(w)-1]
+	}
+	for _, suffix := range []string{"ing", "ed", "ly"} {
+		if base := strings.TrimSuffix(w, suffix); base != w && len(base) >= 3 && strings.ContainsAny(base, "aeiouy") {
+			w = base
+			//running to run, stopped to stop
+			if n := len(w); suffix != "ly" && w[n-1] == w[n-2] && !strings.ContainsRune("aeioulsz", rune(w[n-1])) {
+				w = w[:n-1]
+			}
+			break
+		}
+	}
+	if len(w) > 3 && w[len(w)-1] == 'e' {
+		w = w[:len(w)-1]
+	}
+	return w
+}
+
+//indexText adds the search index entries of the decoded value obj, stored under
+// recordKey, counting it in stats. Each entry's value holds how often the word appears in
+// the record and how many words the record has
+func indexText(wb *badger.WriteBatch, obj map[string]interface{}, recordKey []byte, search *sdsshared.SearchFields, stats *textStats) error {
+	counts := make(map[string]uint64)
+	var words uint64
+	for _, field := range search.Fields {
+		for _, text := range textValues(obj[field]) {
+			for _, w := range indexWords(text, search.Stem) {
+				counts[w]++
+				words++
+			}
+		}
+	}
+	if words == 0 {
+		return nil
+	}
+	stats.Docs++
+	stats.Words += int64(words)
+	for w, n := range counts {
+		var val []byte
+		val = appendUvarint(val, n)
+		val = appendUvarint(val, words)
+		if err := wb.Set(indexKey(textIndex, w, recordKey), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//textValues returns the strings of a decoded field value, including those in a list
+func textValues(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, elem := range v {
+			if s, ok := elem.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+//readTextStats returns the textStats of the search index, zero if there is none
+func readTextStats(txn *badger.Txn) (textStats, error) {
+	var stats textStats
+	item, err := txn.Get([]byte(textStatsKey))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &stats)
+	})
+	return stats, err
+}
+
+//textHits returns the records matching l's search and the rest of l, ranked by BM25
+// relevance, highest first
+func textHits(ctx context.Context, txn *badger.Txn, l lookup) ([]rankedHit, error) {
+	stats, err := readTextStats(txn)
+	if err != nil {
+		return nil, err
+	}
+	if stats.Docs == 0 {
+		return nil, nil
+	}
+	avgWords := float64(stats.Words) / float64(stats.Docs)
+	type match struct {
+		kvKey []byte
+		score float64
+		words int
+	}
+	matches := make(map[string]*match)
+	n := 0
+	for _, w := range l.text.words {
+		//the number of records with the word is needed before any can be scored
+		type posting struct {
+			kvKey       []byte
+			count, size uint64
+		}
+		var postings []posting
+		prefix := indexTokenPrefix(textIndex, w)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if n++; n%1000 == 0 {
+				if err := ctx.Err(); err != nil {
+					it.Close()
+					return nil, err
+				}
+			}
+			item := it.Item()
+			p := posting{kvKey: item.KeyCopy(nil)[len(prefix):]}
+			if err := item.Value(func(val []byte) error {
+				var read int
+				p.count, read = binary.Uvarint(val)
+				if read <= 0 {
+					return errors.New("invalid search index entry")
+				}
+				p.size, _ = binary.Uvarint(val[read:])
+				return nil
+			}); err != nil {
+				it.Close()
+				return nil, err
+			}
+			postings = append(postings, p)
+		}
+		it.Close()
+		df := float64(len(postings))
+		idf := math.Log(1 + (float64(stats.Docs)-df+0.5)/(df+0.5))
+		for _, p := range postings {
+			tf := float64(p.count)
+			score := idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(p.size)/avgWords))
+			m, ok := matches[string(p.kvKey)]
+			if !ok {
+				m = &match{kvKey: p.kvKey}
+				matches[string(p.kvKey)] = m
+			}
+			m.score += score
+			m.words++
+		}
+	}
+	var allowed map[string]bool
+	if len(l.filters) > 0 {
+		allowed = make(map[string]bool)
+		for _, k := range filterKeys(txn, l.filters) {
+			allowed[string(k)] = true
+		}
+	}
+	hits := make([]rankedHit, 0, len(matches))
+	for _, m := range matches {
+		if !l.text.or && m.words < len(l.text.words) {
+			continue
+		}
+		if allowed != nil && !allowed[string(m.kvKey)] {
+			continue
+		}
+		key, timestamp, ok := sdsshared.ParseKVStoreKey(string(m.kvKey), keySeparator)
+		if !ok || !l.matches(key) {
+			continue
+		}
+		score := math.Round(m.score*1e4) / 1e4
+		hits = append(hits, newRankedHit(m.score, true, m.kvKey, sdsshared.Record{Key: key, Timestamp: timestamp, Score: &score}))
+	}
+	return hits, nil
+}
+
+//scanText is scan for a full text search, returning the most relevant records first
+func (pal *Palawan) scanText(ctx context.Context, txn *badger.Txn, l lookup, fn func(sdsshared.Record) error) (string, error) {
+	hits, err := textHits(ctx, txn, l)
+	if err != nil {
+		return "", err
+	}
+	return pal.scanRanked(ctx, txn, l, hits, fn)
+}
@@ -0,0 +1,175 @@
+package sdsshared
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//maxBatchBody is the largest /fetch/batch request body read, in bytes
+const maxBatchBody = 8 << 20
+
+//BatchResult is the outcome of one query of a batch
+type BatchResult struct {
+	Data SimpleData
+	//Err is the error of this query alone, such as ErrBadRequest for invalid options
+	Err error
+}
+
+//BatchRetriever is implemented by data resources that can answer many queries at once
+// more cheaply than one at a time, such as by reading every query from one database
+// transaction. The server uses it for /fetch/batch; resources without it have their
+// queries run in turn
+type BatchRetriever interface {
+	//RetrieveBatch returns a result for each query, in order, all read from the same
+	// version of the dataset. An error returned for the whole batch, such as there being
+	// no dataset, fails every query
+	RetrieveBatch(ctx context.Context, queries []Query) ([]BatchResult, error)
+}
+
+//BatchResponse is the body of a /fetch/batch response
+type BatchResponse struct {
+	//ResultCount is the number of queries answered without an error
+	ResultCount int `json:"result_count"`
+	//Results holds the response to each query, in request order. A query that failed has
+	// its error in Errors, as a failed /fetch would
+	Results []SimpleData `json:"results"`
+}
+
+//parseBatch reads the queries of a /fetch/batch body: a JSON array whose items are each
+// a term or an object of /fetch options including fetch. Options in defaults, from the
+// request URL, apply to every query that does not set them
+func parseBatch(body []byte, defaults map[string]string) ([]map[string]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var items []interface{}
+	if err := dec.Decode(&items); err != nil {
+		return nil, NewError(ErrBadRequest, "the body must be a JSON array of terms or option objects: %v", err)
+	}
+	if len(items) == 0 {
+		return nil, NewError(ErrBadRequest, "the batch has no queries")
+	}
+	if MaxBatchSize > 0 && len(items) > MaxBatchSize {
+		return nil, NewError(ErrBadRequest, "the batch has %d queries, at most %d are allowed", len(items), MaxBatchSize)
+	}
+	batch := make([]map[string]string, len(items))
+	for i, item := range items {
+		options := make(map[string]string, len(defaults)+1)
+		for k, v := range defaults {
+			options[k] = v
+		}
+		switch item := item.(type) {
+		case string:
+			options["fetch"] = item
+		case map[string]interface{}:
+			for k, v := range item {
+				switch v := v.(type) {
+				case string:
+					options[k] = v
+				case json.Number, bool:
+					options[k] = fmt.Sprint(v)
+				default:
+					return nil, NewError(ErrBadRequest, "query %d: option %q must be a string, number or bool", i, k)
+				}
+			}
+		default:
+			return nil, NewError(ErrBadRequest, "query %d must be a term or an object of options", i)
+		}
+		batch[i] = options
+	}
+	return batch, nil
+}
+
+//handleBatch answers a POST of many /fetch queries at once with a BatchResponse. The
+// response is 200 if the batch could be run even if some of its queries failed; each
+// failure is reported with its query
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, "Dataset batch fetch error", http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxBatchBody)
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(body); err != nil {
+		writeResourceError(w, "Dataset batch fetch error", NewError(ErrBadRequest, "could not read the body: %v", err))
+		return
+	}
+	defaults := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		defaults[k] = strings.Join(v, ",")
+	}
+	batch, err := parseBatch(buf.Bytes(), defaults)
+	if err != nil {
+		writeResourceError(w, "Dataset batch fetch error", err)
+		return
+	}
+	results := make([]BatchResult, len(batch))
+	//only valid queries go to the data resource
+	var queries []Query
+	var positions []int
+	for i, options := range batch {
+		q, err := NewQuery(options["fetch"], options)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		queries = append(queries, q)
+		positions = append(positions, i)
+	}
+	answers, err := s.retrieveBatch(r.Context(), queries)
+	if err != nil {
+		log.Printf("Error. Could not retrieve batch from data resource: %v", err)
+		writeResourceError(w, "Dataset batch fetch error", err)
+		return
+	}
+	for n, i := range positions {
+		results[i] = answers[n]
+	}
+	out := BatchResponse{Results: make([]SimpleData, len(results))}
+	for i, res := range results {
+		if res.Err != nil {
+			out.Results[i] = SimpleData{
+				RequestOptions: batch[i],
+				Meta:           Meta{Resource: ResourceServiceName},
+				Errors:         map[string]string{"title": "Dataset fetch error", "code": strconv.Itoa(StatusCode(res.Err)), "message": res.Err.Error()},
+			}
+			continue
+		}
+		out.ResultCount++
+		out.Results[i] = res.Data
+	}
+	writeJSON(w, "Dataset batch fetch error", http.StatusOK, out)
+}
+
+//retrieveBatch runs queries against the data resource, as one batch for resources
+// implementing BatchRetriever and otherwise one at a time
+func (s *Server) retrieveBatch(ctx context.Context, queries []Query) ([]BatchResult, error) {
+	if len(queries) == 0 {
+		return nil, nil
+	}
+	if br, ok := s.underlying().(BatchRetriever); ok {
+		results, err := br.RetrieveBatch(ctx, queries)
+		if err == nil && len(results) != len(queries) {
+			err = fmt.Errorf("data resource returned %d batch results for %d queries", len(results), len(queries))
+		}
+		return results, err
+	}
+	results := make([]BatchResult, len(queries))
+	for i, q := range queries {
+		//a dropped request fails the batch rather than every query left in it
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		//batches list records as BatchRetriever does
+		q.Records = true
+		data, err := s.retrieve(ctx, q)
+		results[i] = BatchResult{Data: data, Err: err}
+	}
+	return results, nil
+}
@@ -0,0 +1,176 @@
+package sdsshared
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//echoResource answers each query with its options as the values, so tests can see what
+// reached the data resource. It does not implement BatchRetriever
+type echoResource struct {
+	blockingResource
+	calls int
+}
+
+func (er *echoResource) RetrieveContext(ctx context.Context, term string, options map[string]string) (SimpleData, error) {
+	er.calls++
+	return SimpleData{ResultCount: 1, RequestOptions: options, Data: DataOutput{Values: options}}, nil
+}
+
+//batchEchoResource answers a whole batch at once, dropping the last result if short is set
+type batchEchoResource struct {
+	echoResource
+	batches int
+	short   bool
+}
+
+func (br *batchEchoResource) RetrieveBatch(ctx context.Context, queries []Query) ([]BatchResult, error) {
+	br.batches++
+	results := make([]BatchResult, len(queries))
+	for i, q := range queries {
+		results[i] = BatchResult{Data: SimpleData{ResultCount: 1, RequestOptions: q.Options, Data: DataOutput{Values: q.Options}}}
+	}
+	if br.short {
+		results = results[:len(results)-1]
+	}
+	return results, nil
+}
+
+//postBatch posts body to /fetch/batch with query as the URL query
+func postBatch(s *Server, query, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/fetch/batch?"+query, strings.NewReader(body)))
+	return rec
+}
+
+func TestBatchMethod(t *testing.T) {
+	s := newTestServer(&batchEchoResource{})
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fetch/batch", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status %d, want 405", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != http.MethodPost {
+		t.Errorf("Allow %q, want POST", allow)
+	}
+}
+
+func TestBatchBadRequests(t *testing.T) {
+	defer func(max int) { MaxBatchSize = max }(MaxBatchSize)
+	MaxBatchSize = 3
+	tests := []struct {
+		name, body string
+	}{
+		{"not json", `SE1`},
+		{"object", `{"fetch": "SE1"}`},
+		{"empty", `[]`},
+		{"too many", `["a", "b", "c", "d"]`},
+		{"number item", `["a", 5]`},
+		{"array option", `[{"fetch": "a", "fields": ["lat", "lng"]}]`},
+		{"object option", `[{"fetch": "a", "limit": {"n": 1}}]`},
+		{"null option", `[{"fetch": "a", "limit": null}]`},
+	}
+	for _, tt := range tests {
+		dr := &batchEchoResource{}
+		rec := postBatch(newTestServer(dr), "", tt.body)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400: %s", tt.name, rec.Code, rec.Body)
+		}
+		if dr.batches != 0 {
+			t.Errorf("%s: the data resource was queried", tt.name)
+		}
+	}
+	if rec := postBatch(newTestServer(&batchEchoResource{}), "", `["a", "b", "c"]`); rec.Code != http.StatusOK {
+		t.Errorf("batch of max_batch_size items: status %d, want 200: %s", rec.Code, rec.Body)
+	}
+}
+
+//decodeBatch decodes a 200 /fetch/batch response
+func decodeBatch(t *testing.T, rec *httptest.ResponseRecorder) BatchResponse {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var out BatchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return out
+}
+
+func TestBatchDefaults(t *testing.T) {
+	dr := &batchEchoResource{}
+	body := `["SE1", {"fetch": "SE2", "fields": "name", "limit": 5, "exact": true}]`
+	out := decodeBatch(t, postBatch(newTestServer(dr), "fields=lat,lng&order=newest", body))
+	if dr.batches != 1 || dr.calls != 0 {
+		t.Errorf("%d batches and %d single retrieves, want one batch", dr.batches, dr.calls)
+	}
+	if out.ResultCount != 2 || len(out.Results) != 2 {
+		t.Fatalf("result_count %d with %d results, want 2", out.ResultCount, len(out.Results))
+	}
+	want := []map[string]string{
+		{"fetch": "SE1", "fields": "lat,lng", "order": "newest"},
+		{"fetch": "SE2", "fields": "name", "order": "newest", "limit": "5", "exact": "true"},
+	}
+	for i, res := range out.Results {
+		if len(res.RequestOptions) != len(want[i]) {
+			t.Errorf("item %d options %v, want %v", i, res.RequestOptions, want[i])
+			continue
+		}
+		for k, v := range want[i] {
+			if res.RequestOptions[k] != v {
+				t.Errorf("item %d option %s = %q, want %q", i, k, res.RequestOptions[k], v)
+			}
+		}
+	}
+}
+
+func TestBatchItemErrors(t *testing.T) {
+	for _, dr := range []ContextDataResource{&batchEchoResource{}, &echoResource{}} {
+		body := `["a", {"fetch": "b", "limit": "many"}, {"fetch": "c", "order": "sideways"}, "d"]`
+		out := decodeBatch(t, postBatch(newTestServer(dr), "", body))
+		if out.ResultCount != 2 {
+			t.Errorf("%T: result_count %d, want 2", dr, out.ResultCount)
+		}
+		for i, res := range out.Results {
+			failed := i == 1 || i == 2
+			if failed != (res.Errors != nil) {
+				t.Errorf("%T: item %d errors %v", dr, i, res.Errors)
+			}
+			if failed && res.Errors["code"] != strconv.Itoa(http.StatusBadRequest) {
+				t.Errorf("%T: item %d error code %q, want 400", dr, i, res.Errors["code"])
+			}
+			if !failed && res.ResultCount != 1 {
+				t.Errorf("%T: item %d result_count %d, want 1", dr, i, res.ResultCount)
+			}
+		}
+	}
+}
+
+func TestBatchFallback(t *testing.T) {
+	dr := &echoResource{}
+	out := decodeBatch(t, postBatch(newTestServer(dr), "", `["a", "b", "c"]`))
+	if dr.calls != 3 {
+		t.Errorf("%d single retrieves, want 3", dr.calls)
+	}
+	for i, term := range []string{"a", "b", "c"} {
+		if got := out.Results[i].RequestOptions["fetch"]; got != term {
+			t.Errorf("result %d is for %q, want %q", i, got, term)
+		}
+	}
+}
+
+func TestBatchLengthMismatch(t *testing.T) {
+	rec := postBatch(newTestServer(&batchEchoResource{short: true}), "", `["a", "b"]`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d for a short batch, want 500: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "1 batch results for 2 queries") {
+		t.Errorf("error does not report the mismatch: %s", rec.Body)
+	}
+}
@@ -0,0 +1,200 @@
+package sdsshared
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//Content codings the server compresses responses with
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}}
+	zstdWriters = sync.Pool{New: func() interface{} {
+		//one goroutine and a 1MB window keep pooled encoders small; every browser
+		// decoding zstd accepts windows up to 8MB
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		return enc
+	}}
+)
+
+//compressor is the part of the gzip and zstd writers used for responses
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+//compress wraps h to compress responses with the content coding preferred in the
+// request's Accept-Encoding header. Responses are only compressed once they reach
+// CompressMinSize bytes, or when they are flushed while streaming, so small responses such
+// as most errors are sent as they are
+func compress(h http.Handler) http.Handler {
+	if !Compression {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		coding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if coding == "" || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, coding: coding, status: http.StatusOK}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+//negotiateEncoding returns the supported content coding most preferred by an
+// Accept-Encoding header, zstd on a tie, or "" for none. A "*" entry covers the codings
+// not listed by name, and q=0 rules a coding out
+func negotiateEncoding(acceptEncoding string) string {
+	named := make(map[string]float64)
+	wildcard := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if coding == "*" {
+			wildcard = q
+		} else {
+			named[coding] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range []string{EncodingZstd, EncodingGzip} {
+		q, ok := named[coding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+//compressWriter holds back the status and body of a response until it knows whether to
+// compress it
+type compressWriter struct {
+	http.ResponseWriter
+	coding string
+	status int
+	//buf holds the start of the body until the decision is made
+	buf []byte
+	//decided is set once the headers have gone out, with enc set if compressing
+	decided bool
+	enc     compressor
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if !cw.decided {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(b)
+		}
+		return cw.ResponseWriter.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= CompressMinSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+//Flush sends what has been written so far. A response flushed before it is complete is
+// being streamed and may grow, so it is compressed whatever its size so far
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(len(cw.buf) > 0); err != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//decide writes the held back status, compressing the body from here on if compress is
+// set and the response can be compressed
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified {
+		compress = false
+	}
+	if compress {
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(cw.buf))
+		}
+		h.Set("Content-Encoding", cw.coding)
+		h.Del("Content-Length")
+		switch cw.coding {
+		case EncodingGzip:
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(cw.ResponseWriter)
+			cw.enc = gz
+		case EncodingZstd:
+			zw := zstdWriters.Get().(*zstd.Encoder)
+			zw.Reset(cw.ResponseWriter)
+			cw.enc = zw
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.Write(buf)
+	return err
+}
+
+//close finishes the response once the handler returns
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if cw.enc == nil {
+		return
+	}
+	cw.enc.Close()
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		enc.Reset(nil)
+		gzipWriters.Put(enc)
+	case *zstd.Encoder:
+		enc.Reset(nil)
+		zstdWriters.Put(enc)
+	}
+	cw.enc = nil
+}
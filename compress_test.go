@@ -0,0 +1,216 @@
+package sdsshared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", EncodingGzip},
+		{"zstd", EncodingZstd},
+		{"gzip, deflate, br, zstd", EncodingZstd},
+		{"gzip;q=1.0, zstd;q=0.5", EncodingGzip},
+		{"*", EncodingZstd},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, zstd;q=0", ""},
+		//q=0 rules a coding out even when a wildcard would allow it
+		{"zstd;q=0, *", EncodingGzip},
+		{"*;q=0.5, gzip;q=0", EncodingZstd},
+		{"gzip, *;q=0", EncodingGzip},
+		{"zstd;q=bad, gzip", EncodingGzip},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+//decodeBody returns the body of w decoded from its Content-Encoding
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	switch w.Header().Get("Content-Encoding") {
+	case EncodingGzip:
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	case EncodingZstd:
+		zr, err := zstd.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		out, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	return w.Body.String()
+}
+
+func TestCompress(t *testing.T) {
+	defer func(min int) { CompressMinSize = min }(CompressMinSize)
+	CompressMinSize = 100
+	small := "short"
+	large := string(bytes.Repeat([]byte("compressible "), 20))
+
+	tests := []struct {
+		name    string
+		method  string
+		accept  string
+		handler http.HandlerFunc
+		//encoding is the expected Content-Encoding, status and body the response
+		encoding string
+		status   int
+		body     string
+	}{
+		{
+			name: "below threshold", accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(small)))
+				w.Write([]byte(small))
+			},
+			status: http.StatusOK, body: small,
+		},
+		{
+			name: "at threshold gzip", accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+				w.Write([]byte(large))
+			},
+			encoding: EncodingGzip, status: http.StatusOK, body: large,
+		},
+		{
+			name: "written in pieces zstd", accept: "zstd, gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < len(large); i += 10 {
+					w.Write([]byte(large[i : i+10]))
+				}
+			},
+			encoding: EncodingZstd, status: http.StatusOK, body: large,
+		},
+		{
+			name: "flush compresses small", accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(small))
+				w.(http.Flusher).Flush()
+				w.Write([]byte(small))
+			},
+			encoding: EncodingGzip, status: http.StatusOK, body: small + small,
+		},
+		{
+			name: "flush with nothing written", accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.(http.Flusher).Flush()
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "small error keeps status", accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(small))
+			},
+			status: http.StatusNotFound, body: small,
+		},
+		{
+			name: "large error compressed", accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(large))
+			},
+			encoding: EncodingGzip, status: http.StatusBadRequest, body: large,
+		},
+		{
+			name: "already encoded", accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "br")
+				w.Write([]byte(large))
+			},
+			encoding: "br", status: http.StatusOK, body: large,
+		},
+		{
+			name: "refused coding", accept: "gzip;q=0",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(large))
+			},
+			status: http.StatusOK, body: large,
+		},
+		{
+			name: "head", method: http.MethodHead, accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "5000")
+			},
+			status: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		method := tt.method
+		if method == "" {
+			method = http.MethodGet
+		}
+		r := httptest.NewRequest(method, "/fetch", nil)
+		r.Header.Set("Accept-Encoding", tt.accept)
+		w := httptest.NewRecorder()
+		compress(tt.handler).ServeHTTP(w, r)
+
+		if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.name, got, tt.encoding)
+		}
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: Vary %q", tt.name, w.Header().Get("Vary"))
+		}
+		compressed := tt.encoding == EncodingGzip || tt.encoding == EncodingZstd
+		if compressed && w.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: compressed response kept Content-Length %s", tt.name, w.Header().Get("Content-Length"))
+		}
+		if !compressed && tt.name == "below threshold" && w.Header().Get("Content-Length") != strconv.Itoa(len(small)) {
+			t.Errorf("%s: uncompressed response lost its Content-Length", tt.name)
+		}
+		if compressed {
+			if body := decodeBody(t, w); body != tt.body {
+				t.Errorf("%s: decoded body %q, want %q", tt.name, body, tt.body)
+			}
+		} else if w.Body.String() != tt.body {
+			t.Errorf("%s: body %q, want %q", tt.name, w.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestCompressionOff(t *testing.T) {
+	defer func() { Compression = true }()
+	Compression = false
+	h := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 5000))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/fetch", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 5000 {
+		t.Errorf("compression=false gave Content-Encoding %q and %d bytes", w.Header().Get("Content-Encoding"), w.Body.Len())
+	}
+}
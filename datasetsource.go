@@ -0,0 +1,256 @@
+package sdsshared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//DatasetArchiveName is the file name dataset archives are downloaded to in LocalDownloadDir
+const DatasetArchiveName = "datasetupdate.zip"
+
+//DatasetSource is a location a dataset archive can be read from
+type DatasetSource interface {
+	//URI identifies the source, in the form given to NewDatasetSource
+	URI() string
+	//Open returns a reader over the dataset archive. The caller must close it
+	Open(ctx context.Context) (io.ReadCloser, error)
+}
+
+//DatasetSourceFactory creates a DatasetSource from a parsed dataset URI
+type DatasetSourceFactory func(u *url.URL) (DatasetSource, error)
+
+var (
+	datasetSourcesMu sync.RWMutex
+	datasetSources   = map[string]DatasetSourceFactory{
+		"file":  newFileSource,
+		"http":  newHTTPSource,
+		"https": newHTTPSource,
+		"gs":    newGCSSource,
+		"s3":    newS3Source,
+	}
+)
+
+//RegisterDatasetSource makes a DatasetSource available for dataset URIs with the given
+// scheme, replacing any existing source for that scheme
+func RegisterDatasetSource(scheme string, factory DatasetSourceFactory) {
+	datasetSourcesMu.Lock()
+	defer datasetSourcesMu.Unlock()
+	datasetSources[strings.ToLower(scheme)] = factory
+}
+
+//NewDatasetSource returns the DatasetSource for uri chosen by its scheme. A uri without
+// a scheme is a local file path. Built in schemes are file, http, https, gs
+// (gs://bucket/object) and s3 (s3://bucket/key). HTTP(S) URLs on storage.cloud.google.com are read from Google
+// Cloud Storage so that they can use GCP authentication
+func NewDatasetSource(uri string) (DatasetSource, error) {
+	if uri == "" {
+		return nil, NewError(ErrBadRequest, "no dataset location given")
+	}
+	u, err := url.Parse(uri)
+	//no scheme, or a windows drive letter, means a local path
+	if err != nil || len(u.Scheme) <= 1 {
+		return &fileSource{path: uri}, nil
+	}
+	datasetSourcesMu.RLock()
+	factory, ok := datasetSources[strings.ToLower(u.Scheme)]
+	datasetSourcesMu.RUnlock()
+	if !ok {
+		return nil, NewError(ErrBadRequest, "no dataset source for scheme %q", u.Scheme)
+	}
+	return factory(u)
+}
+
+//DownloadDataset streams the archive from src into LocalDownloadDir and returns the path
+// of the downloaded file. The archive is written to a temporary file first so that a
+// failed or cancelled download never leaves a partial archive in place
+func DownloadDataset(ctx context.Context, src DatasetSource) (string, error) {
+	target := filepath.Join(LocalDownloadDir, DatasetArchiveName)
+	if _, err := downloadTo(ctx, src, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+//downloadTo streams the archive from src to the file at target and returns the hex
+// SHA-256 digest of the downloaded bytes. Progress is reported to the Progress in ctx
+func downloadTo(ctx context.Context, src DatasetSource, target string) (string, error) {
+	//Local download target file
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	partial := target + ".part"
+	file, err := os.Create(partial)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(partial)
+	defer file.Close()
+
+	progress := ProgressFromContext(ctx)
+	progress.SetPhase(PhaseDownloading)
+	rc, err := src.Open(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if size := archiveSize(rc); size > 0 {
+		progress.SetBytesTotal(size)
+	}
+	//Download, hashing as we go to save reading the archive again
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, digest, progressWriter{progress}), rc); err != nil {
+		return "", &DownloadError{URI: src.URI(), Err: err}
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(partial, target); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+//sizedBody is a response body that knows its Content-Length
+type sizedBody struct {
+	io.ReadCloser
+	size int64
+}
+
+func (sb sizedBody) Size() int64 {
+	return sb.size
+}
+
+//archiveSize returns the size of the archive read by rc, or 0 if unknown
+func archiveSize(rc io.ReadCloser) int64 {
+	switch r := rc.(type) {
+	case interface{ Size() int64 }:
+		return r.Size()
+	case *os.File:
+		if info, err := r.Stat(); err == nil {
+			return info.Size()
+		}
+	}
+	return 0
+}
+
+//fileSource reads dataset archives from the local filesystem
+type fileSource struct {
+	path string
+}
+
+func newFileSource(u *url.URL) (DatasetSource, error) {
+	p := u.Path
+	if u.Host != "" && u.Host != "localhost" {
+		//file://relative/path.zip is read as a relative path
+		p = path.Join(u.Host, u.Path)
+	}
+	if p == "" {
+		p = u.Opaque
+	}
+	return &fileSource{path: filepath.FromSlash(p)}, nil
+}
+
+func (fs *fileSource) URI() string {
+	return fs.path
+}
+
+//Revision changes when the file size or modification time changes
+func (fs *fileSource) Revision(ctx context.Context) (string, error) {
+	info, err := os.Stat(fs.path)
+	if err != nil {
+		return "", &DownloadError{URI: fs.path, Err: err}
+	}
+	return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano()), nil
+}
+
+func (fs *fileSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return nil, &DownloadError{URI: fs.path, Err: err}
+	}
+	return f, nil
+}
+
+//httpSource downloads dataset archives with an HTTP GET
+type httpSource struct {
+	url string
+}
+
+func newHTTPSource(u *url.URL) (DatasetSource, error) {
+	//Cloud storage browser URLs need GCP authentication so are fetched through the storage API
+	if u.Host == "storage.cloud.google.com" {
+		if parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2); len(parts) == 2 {
+			return &gcsSource{bucket: parts[0], object: parts[1]}, nil
+		}
+	}
+	return &httpSource{url: u.String()}, nil
+}
+
+func (hs *httpSource) URI() string {
+	return hs.url
+}
+
+//Revision is the archive ETag, or its Last-Modified time if the server sends no ETag.
+// It is empty if the server supports neither or does not answer HEAD requests
+func (hs *httpSource) Revision(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, hs.url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := NewHTTPClient().Do(req)
+	if err != nil {
+		return "", &DownloadError{URI: hs.url, Err: err}
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return "", nil
+	default:
+		return "", &DownloadError{URI: hs.url, StatusCode: resp.StatusCode}
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+	return resp.Header.Get("Last-Modified"), nil
+}
+
+func (hs *httpSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hs.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := NewHTTPClient()
+	//large archives take longer than the client timeout so the download is bounded by ctx instead
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &DownloadError{URI: hs.url, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &DownloadError{URI: hs.url, StatusCode: resp.StatusCode}
+	}
+	return sizedBody{resp.Body, resp.ContentLength}, nil
+}
+
+func newGCSSource(u *url.URL) (DatasetSource, error) {
+	object := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || object == "" {
+		return nil, NewError(ErrBadRequest, "dataset uri %q must be of the form gs://bucket/object", u.String())
+	}
+	return &gcsSource{bucket: u.Host, object: object}, nil
+}
@@ -0,0 +1,302 @@
+package sdsshared
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDatasetSource(t *testing.T) {
+	tests := []struct {
+		uri string
+		//want is the source expected, nil for an ErrBadRequest
+		want DatasetSource
+	}{
+		{"data/dataset.zip", &fileSource{path: "data/dataset.zip"}},
+		{"/srv/dataset.zip", &fileSource{path: "/srv/dataset.zip"}},
+		{`C:\data\dataset.zip`, &fileSource{path: `C:\data\dataset.zip`}},
+		{"file:///srv/dataset.zip", &fileSource{path: filepath.FromSlash("/srv/dataset.zip")}},
+		{"file://localhost/srv/dataset.zip", &fileSource{path: filepath.FromSlash("/srv/dataset.zip")}},
+		{"file://data/dataset.zip", &fileSource{path: filepath.FromSlash("data/dataset.zip")}},
+		{"FILE:data/dataset.zip", &fileSource{path: filepath.FromSlash("data/dataset.zip")}},
+		{"https://example.com/dataset.zip?v=2", &httpSource{url: "https://example.com/dataset.zip?v=2"}},
+		{"http://example.com/dataset.zip", &httpSource{url: "http://example.com/dataset.zip"}},
+		{"https://storage.cloud.google.com/bucket/path/dataset.zip", &gcsSource{bucket: "bucket", object: "path/dataset.zip"}},
+		{"https://storage.cloud.google.com/bucket", &httpSource{url: "https://storage.cloud.google.com/bucket"}},
+		{"gs://bucket/path/dataset.zip", &gcsSource{bucket: "bucket", object: "path/dataset.zip"}},
+		{"gs://bucket", nil},
+		{"gs://bucket/", nil},
+		{"gs:///dataset.zip", nil},
+		{"s3://bucket", nil},
+		{"ftp://example.com/dataset.zip", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := NewDatasetSource(tt.uri)
+		if tt.want == nil {
+			if !errors.Is(err, ErrBadRequest) {
+				t.Errorf("NewDatasetSource(%q) = %#v, %v, want ErrBadRequest", tt.uri, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewDatasetSource(%q): %v", tt.uri, err)
+			continue
+		}
+		switch want := tt.want.(type) {
+		case *fileSource:
+			if fs, ok := got.(*fileSource); !ok || *fs != *want {
+				t.Errorf("NewDatasetSource(%q) = %#v, want %#v", tt.uri, got, want)
+			}
+		case *httpSource:
+			if hs, ok := got.(*httpSource); !ok || *hs != *want {
+				t.Errorf("NewDatasetSource(%q) = %#v, want %#v", tt.uri, got, want)
+			}
+		case *gcsSource:
+			if gs, ok := got.(*gcsSource); !ok || *gs != *want {
+				t.Errorf("NewDatasetSource(%q) = %#v, want %#v", tt.uri, got, want)
+			}
+		}
+	}
+	if src, err := NewDatasetSource("s3://bucket/dataset.zip"); err != nil {
+		t.Errorf("s3 source: %v", err)
+	} else if _, ok := src.(*s3Source); !ok {
+		t.Errorf("s3 uri gave %#v", src)
+	}
+}
+
+//memorySource is a DatasetSource holding its archive in memory
+type memorySource struct {
+	uri  string
+	data string
+}
+
+func (ms *memorySource) URI() string {
+	return ms.uri
+}
+
+func (ms *memorySource) Open(ctx context.Context) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(ms.data)), nil
+}
+
+func TestRegisterDatasetSource(t *testing.T) {
+	var parsed *url.URL
+	RegisterDatasetSource("MEM", func(u *url.URL) (DatasetSource, error) {
+		parsed = u
+		return &memorySource{uri: u.String(), data: "archive"}, nil
+	})
+	defer func() {
+		datasetSourcesMu.Lock()
+		delete(datasetSources, "mem")
+		datasetSourcesMu.Unlock()
+	}()
+	src, err := NewDatasetSource("Mem://store/dataset.zip")
+	if err != nil {
+		t.Fatalf("registered scheme: %v", err)
+	}
+	if _, ok := src.(*memorySource); !ok {
+		t.Fatalf("registered scheme gave %#v", src)
+	}
+	if parsed.Host != "store" || parsed.Path != "/dataset.zip" {
+		t.Errorf("factory got %v, want the parsed uri", parsed)
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	const archive = "zip bytes"
+	modified := time.Date(2021, 12, 8, 21, 7, 33, 0, time.UTC)
+	var etag string
+	var heads, gets int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dataset.zip":
+		case "/nohead.zip":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodHead {
+			heads++
+		} else {
+			gets++
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, r, "dataset.zip", modified, strings.NewReader(archive))
+	}))
+	defer srv.Close()
+
+	src, err := NewDatasetSource(srv.URL + "/dataset.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := src.(*httpSource)
+	rev, err := hs.Revision(context.Background())
+	if err != nil || rev != modified.Format(http.TimeFormat) {
+		t.Errorf("revision without an ETag = %q, %v, want the Last-Modified time", rev, err)
+	}
+	etag = `"v2"`
+	if rev, err = hs.Revision(context.Background()); err != nil || rev != `"v2"` {
+		t.Errorf("revision with an ETag = %q, %v, want the ETag", rev, err)
+	}
+	if heads != 2 || gets != 0 {
+		t.Errorf("revisions made %d HEAD and %d GET requests, want 2 HEAD", heads, gets)
+	}
+
+	nohead, _ := NewDatasetSource(srv.URL + "/nohead.zip")
+	if rev, err := nohead.(*httpSource).Revision(context.Background()); err != nil || rev != "" {
+		t.Errorf("revision without HEAD support = %q, %v, want none", rev, err)
+	}
+	missing, _ := NewDatasetSource(srv.URL + "/missing.zip")
+	if _, err := missing.(*httpSource).Revision(context.Background()); !errors.Is(err, ErrDownloadFailed) {
+		t.Errorf("revision of a missing archive gave %v, want ErrDownloadFailed", err)
+	}
+
+	defer func(dir string) { LocalDownloadDir = dir }(LocalDownloadDir)
+	LocalDownloadDir = t.TempDir()
+	path, err := DownloadDataset(context.Background(), src)
+	if err != nil {
+		t.Fatalf("DownloadDataset: %v", err)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != archive {
+		t.Errorf("downloaded %q, %v, want %q", got, err, archive)
+	}
+	if _, err := DownloadDataset(context.Background(), missing); !errors.Is(err, ErrDownloadFailed) || StatusCode(err) != http.StatusBadGateway {
+		t.Errorf("download of a missing archive gave %v, want a 502 ErrDownloadFailed", err)
+	}
+}
+
+//checkingReader fails the test if the partial download of target does not exist while
+// the archive is being read, or target itself does unless keep is set. Once the data
+// runs out it fails with err, if set
+type checkingReader struct {
+	t      *testing.T
+	target string
+	keep   bool
+	r      io.Reader
+	err    error
+}
+
+func (cr *checkingReader) Read(p []byte) (int, error) {
+	if _, err := os.Stat(cr.target); !cr.keep && !os.IsNotExist(err) {
+		cr.t.Errorf("%s exists during the download", cr.target)
+	}
+	if _, err := os.Stat(cr.target + ".part"); err != nil {
+		cr.t.Errorf("no partial download during the download: %v", err)
+	}
+	n, err := cr.r.Read(p)
+	if err == io.EOF && cr.err != nil {
+		err = cr.err
+	}
+	return n, err
+}
+
+func (cr *checkingReader) Close() error {
+	return nil
+}
+
+//checkingSource is a DatasetSource reading a local file through a checkingReader
+type checkingSource struct {
+	fileSource
+	t      *testing.T
+	target string
+	keep   bool
+	err    error
+}
+
+func (cs *checkingSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	rc, err := cs.fileSource.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &checkingReader{t: cs.t, target: cs.target, keep: cs.keep, r: rc, err: cs.err}, nil
+}
+
+func TestFileSourceDownload(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "dataset.zip")
+	if err := os.WriteFile(archive, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { LocalDownloadDir = dir }(LocalDownloadDir)
+	LocalDownloadDir = filepath.Join(dir, "downloads")
+	target := filepath.Join(LocalDownloadDir, DatasetArchiveName)
+
+	src, err := NewDatasetSource("file://" + filepath.ToSlash(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := src.(*fileSource)
+	path, err := DownloadDataset(context.Background(), &checkingSource{fileSource: *fs, t: t, target: target})
+	if err != nil {
+		t.Fatalf("DownloadDataset: %v", err)
+	}
+	if path != target {
+		t.Errorf("downloaded to %s, want %s", path, target)
+	}
+	if got, _ := os.ReadFile(target); string(got) != "first" {
+		t.Errorf("downloaded %q, want first", got)
+	}
+	if _, err := os.Stat(target + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial download left behind: %v", err)
+	}
+
+	//a failed download leaves the previous archive in place and no partial file
+	if err := os.WriteFile(archive, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	failing := &checkingSource{fileSource: *fs, t: t, target: target, keep: true, err: io.ErrUnexpectedEOF}
+	if _, err := downloadTo(context.Background(), failing, target); !errors.Is(err, ErrDownloadFailed) {
+		t.Errorf("failed download gave %v, want ErrDownloadFailed", err)
+	}
+	if got, _ := os.ReadFile(target); string(got) != "first" {
+		t.Errorf("failed download replaced the archive with %q", got)
+	}
+	if _, err := os.Stat(target + ".part"); !os.IsNotExist(err) {
+		t.Errorf("failed download left a partial file: %v", err)
+	}
+
+	missing := &fileSource{path: filepath.Join(dir, "missing.zip")}
+	if _, err := DownloadDataset(context.Background(), missing); !errors.Is(err, ErrDownloadFailed) {
+		t.Errorf("download of a missing file gave %v, want ErrDownloadFailed", err)
+	}
+}
+
+func TestFileSourceRevision(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "dataset.zip")
+	if err := os.WriteFile(archive, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs := &fileSource{path: archive}
+	first, err := fs.Revision(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := fs.Revision(context.Background()); again != first {
+		t.Errorf("revision of an unchanged file changed from %q to %q", first, again)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(archive, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if touched, _ := fs.Revision(context.Background()); touched == first {
+		t.Errorf("revision did not change with the modification time")
+	}
+	if _, err := (&fileSource{path: archive + ".missing"}).Revision(context.Background()); !errors.Is(err, ErrDownloadFailed) {
+		t.Errorf("revision of a missing file gave %v, want ErrDownloadFailed", err)
+	}
+}
@@ -0,0 +1,308 @@
+package sdsshared
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Built in /fetch response formats, chosen with the format option or the Accept header
+const (
+	//FormatJSON is compact JSON, chosen by Accept: application/json
+	FormatJSON = "json"
+	//FormatPretty is indented JSON, the default when no other format is asked for
+	FormatPretty = "pretty"
+	//FormatCSV is CSV with a header row, chosen by Accept: text/csv. See CSVEncoder
+	FormatCSV = "csv"
+	//FormatMsgPack is MessagePack, chosen by Accept: application/msgpack. See MsgPackEncoder
+	FormatMsgPack = "msgpack"
+	//FormatProtobuf is protobuf, chosen by Accept: application/x-protobuf. See
+	// ProtobufEncoder
+	FormatProtobuf = "protobuf"
+	//FormatNDJSON streams the response as newline delimited JSON. See StreamRetriever
+	FormatNDJSON = "ndjson"
+)
+
+//Encoder writes /fetch responses in one format
+type Encoder interface {
+	//ContentType is the Content-Type of the encoded response
+	ContentType() string
+	//Encode writes data to w
+	Encode(w io.Writer, data SimpleData) error
+}
+
+type encoderEntry struct {
+	encoder    Encoder
+	mediaTypes []string
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]encoderEntry{
+		FormatJSON:     {jsonEncoder{}, []string{"application/json"}},
+		FormatPretty:   {jsonEncoder{indent: true}, nil},
+		FormatCSV:      {CSVEncoder{}, []string{"text/csv"}},
+		FormatMsgPack:  {MsgPackEncoder{}, []string{"application/msgpack", "application/x-msgpack"}},
+		FormatProtobuf: {ProtobufEncoder{}, []string{"application/x-protobuf", "application/protobuf"}},
+	}
+)
+
+//RegisterEncoder makes enc available as the /fetch format named format, replacing any
+// existing encoder of that name. It is chosen by the format option, or by an Accept
+// header naming one of mediaTypes
+func RegisterEncoder(format string, enc Encoder, mediaTypes ...string) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	for i, mt := range mediaTypes {
+		mediaTypes[i] = strings.ToLower(mt)
+	}
+	encoders[strings.ToLower(format)] = encoderEntry{encoder: enc, mediaTypes: mediaTypes}
+}
+
+//encoderFor returns the encoder registered as format
+func encoderFor(format string) (Encoder, bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	entry, ok := encoders[format]
+	return entry.encoder, ok
+}
+
+//formatForMediaType returns the format chosen by an Accept media type
+func formatForMediaType(mediaType string) (string, bool) {
+	if mediaType == NDJSONContentType {
+		return FormatNDJSON, true
+	}
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	//sorted so that a media type registered for two formats always picks the same one
+	formats := make([]string, 0, len(encoders))
+	for format := range encoders {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	for _, format := range formats {
+		for _, mt := range encoders[format].mediaTypes {
+			if mt == mediaType {
+				return format, true
+			}
+		}
+	}
+	return "", false
+}
+
+//negotiateFormat returns the format a /fetch request asks for. The format option comes
+// first, then stream=true, then the most preferred Accept media type with an encoder,
+// preferring a named type over a wildcard of the same quality. Without an Accept header,
+// or when a wildcard such as */* is preferred, the format is FormatPretty. An unknown
+// format option, or an Accept header allowing no format, is an error matching
+// ErrNotAcceptable
+func negotiateFormat(r *http.Request) (string, error) {
+	query := r.URL.Query()
+	if format := strings.ToLower(query.Get("format")); format != "" {
+		if _, ok := encoderFor(format); ok || format == FormatNDJSON {
+			return format, nil
+		}
+		return "", NewError(ErrNotAcceptable, "unknown format %q", query.Get("format"))
+	}
+	if stream, err := strconv.ParseBool(query.Get("stream")); err == nil && stream {
+		return FormatNDJSON, nil
+	}
+	best, bestQ, named := "", 0.0, false
+	asked := false
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil {
+				continue
+			}
+			asked = true
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			//q=0 marks a media type as not acceptable
+			if q <= 0 || q < bestQ {
+				continue
+			}
+			format, isNamed := FormatPretty, true
+			switch mediaType {
+			case "*/*", "application/*":
+				isNamed = false
+			default:
+				var ok bool
+				if format, ok = formatForMediaType(mediaType); !ok {
+					continue
+				}
+			}
+			if q > bestQ || (isNamed && !named) {
+				best, bestQ, named = format, q, isNamed
+			}
+		}
+	}
+	switch {
+	case best != "":
+		return best, nil
+	case asked:
+		return "", NewError(ErrNotAcceptable, "no response format matches Accept: %s", strings.Join(r.Header.Values("Accept"), ", "))
+	}
+	return FormatPretty, nil
+}
+
+//writeEncoded writes data to w with enc. It is encoded in full first so an encoding
+// error can still be answered with an error status
+func writeEncoded(w http.ResponseWriter, enc Encoder, data SimpleData) error {
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", enc.ContentType())
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+//jsonEncoder writes SimpleData as JSON, compact or indented
+type jsonEncoder struct {
+	indent bool
+}
+
+func (jsonEncoder) ContentType() string { return "application/json" }
+
+func (je jsonEncoder) Encode(w io.Writer, data SimpleData) error {
+	if je.indent {
+		dataJSON, err := json.MarshalIndent(data, " ", " ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(dataJSON)
+		return err
+	}
+	return json.NewEncoder(w).Encode(data)
+}
+
+//genericValue converts v to the plain maps, slices, strings, json.Numbers, bools and
+// nils of its JSON form, so that every format sees values as the JSON format does
+func genericValue(v interface{}) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var out interface{}
+	err = dec.Decode(&out)
+	return out, err
+}
+
+//sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//CSVEncoder writes DataOutput.Values as CSV with a header row; meta data is left out.
+//
+//A list becomes a row per element and a map a row per entry, with the map key in a "key"
+// column. Object fields become columns, nested objects flattened with dotted names such
+// as "value.lat". Other values go in a "value" column, and lists within a row are
+// written as JSON
+type CSVEncoder struct{}
+
+func (CSVEncoder) ContentType() string { return "text/csv; charset=utf-8" }
+
+func (CSVEncoder) Encode(w io.Writer, data SimpleData) error {
+	values, err := genericValue(data.Data.Values)
+	if err != nil {
+		return err
+	}
+	var rows []map[string]string
+	switch v := values.(type) {
+	case nil:
+	case []interface{}:
+		for _, elem := range v {
+			row := make(map[string]string)
+			flattenCSV(row, "", elem)
+			rows = append(rows, row)
+		}
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			row := map[string]string{"key": k}
+			flattenCSV(row, "", v[k])
+			rows = append(rows, row)
+		}
+	default:
+		row := make(map[string]string)
+		flattenCSV(row, "", v)
+		rows = append(rows, row)
+	}
+
+	//columns in the order first seen, each row's own columns sorted
+	var columns []string
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		names := make([]string, 0, len(row))
+		for name := range row {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				columns = append(columns, name)
+			}
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	if len(columns) > 0 {
+		cw.Write(columns)
+	}
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, name := range columns {
+			record[i] = row[name]
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//flattenCSV adds the cells of v to row, with prefix naming v's column. The top level
+// value has no prefix; if it is not an object it goes in the "value" column
+func flattenCSV(row map[string]string, prefix string, v interface{}) {
+	if obj, ok := v.(map[string]interface{}); ok {
+		for k, field := range obj {
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			flattenCSV(row, k, field)
+		}
+		return
+	}
+	if prefix == "" {
+		prefix = "value"
+	}
+	switch v := v.(type) {
+	case nil:
+		row[prefix] = ""
+	case []interface{}:
+		raw, _ := json.Marshal(v)
+		row[prefix] = string(raw)
+	default:
+		row[prefix] = fmt.Sprint(v)
+	}
+}
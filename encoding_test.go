@@ -0,0 +1,313 @@
+package sdsshared
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		accept []string
+		want   string
+		//err is the error kind expected instead of a format
+		err error
+	}{
+		{"default", "", nil, FormatPretty, nil},
+		{"any", "", []string{"*/*"}, FormatPretty, nil},
+		{"json", "", []string{"application/json"}, FormatJSON, nil},
+		{"csv", "", []string{"text/csv"}, FormatCSV, nil},
+		{"msgpack alias", "", []string{"application/x-msgpack"}, FormatMsgPack, nil},
+		{"protobuf", "", []string{"application/x-protobuf"}, FormatProtobuf, nil},
+		{"ndjson", "", []string{NDJSONContentType}, FormatNDJSON, nil},
+		{"highest q", "", []string{"application/json;q=0.5, text/csv;q=0.9"}, FormatCSV, nil},
+		{"q across headers", "", []string{"text/csv;q=0.2", "application/msgpack;q=0.8"}, FormatMsgPack, nil},
+		{"unknown types skipped", "", []string{"application/xml, text/csv;q=0.1"}, FormatCSV, nil},
+		{"named over wildcard", "", []string{"*/*, application/json"}, FormatJSON, nil},
+		{"preferred wildcard", "", []string{"application/json;q=0.5, */*"}, FormatPretty, nil},
+		{"q=0 refuses", "", []string{"application/json;q=0, text/csv;q=0.1"}, FormatCSV, nil},
+		{"bad q skipped", "", []string{"application/json;q=high, text/csv"}, FormatCSV, nil},
+		{"format overrides Accept", "format=csv", []string{"application/json"}, FormatCSV, nil},
+		{"format case", "format=MsgPack", nil, FormatMsgPack, nil},
+		{"format ndjson", "format=ndjson", nil, FormatNDJSON, nil},
+		{"stream", "stream=true", []string{"application/json"}, FormatNDJSON, nil},
+		{"format overrides stream", "format=json&stream=true", nil, FormatJSON, nil},
+		{"unknown format", "format=xml", nil, "", ErrNotAcceptable},
+		{"nothing acceptable", "", []string{"application/xml"}, "", ErrNotAcceptable},
+		{"all refused", "", []string{"application/json;q=0, */*;q=0"}, "", ErrNotAcceptable},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/fetch?fetch=a&"+tt.query, nil)
+		for _, a := range tt.accept {
+			r.Header.Add("Accept", a)
+		}
+		got, err := negotiateFormat(r)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) || StatusCode(err) != http.StatusNotAcceptable {
+				t.Errorf("%s: negotiateFormat gave %q, %v, want a 406 error", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: negotiateFormat gave %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestCSVEncoder(t *testing.T) {
+	tests := []struct {
+		name   string
+		values interface{}
+		want   string
+	}{
+		{"nothing", nil, ""},
+		{"scalar", "SW1A 1AA", "value\nSW1A 1AA\n"},
+		{"list of scalars", []interface{}{1, "two", nil}, "value\n1\ntwo\n\n"},
+		{
+			"map of objects",
+			map[string]interface{}{
+				"b": map[string]interface{}{"name": "Bristol", "pos": map[string]interface{}{"lat": 51.45, "lon": -2.58}},
+				"a": map[string]interface{}{"name": "Aberdeen", "tags": []string{"north", "coast"}},
+			},
+			"key,name,tags,pos.lat,pos.lon\na,Aberdeen,\"[\"\"north\"\",\"\"coast\"\"]\",,\nb,Bristol,,51.45,-2.58\n",
+		},
+		{
+			"records",
+			[]Record{{Key: "K1", Timestamp: 5, Value: map[string]interface{}{"n": 1}}},
+			"key,timestamp,value.n\nK1,5,1\n",
+		},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := (CSVEncoder{}).Encode(&buf, SimpleData{Data: DataOutput{Values: tt.values}}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: CSV\n%q\nwant\n%q", tt.name, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestAppendMsgPackInt(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{-1, []byte{0xff}},
+		{-32, []byte{0xe0}},
+		{128, []byte{0xcc, 0x80}},
+		{255, []byte{0xcc, 0xff}},
+		{256, []byte{0xcd, 0x01, 0x00}},
+		{65536, []byte{0xce, 0x00, 0x01, 0x00, 0x00}},
+		{1 << 32, []byte{0xcf, 0, 0, 0, 1, 0, 0, 0, 0}},
+		{-33, []byte{0xd0, 0xdf}},
+		{-128, []byte{0xd0, 0x80}},
+		{-129, []byte{0xd1, 0xff, 0x7f}},
+		{math.MinInt16, []byte{0xd1, 0x80, 0x00}},
+		{math.MinInt16 - 1, []byte{0xd2, 0xff, 0xff, 0x7f, 0xff}},
+		{math.MinInt32 - 1, []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xff}},
+		{math.MinInt64, []byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		{math.MaxInt64, []byte{0xcf, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		got := appendMsgPackInt(nil, tt.n)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("appendMsgPackInt(%d) = % x, want % x", tt.n, got, tt.want)
+			continue
+		}
+		//the decoder sign extends each signed width back to the same value
+		v, err := decodeMsgPack(got)
+		if err != nil || v != tt.n {
+			t.Errorf("decodeMsgPack(% x) = %v (%T), %v, want %d", got, v, v, err, tt.n)
+		}
+	}
+}
+
+func TestMsgPackRoundTrip(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	list := make([]interface{}, 20)
+	for i := range list {
+		list[i] = json.Number("1")
+	}
+	obj := make(map[string]interface{}, 20)
+	for i := 0; i < 20; i++ {
+		obj[string(rune('a'+i))] = true
+	}
+	values := []interface{}{
+		nil, true, false,
+		json.Number("42"), json.Number("-100000"), json.Number("1.5"),
+		"", "short", string(bytes.Repeat([]byte("y"), 40)), long, string(bytes.Repeat([]byte("z"), 70000)),
+		[]interface{}{}, list,
+		map[string]interface{}{}, obj,
+		map[string]interface{}{"nested": []interface{}{map[string]interface{}{"k": "v"}, nil}},
+	}
+	for _, v := range values {
+		encoded, err := appendMsgPack(nil, v)
+		if err != nil {
+			t.Fatalf("appendMsgPack(%.20v): %v", v, err)
+		}
+		decoded, err := decodeMsgPack(encoded)
+		if err != nil {
+			t.Fatalf("decodeMsgPack of %.20v: %v", v, err)
+		}
+		if !reflect.DeepEqual(normaliseNumbers(v), decoded) {
+			t.Errorf("round trip of %.40v gave %.40v", v, decoded)
+		}
+	}
+}
+
+//normaliseNumbers converts the json.Numbers of v to the int64 or float64 the MessagePack
+// decoder returns
+func normaliseNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = normaliseNumbers(elem)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			out[k] = normaliseNumbers(elem)
+		}
+		return out
+	}
+	return v
+}
+
+func TestDecodeMsgPack(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want interface{}
+		ok   bool
+	}{
+		{"float32", []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, 1.5, true},
+		{"bin8", []byte{0xc4, 0x02, 'h', 'i'}, "hi", true},
+		{"uint64 above int64", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint64(math.MaxUint64), true},
+		{"int8", []byte{0xd0, 0xfe}, int64(-2), true},
+		{"int16", []byte{0xd1, 0xff, 0xfe}, int64(-2), true},
+		{"int32", []byte{0xd2, 0xff, 0xff, 0xff, 0xfe}, int64(-2), true},
+		{"positive int16", []byte{0xd1, 0x01, 0x00}, int64(256), true},
+		{"integer map key", []byte{0x81, 0x01, 0xa1, 'a'}, map[string]interface{}{"1": "a"}, true},
+		{"truncated", []byte{0xcd, 0x01}, nil, false},
+		{"short array", []byte{0x92, 0x01}, nil, false},
+		{"huge array", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, nil, false},
+		{"left over", []byte{0x01, 0x02}, nil, false},
+		{"extension", []byte{0xd4, 0x01, 0x00}, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := decodeMsgPack(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: decodeMsgPack gave %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: decodeMsgPack = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMsgPackEncoder(t *testing.T) {
+	data := SimpleData{ResultCount: 1, Meta: Meta{Resource: "postcodes"}, Data: DataOutput{Values: []Record{{Key: "K", Timestamp: 1, Value: "v"}}}}
+	var buf bytes.Buffer
+	if err := (MsgPackEncoder{}).Encode(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeMsgPack(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the MessagePack has the same shape as the JSON
+	want, _ := genericValue(data)
+	if !reflect.DeepEqual(decoded, normaliseNumbers(want)) {
+		t.Errorf("MessagePack of %+v decoded as %v, want %v", data, decoded, want)
+	}
+}
+
+//protoFields splits an encoded protobuf message into its field values by number
+func protoFields(t *testing.T, b []byte) map[protowire.Number][]interface{} {
+	t.Helper()
+	fields := make(map[protowire.Number][]interface{})
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var v interface{}
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			var bits uint64
+			bits, n = protowire.ConsumeFixed64(b)
+			v = math.Float64frombits(bits)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+		if n < 0 {
+			t.Fatalf("bad field %d: %v", num, protowire.ParseError(n))
+		}
+		fields[num] = append(fields[num], v)
+		b = b[n:]
+	}
+	return fields
+}
+
+func TestProtobufEncoder(t *testing.T) {
+	distance := 12.5
+	data := SimpleData{
+		ResultCount:    2,
+		RequestOptions: map[string]string{"fetch": "K"},
+		Meta:           Meta{Resource: "postcodes", DataSources: []string{"a", "b"}},
+		Data: DataOutput{Values: []Record{
+			{Key: "K1", Timestamp: 7, Value: "text"},
+			{Key: "K2", Value: map[string]interface{}{"n": 1}, Distance: &distance},
+		}},
+		NextCursor: "next",
+	}
+	var buf bytes.Buffer
+	if err := (ProtobufEncoder{}).Encode(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	top := protoFields(t, buf.Bytes())
+	if top[1][0] != uint64(2) || string(top[5][0].([]byte)) != "next" || len(top[2]) != 1 {
+		t.Errorf("SimpleData fields = %v", top)
+	}
+	meta := protoFields(t, top[3][0].([]byte))
+	if string(meta[1][0].([]byte)) != "postcodes" || len(meta[3]) != 2 {
+		t.Errorf("Meta fields = %v", meta)
+	}
+	records := protoFields(t, top[4][0].([]byte))[1]
+	if len(records) != 2 {
+		t.Fatalf("%d records, want 2", len(records))
+	}
+	first, second := protoFields(t, records[0].([]byte)), protoFields(t, records[1].([]byte))
+	if string(first[1][0].([]byte)) != "K1" || first[2][0] != uint64(7) || string(first[3][0].([]byte)) != "text" {
+		t.Errorf("first Record fields = %v", first)
+	}
+	if string(second[4][0].([]byte)) != `{"n":1}` || second[5][0] != 12.5 || second[2] != nil {
+		t.Errorf("second Record fields = %v", second)
+	}
+}
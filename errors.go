@@ -0,0 +1,155 @@
+package sdsshared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+//Error kinds that DataResource implementations can return, directly or wrapped, to have
+// the server respond with a matching HTTP status code. Test for them with errors.Is
+var (
+	//ErrNotFound is returned when the requested data does not exist. 404 Not Found
+	ErrNotFound = errors.New("not found")
+	//ErrBadRequest is returned when a query or its options are invalid. 400 Bad Request
+	ErrBadRequest = errors.New("bad request")
+	//ErrNotAcceptable is returned when a request asks for a response format that cannot
+	// be produced. 406 Not Acceptable
+	ErrNotAcceptable = errors.New("not acceptable")
+	//ErrUpdating is returned when a request cannot be served because the dataset is
+	// being updated, for example a second concurrent update. 503 Service Unavailable
+	ErrUpdating = errors.New("unavailable while dataset is updating")
+	//ErrDownloadFailed is returned when a dataset archive could not be downloaded from
+	// its repository. 502 Bad Gateway
+	ErrDownloadFailed = errors.New("dataset download failed")
+	//ErrVerificationFailed is returned when a downloaded dataset archive does not match
+	// its manifest checksum or signature. 502 Bad Gateway
+	ErrVerificationFailed = errors.New("dataset verification failed")
+	//ErrUpToDate is returned by UpdateDatasetContext, along with the current version, when
+	// the latest available dataset is the one already loaded. It is not a failure and
+	// the server answers 200 OK
+	ErrUpToDate = errors.New("dataset already up to date")
+	//ErrUnauthorised is returned for requests without valid credentials. 401 Unauthorized
+	ErrUnauthorised = errors.New("unauthorised")
+	//ErrForbidden is returned for requests whose credentials lack permission. 403 Forbidden
+	ErrForbidden = errors.New("forbidden")
+	//ErrKeysUnavailable is returned by a KeySource that cannot get its verification keys,
+	// such as when the JWKS endpoint is down. Clients get a generic message rather than
+	// the cause. 503 Service Unavailable
+	ErrKeysUnavailable = errors.New("token verification keys unavailable")
+	//ErrNotSupported is returned when the data resource does not support a request, such
+	// as a rollback on a connector that keeps no previous datasets. 501 Not Implemented
+	ErrNotSupported = errors.New("not supported")
+)
+
+//Error is an error of one of the sentinel kinds, such as ErrNotFound, with a message for
+// the client and an optional underlying cause
+type Error struct {
+	//Kind is the sentinel error this error matches with errors.Is
+	Kind error
+	//Message describes the problem to the client
+	Message string
+	//Err is the underlying cause, if any
+	Err error
+}
+
+//NewError creates an Error of kind with a formatted client message
+func NewError(kind error, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+//WrapError creates an Error of kind around err. The client message is err's message
+func WrapError(kind error, err error) *Error {
+	return &Error{Kind: kind, Message: err.Error(), Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Kind.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.Kind, e.Message)
+}
+
+//Unwrap returns the underlying cause
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//Is reports whether target is the kind of this error
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+//DownloadError records a failed dataset archive download. It matches ErrDownloadFailed
+type DownloadError struct {
+	//URI is the dataset location the download was attempted from
+	URI string
+	//StatusCode is the upstream HTTP status if the failure was an HTTP response
+	StatusCode int
+	//Err is the underlying cause, if any
+	Err error
+}
+
+func (e *DownloadError) Error() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("%v from %s: %v", ErrDownloadFailed, e.URI, e.Err)
+	case e.StatusCode != 0:
+		return fmt.Sprintf("%v from %s: upstream status %d", ErrDownloadFailed, e.URI, e.StatusCode)
+	default:
+		return fmt.Sprintf("%v from %s", ErrDownloadFailed, e.URI)
+	}
+}
+
+//Unwrap returns the underlying cause
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+//Is reports true for ErrDownloadFailed
+func (e *DownloadError) Is(target error) bool {
+	return target == ErrDownloadFailed
+}
+
+//StatusCode returns the HTTP status code matching the kind of err. ErrUpToDate is not a
+// failure and gives 200 OK. Unknown errors are 500 Internal Server Error
+func StatusCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, ErrUpToDate):
+		return http.StatusOK
+	case errors.Is(err, ErrBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnauthorised):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNotAcceptable):
+		return http.StatusNotAcceptable
+	case errors.Is(err, ErrUpdating), errors.Is(err, ErrKeysUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrDownloadFailed), errors.Is(err, ErrVerificationFailed):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		//the client has gone away so this is never seen, but it is not a server fault
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+//writeResourceError writes err to w in the standard simple data error payload with the
+// status code matching its kind
+func writeResourceError(w http.ResponseWriter, errorTitle string, err error) {
+	code := StatusCode(err)
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "30")
+	}
+	writeError(w, errorTitle, code, err.Error())
+}
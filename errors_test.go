@@ -0,0 +1,54 @@
+package sdsshared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, http.StatusOK},
+		{ErrUpToDate, http.StatusOK},
+		{NewError(ErrBadRequest, "unknown option %q", "x"), http.StatusBadRequest},
+		{ErrUnauthorised, http.StatusUnauthorized},
+		{ErrForbidden, http.StatusForbidden},
+		{NewError(ErrNotFound, "no key"), http.StatusNotFound},
+		{ErrNotAcceptable, http.StatusNotAcceptable},
+		{NewError(ErrNotSupported, "no rollback"), http.StatusNotImplemented},
+		{&DownloadError{URI: "gs://b/o", StatusCode: 500}, http.StatusBadGateway},
+		{&VerificationError{URI: "gs://b/o", Reason: "checksum mismatch"}, http.StatusBadGateway},
+		{NewError(ErrUpdating, "update running"), http.StatusServiceUnavailable},
+		{WrapError(ErrKeysUnavailable, errors.New("dial tcp: refused")), http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{context.Canceled, http.StatusServiceUnavailable},
+		//kinds are found through wrapping
+		{fmt.Errorf("loading: %w", NewError(ErrNotFound, "gone")), http.StatusNotFound},
+		{fmt.Errorf("startup: %w", &DownloadError{URI: "s3://b/k", Err: errors.New("timeout")}), http.StatusBadGateway},
+		{errors.New("something else"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := StatusCode(tt.err); got != tt.want {
+			t.Errorf("StatusCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	cause := errors.New("dial tcp: refused")
+	err := WrapError(ErrKeysUnavailable, cause)
+	if !errors.Is(err, ErrKeysUnavailable) || !errors.Is(err, cause) || errors.Is(err, ErrNotFound) {
+		t.Errorf("WrapError does not match its kind and cause only: %v", err)
+	}
+	if got := NewError(ErrBadRequest, "bad %s", "term").Error(); got != "bad request: bad term" {
+		t.Errorf("Error() = %q", got)
+	}
+	if got := (&Error{Kind: ErrForbidden}).Error(); got != "forbidden" {
+		t.Errorf("Error() without message = %q", got)
+	}
+}
@@ -5,5 +5,7 @@ go 1.16
 require (
 	cloud.google.com/go/storage v1.10.0
 	github.com/dgraph-io/badger/v3 v3.2103.2
+	github.com/klauspost/compress v1.12.3
 	google.golang.org/api v0.61.0 // indirect
+	google.golang.org/protobuf v1.27.1
 )
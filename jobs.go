@@ -0,0 +1,225 @@
+package sdsshared
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+//Update job phases reported through Progress
+const (
+	PhaseChecking    = "checking"
+	PhaseDownloading = "downloading"
+	PhaseVerifying   = "verifying"
+	PhaseLoading     = "loading"
+	PhaseIndexing    = "indexing"
+	PhaseMounting    = "mounting"
+)
+
+//Update job statuses
+const (
+	UpdateStatusQueued   = "queued"
+	UpdateStatusRunning  = "running"
+	UpdateStatusUpdated  = "updated"
+	UpdateStatusUpToDate = "already up to date"
+	UpdateStatusFailed   = "failed"
+)
+
+//Update job triggers
+const (
+	TriggerRequest  = "request"
+	TriggerSchedule = "schedule"
+	TriggerManual   = "manual"
+	TriggerStartup  = "startup"
+)
+
+//Progress receives progress reports from a running dataset update. Data resources get
+// the Progress of the job they run for with ProgressFromContext
+type Progress interface {
+	//SetPhase records the step the update has reached, such as PhaseLoading
+	SetPhase(phase string)
+	//SetBytesTotal records the size of the archive being downloaded, if known
+	SetBytesTotal(n int64)
+	//AddBytes adds n to the number of archive bytes downloaded
+	AddBytes(n int64)
+	//AddRecords adds n to the number of records loaded
+	AddRecords(n int64)
+}
+
+type progressKey struct{}
+
+//WithProgress returns a context carrying p for progress reports
+func WithProgress(ctx context.Context, p Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+//ProgressFromContext returns the Progress carried by ctx. If there is none the returned
+// Progress discards reports, so callers never need to check for nil
+func ProgressFromContext(ctx context.Context) Progress {
+	if p, ok := ctx.Value(progressKey{}).(Progress); ok {
+		return p
+	}
+	return noProgress{}
+}
+
+type noProgress struct{}
+
+func (noProgress) SetPhase(string)     {}
+func (noProgress) SetBytesTotal(int64) {}
+func (noProgress) AddBytes(int64)      {}
+func (noProgress) AddRecords(int64)    {}
+
+//progressWriter reports the bytes written through it to a Progress
+type progressWriter struct {
+	p Progress
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	pw.p.AddBytes(int64(len(b)))
+	return len(b), nil
+}
+
+//UpdateJob is a snapshot of a dataset update run by an Updater
+type UpdateJob struct {
+	//ID identifies the job in /update/status/{id}
+	ID string `json:"id"`
+	//Status is UpdateStatusQueued while the job waits for the running one,
+	// UpdateStatusRunning until the job ends, then UpdateStatusUpdated,
+	// UpdateStatusUpToDate or UpdateStatusFailed
+	Status string `json:"status"`
+	//Trigger is what started the job: TriggerRequest, TriggerSchedule, TriggerStartup or
+	// TriggerManual
+	Trigger string `json:"trigger"`
+	//Forced is true if the version check was skipped
+	Forced bool `json:"forced,omitempty"`
+	//Phase is the step the job has reached, such as PhaseDownloading. A finished job
+	// keeps the phase it ended in
+	Phase string `json:"phase,omitempty"`
+	//BytesTransferred and BytesTotal are the archive bytes downloaded so far and the
+	// archive size. BytesTotal is 0 if the source does not report a size
+	BytesTransferred int64 `json:"bytes_transferred"`
+	BytesTotal       int64 `json:"bytes_total,omitempty"`
+	//RecordsLoaded counts the records loaded into the new dataset
+	RecordsLoaded int64 `json:"records_loaded"`
+	//StartedAt and FinishedAt are when the job started and ended
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	//Error is the reason a failed job failed
+	Error string `json:"error,omitempty"`
+	//Dataset is the version information of the dataset in use after a successful job
+	Dataset *VersionManager `json:"dataset,omitempty"`
+}
+
+//updateJob is a running or finished UpdateJob. It implements Progress
+type updateJob struct {
+	mu  sync.Mutex
+	job UpdateJob
+	//detached is set for jobs the Updater runs itself, which Stop cancels and waits for
+	detached bool
+	done     chan struct{}
+}
+
+func newUpdateJob(trigger string, force, detached bool) *updateJob {
+	return &updateJob{
+		job: UpdateJob{
+			ID:        newJobID(),
+			Status:    UpdateStatusRunning,
+			Trigger:   trigger,
+			Forced:    force,
+			Phase:     PhaseChecking,
+			StartedAt: time.Now(),
+		},
+		detached: detached,
+		done:     make(chan struct{}),
+	}
+}
+
+//newQueuedJob returns a detached forced job waiting for the running job to finish
+func newQueuedJob(trigger string) *updateJob {
+	return &updateJob{
+		job: UpdateJob{
+			ID:      newJobID(),
+			Status:  UpdateStatusQueued,
+			Trigger: trigger,
+			Forced:  true,
+		},
+		detached: true,
+		done:     make(chan struct{}),
+	}
+}
+
+//begin moves a queued job to running
+func (j *updateJob) begin() {
+	j.mu.Lock()
+	j.job.Status = UpdateStatusRunning
+	j.job.Phase = PhaseChecking
+	j.job.StartedAt = time.Now()
+	j.mu.Unlock()
+}
+
+//newJobID returns a random job ID
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+func (j *updateJob) SetPhase(phase string) {
+	j.mu.Lock()
+	j.job.Phase = phase
+	j.mu.Unlock()
+}
+
+func (j *updateJob) SetBytesTotal(n int64) {
+	j.mu.Lock()
+	j.job.BytesTotal = n
+	j.mu.Unlock()
+}
+
+func (j *updateJob) AddBytes(n int64) {
+	j.mu.Lock()
+	j.job.BytesTransferred += n
+	j.mu.Unlock()
+}
+
+func (j *updateJob) AddRecords(n int64) {
+	j.mu.Lock()
+	j.job.RecordsLoaded += n
+	j.mu.Unlock()
+}
+
+//snapshot returns a copy of the job state
+func (j *updateJob) snapshot() UpdateJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.job
+	if job.Dataset != nil {
+		vm := *job.Dataset
+		job.Dataset = &vm
+	}
+	return job
+}
+
+//finish records the outcome of the job and releases anyone waiting for it
+func (j *updateJob) finish(vm VersionManager, err error) {
+	j.mu.Lock()
+	j.job.FinishedAt = time.Now()
+	switch {
+	case err == nil:
+		j.job.Status = UpdateStatusUpdated
+		j.job.Dataset = &vm
+	case errors.Is(err, ErrUpToDate):
+		j.job.Status = UpdateStatusUpToDate
+		j.job.Dataset = &vm
+	default:
+		j.job.Status = UpdateStatusFailed
+		j.job.Error = err.Error()
+	}
+	j.mu.Unlock()
+	close(j.done)
+}
@@ -0,0 +1,168 @@
+package sdsshared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJobProgress(t *testing.T) {
+	job := newUpdateJob(TriggerRequest, false, false)
+	var p Progress = job
+	ctx := WithProgress(context.Background(), p)
+	if ProgressFromContext(ctx) != p {
+		t.Fatal("ProgressFromContext did not return the job")
+	}
+	//reports to a context without a job are discarded
+	ProgressFromContext(context.Background()).AddRecords(5)
+
+	progress := ProgressFromContext(ctx)
+	progress.SetPhase(PhaseDownloading)
+	progress.SetBytesTotal(100)
+	progress.AddBytes(30)
+	progress.AddBytes(20)
+	before := job.snapshot()
+	progress.SetPhase(PhaseLoading)
+	progress.AddRecords(7)
+	progress.AddRecords(3)
+
+	if before.Phase != PhaseDownloading || before.BytesTransferred != 50 || before.BytesTotal != 100 || before.RecordsLoaded != 0 {
+		t.Errorf("snapshot during download = %+v", before)
+	}
+	after := job.snapshot()
+	if after.Phase != PhaseLoading || after.RecordsLoaded != 10 || after.Status != UpdateStatusRunning {
+		t.Errorf("snapshot during load = %+v", after)
+	}
+
+	job.finish(VersionManager{CurrentVersion: "2"}, nil)
+	done := job.snapshot()
+	if done.Status != UpdateStatusUpdated || done.FinishedAt.IsZero() || done.Dataset == nil || done.Dataset.CurrentVersion != "2" {
+		t.Fatalf("finished snapshot = %+v", done)
+	}
+	//snapshots do not share the dataset with the job
+	done.Dataset.CurrentVersion = "changed"
+	if job.snapshot().Dataset.CurrentVersion != "2" {
+		t.Error("changing a snapshot changed the job")
+	}
+	select {
+	case <-job.done:
+	default:
+		t.Error("finish did not release waiters")
+	}
+}
+
+func TestJobOutcomes(t *testing.T) {
+	tests := []struct {
+		err     error
+		status  string
+		dataset bool
+	}{
+		{nil, UpdateStatusUpdated, true},
+		{ErrUpToDate, UpdateStatusUpToDate, true},
+		{NewError(ErrVerificationFailed, "checksum mismatch"), UpdateStatusFailed, false},
+	}
+	for _, tt := range tests {
+		job := newUpdateJob(TriggerSchedule, false, true)
+		job.finish(VersionManager{CurrentVersion: "1"}, tt.err)
+		got := job.snapshot()
+		if got.Status != tt.status || (got.Dataset != nil) != tt.dataset {
+			t.Errorf("%v: job ended %+v, want status %q", tt.err, got, tt.status)
+		}
+		if tt.status == UpdateStatusFailed && got.Error != tt.err.Error() {
+			t.Errorf("%v: job error %q", tt.err, got.Error)
+		}
+	}
+}
+
+func TestJobHistory(t *testing.T) {
+	ur := newUpdateResource()
+	close(ur.finish)
+	u := NewUpdater(ur, nil)
+	var ids []string
+	for i := 0; i < maxJobHistory+5; i++ {
+		ctx := context.Background()
+		//every other job, including the last, is forced
+		if i%2 == 0 {
+			ctx = WithForceUpdate(ctx)
+		}
+		if _, err := u.Update(ctx); err != nil && !errors.Is(err, ErrUpToDate) {
+			t.Fatal(err)
+		}
+		<-ur.started
+		ids = append(ids, u.Status().Job)
+	}
+	jobs := u.Jobs()
+	if len(jobs) != maxJobHistory {
+		t.Fatalf("%d jobs kept, want %d", len(jobs), maxJobHistory)
+	}
+	//newest first, oldest dropped
+	for i, job := range jobs {
+		if want := ids[len(ids)-1-i]; job.ID != want {
+			t.Fatalf("Jobs()[%d] = %s, want %s", i, job.ID, want)
+		}
+		if job.Trigger != TriggerManual {
+			t.Errorf("job %s trigger %q, want %q", job.ID, job.Trigger, TriggerManual)
+		}
+	}
+	if _, ok := u.Job(ids[0]); ok {
+		t.Error("oldest job still found after being dropped from the history")
+	}
+	if job, ok := u.Job(ids[len(ids)-1]); !ok || !job.Forced || job.Status != UpdateStatusUpdated {
+		t.Errorf("Job(newest) = %+v, %v, want a forced updated job", job, ok)
+	}
+	if status := u.Status(); status.Running || status.Dataset == nil || status.Dataset.CurrentVersion != "2" {
+		t.Errorf("Status() = %+v", status)
+	}
+}
+
+func TestJobStatusEndpoint(t *testing.T) {
+	ur := newUpdateResource()
+	s := &Server{Resource: ur, Updater: NewUpdater(ur, nil)}
+	defer s.Updater.Stop()
+	h := s.routes()
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update?force=true", nil))
+	var submitted UpdateJob
+	if err := json.Unmarshal(w.Body.Bytes(), &submitted); err != nil || w.Code != http.StatusAccepted {
+		t.Fatalf("/update gave %d %s", w.Code, w.Body)
+	}
+	if loc := w.Header().Get("Location"); loc != "/update/status/"+submitted.ID {
+		t.Errorf("Location %q, want the job status URL", loc)
+	}
+	<-ur.started
+
+	var running UpdateJob
+	if w := get("/update/status/" + submitted.ID); w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &running) != nil {
+		t.Fatalf("job status gave %d %s", w.Code, w.Body)
+	}
+	if running.Status != UpdateStatusRunning || running.Trigger != TriggerRequest || !running.Forced {
+		t.Errorf("running job = %+v", running)
+	}
+
+	ur.finish <- struct{}{}
+	job := waitJob(t, s.Updater, submitted.ID, UpdateStatusRunning)
+	var finished UpdateJob
+	if w := get("/update/status/" + submitted.ID); w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &finished) != nil {
+		t.Fatalf("job status gave %d %s", w.Code, w.Body)
+	}
+	if finished.Status != job.Status || finished.Dataset == nil || finished.Dataset.CurrentVersion != "2" {
+		t.Errorf("finished job = %+v", finished)
+	}
+
+	var jobs []UpdateJob
+	if w := get("/jobs"); w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &jobs) != nil || len(jobs) != 1 || jobs[0].ID != submitted.ID {
+		t.Errorf("/jobs gave %d %s", w.Code, w.Body)
+	}
+	if w := get("/update/status/nosuchjob"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown job gave %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,257 @@
+package sdsshared
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	//jwksMaxAge is how long a fetched key set is used before it is fetched again
+	jwksMaxAge = time.Hour
+	//jwksMinRefresh is the least time between fetches caused by an unknown key id or a
+	// failing key server, so tokens with made up key ids cannot be used to hammer it
+	jwksMinRefresh = time.Minute
+	//jwksFetchTimeout bounds a single fetch of the key set
+	jwksFetchTimeout = 10 * time.Second
+)
+
+//JWKS is a KeySource backed by a JSON Web Key Set document (RFC 7517). URI may be an
+// http(s) URL or a local file path. The set is cached and fetched again when it is older
+// than an hour or a token names a key id that is not in the cached set.
+//
+//Keys of types that cannot be used, such as OKP keys, are skipped. If fetching the set
+// again fails the cached keys are kept in use
+type JWKS struct {
+	URI string
+
+	mu   sync.RWMutex
+	keys map[string]jwk
+	//fetched is when keys were fetched and attempted when a fetch was last started
+	fetched, attempted time.Time
+	//inflight is the fetch in progress, which other callers wait for rather than
+	// starting their own
+	inflight *jwksFetch
+}
+
+//jwksFetch is a fetch of the key set that callers can wait on
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+//jwk is a single JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	//RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	//EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	//Symmetric
+	K string `json:"k"`
+
+	key interface{}
+}
+
+//Load fetches the key set
+func (j *JWKS) Load(ctx context.Context) error {
+	return j.refresh(ctx)
+}
+
+//VerificationKey implements KeySource. Failures to get any keys match ErrKeysUnavailable
+func (j *JWKS) VerificationKey(ctx context.Context, kid, alg string) (interface{}, error) {
+	j.mu.RLock()
+	cached, fetched, attempted := j.keys != nil, j.fetched, j.attempted
+	j.mu.RUnlock()
+
+	switch {
+	case !cached:
+		if err := j.refresh(ctx); err != nil {
+			return nil, err
+		}
+	case time.Since(fetched) > jwksMaxAge && time.Since(attempted) > jwksMinRefresh:
+		//stale keys are better than none while the key server is unreachable
+		if err := j.refresh(ctx); err != nil {
+			log.Printf("Using cached JWKS keys: %v", err)
+		}
+	}
+	k, ok := j.lookup(kid, alg)
+	if !ok {
+		j.mu.RLock()
+		attempted = j.attempted
+		j.mu.RUnlock()
+		if time.Since(attempted) > jwksMinRefresh {
+			if err := j.refresh(ctx); err != nil {
+				log.Printf("Could not fetch JWKS for unknown key id %q: %v", kid, err)
+			}
+			k, ok = j.lookup(kid, alg)
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("no key found for key id %q", kid)
+	}
+	return k.key, nil
+}
+
+//lookup finds the key for kid. A token without a kid may only be used with a set
+// holding a single key
+func (j *JWKS) lookup(kid, alg string) (jwk, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if kid == "" && len(j.keys) == 1 {
+		for _, k := range j.keys {
+			return k, k.Alg == "" || k.Alg == alg
+		}
+	}
+	k, ok := j.keys[kid]
+	if !ok || (k.Alg != "" && k.Alg != alg) {
+		return jwk{}, false
+	}
+	return k, true
+}
+
+//refresh fetches the key set, or waits for the fetch already in progress. The lock is
+// not held while fetching so requests with cached keys are never held up by it
+func (j *JWKS) refresh(ctx context.Context) error {
+	j.mu.Lock()
+	f := j.inflight
+	if f == nil {
+		f = &jwksFetch{done: make(chan struct{})}
+		j.inflight = f
+		j.attempted = time.Now()
+		//the fetch is shared so it must not end with the request that started it
+		go func() {
+			keys, err := j.fetch(context.Background())
+			j.mu.Lock()
+			if err == nil {
+				j.keys, j.fetched = keys, time.Now()
+			}
+			f.err = err
+			j.inflight = nil
+			j.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	j.mu.Unlock()
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return WrapError(ErrKeysUnavailable, ctx.Err())
+	}
+}
+
+//fetch reads and parses the key set. Keys that cannot be parsed are left out
+func (j *JWKS) fetch(ctx context.Context) (map[string]jwk, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+	raw, err := j.read(ctx)
+	if err != nil {
+		return nil, WrapError(ErrKeysUnavailable, fmt.Errorf("Error fetching JWKS: %v", err))
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, WrapError(ErrKeysUnavailable, fmt.Errorf("Error parsing JWKS: %v", err))
+	}
+	keys := make(map[string]jwk, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.key, err = k.parse(); err != nil {
+			if DebugMode {
+				log.Printf("Skipping JWKS key %q: %v", k.Kid, err)
+			}
+			continue
+		}
+		keys[k.Kid] = k
+	}
+	if len(keys) == 0 {
+		return nil, WrapError(ErrKeysUnavailable, errors.New("JWKS has no usable signing keys"))
+	}
+	return keys, nil
+}
+
+//read returns the raw key set document from a URL or file
+func (j *JWKS) read(ctx context.Context) ([]byte, error) {
+	if !isValidUrl(j.URI) {
+		return os.ReadFile(j.URI)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.URI, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := NewHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+//parse builds the verification key described by the JWK
+func (k jwk) parse() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("curve %q not supported", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return pub, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	default:
+		return nil, fmt.Errorf("key type %q not supported", k.Kty)
+	}
+}
@@ -0,0 +1,199 @@
+package sdsshared
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+//ManifestSuffix is appended to a dataset archive URI to find its manifest. A manifest is
+// a JSON encoded VersionManager describing the archive, for example
+// gs://bucket/datasets/postcodesUK.zip.manifest.json
+const ManifestSuffix = ".manifest.json"
+
+//maxManifestSize limits how much of a manifest is read
+const maxManifestSize = 1 << 20
+
+//VerificationError records a dataset archive that failed verification against its
+// manifest. It matches ErrVerificationFailed
+type VerificationError struct {
+	//URI is the dataset location the archive was downloaded from
+	URI string
+	//Expected and Actual are the manifest and downloaded SHA-256 digests, if compared
+	Expected string
+	Actual   string
+	//Reason describes the failure
+	Reason string
+}
+
+func (e *VerificationError) Error() string {
+	if e.Expected != "" && e.Actual != "" && e.Expected != e.Actual {
+		return fmt.Sprintf("%v for %s: %s: expected sha256 %s, got %s", ErrVerificationFailed, e.URI, e.Reason, e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("%v for %s: %s", ErrVerificationFailed, e.URI, e.Reason)
+}
+
+//Is reports true for ErrVerificationFailed
+func (e *VerificationError) Is(target error) bool {
+	return target == ErrVerificationFailed
+}
+
+//ManifestURI returns the location of the manifest for the dataset archive at uri
+func ManifestURI(uri string) string {
+	if u, err := url.Parse(uri); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		//keep any query string, such as a signed URL, after the path
+		u.Path += ManifestSuffix
+		u.RawPath = ""
+		return u.String()
+	}
+	return uri + ManifestSuffix
+}
+
+//FetchManifest reads the manifest stored next to the dataset archive at src. It returns
+// nil and no error if the archive has no manifest
+func FetchManifest(ctx context.Context, src DatasetSource) (*VersionManager, error) {
+	manifestSrc, err := NewDatasetSource(ManifestURI(src.URI()))
+	if err != nil {
+		return nil, err
+	}
+	rc, err := manifestSrc.Open(ctx)
+	if err != nil {
+		if isNotExist(manifestSrc, err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rc.Close()
+	raw, err := io.ReadAll(io.LimitReader(rc, maxManifestSize))
+	if err != nil {
+		return nil, &DownloadError{URI: manifestSrc.URI(), Err: err}
+	}
+	manifest := &VersionManager{}
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		return nil, &VerificationError{URI: src.URI(), Reason: fmt.Sprintf("manifest is not valid JSON: %v", err)}
+	}
+	return manifest, nil
+}
+
+//isNotExist reports whether err, from opening src, means the object does not exist.
+// S3 answers 403 rather than 404 for a missing key when the caller may not list the
+// bucket, so for S3 sources a 403 is also taken as absent
+func isNotExist(src DatasetSource, err error) bool {
+	var de *DownloadError
+	if errors.As(err, &de) {
+		if de.StatusCode == http.StatusNotFound {
+			return true
+		}
+		if _, ok := src.(*s3Source); ok && de.StatusCode == http.StatusForbidden {
+			return true
+		}
+	}
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, storage.ErrObjectNotExist)
+}
+
+//VerifyDigest checks the hex SHA-256 digest of a dataset archive downloaded from uri
+// against manifest. If DatasetPublicKey is set the manifest must also carry a valid
+// Ed25519 signature of the digest. A nil manifest or one without a digest is only
+// accepted when neither RequireDatasetManifest nor DatasetPublicKey is set
+func VerifyDigest(uri, digest string, manifest *VersionManager) error {
+	required := RequireDatasetManifest || len(DatasetPublicKey) != 0
+	if manifest == nil || manifest.SHA256 == "" {
+		if required {
+			return &VerificationError{URI: uri, Actual: digest, Reason: "no manifest with a sha256 digest found"}
+		}
+		if DebugMode {
+			log.Printf("No dataset manifest found for %s, archive not verified", uri)
+		}
+		return nil
+	}
+	if !strings.EqualFold(manifest.SHA256, digest) {
+		return &VerificationError{URI: uri, Expected: manifest.SHA256, Actual: digest, Reason: "checksum mismatch"}
+	}
+	if len(DatasetPublicKey) == 0 {
+		return nil
+	}
+	if manifest.Signature == "" {
+		return &VerificationError{URI: uri, Expected: manifest.SHA256, Actual: digest, Reason: "manifest is not signed"}
+	}
+	sig, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil {
+		return &VerificationError{URI: uri, Expected: manifest.SHA256, Actual: digest, Reason: "signature is not valid base64"}
+	}
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return &VerificationError{URI: uri, Actual: digest, Reason: "digest is not valid hex"}
+	}
+	if !ed25519.Verify(DatasetPublicKey, raw, sig) {
+		return &VerificationError{URI: uri, Expected: manifest.SHA256, Actual: digest, Reason: "invalid signature"}
+	}
+	return nil
+}
+
+//DownloadVerifiedDataset downloads the archive from src into LocalDownloadDir like
+// DownloadDataset, then verifies it against the manifest stored next to it. It returns
+// the archive path and the manifest, which is nil if there was none.
+//
+//If verification fails the downloaded archive is removed and a *VerificationError is
+// returned so the caller can keep serving its current dataset
+func DownloadVerifiedDataset(ctx context.Context, src DatasetSource) (string, *VersionManager, error) {
+	manifest, err := FetchManifest(ctx, src)
+	if err != nil {
+		return "", nil, err
+	}
+	target := filepath.Join(LocalDownloadDir, DatasetArchiveName)
+	digest, err := downloadTo(ctx, src, target)
+	if err != nil {
+		return "", nil, err
+	}
+	ProgressFromContext(ctx).SetPhase(PhaseVerifying)
+	if err := VerifyDigest(src.URI(), digest, manifest); err != nil {
+		os.Remove(target)
+		return "", nil, err
+	}
+	return target, manifest, nil
+}
+
+//parsePublicKey reads an Ed25519 public key given as base64, or as a path to a file
+// holding base64 or a PEM encoded PKIX public key
+func parsePublicKey(setting string) (ed25519.PublicKey, error) {
+	raw := []byte(setting)
+	if _, err := os.Stat(setting); err == nil {
+		if raw, err = os.ReadFile(setting); err != nil {
+			return nil, err
+		}
+	}
+	if block, _ := pem.Decode(raw); block != nil {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("PEM key is not an Ed25519 public key")
+		}
+		return key, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("key is not PEM or base64: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("key is %d bytes, expected %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
@@ -0,0 +1,132 @@
+package sdsshared
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyDigest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("dataset"))
+	digest := hex.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("tampered"))
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, sum[:]))
+	badSignature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, other[:]))
+	defer func() { RequireDatasetManifest, DatasetPublicKey = false, nil }()
+
+	tests := []struct {
+		name     string
+		require  bool
+		key      ed25519.PublicKey
+		manifest *VersionManager
+		ok       bool
+	}{
+		{"no manifest", false, nil, nil, true},
+		{"no manifest required", true, nil, nil, false},
+		{"no digest required", true, nil, &VersionManager{CurrentVersion: "1.0.0"}, false},
+		{"no manifest with a key", false, pub, nil, false},
+		{"digest matches", false, nil, &VersionManager{SHA256: digest}, true},
+		{"digest case", false, nil, &VersionManager{SHA256: strings.ToUpper(digest)}, true},
+		{"digest mismatch", false, nil, &VersionManager{SHA256: hex.EncodeToString(other[:])}, false},
+		{"signed", false, pub, &VersionManager{SHA256: digest, Signature: signature}, true},
+		{"unsigned", false, pub, &VersionManager{SHA256: digest}, false},
+		{"bad signature", false, pub, &VersionManager{SHA256: digest, Signature: badSignature}, false},
+		{"signature not base64", false, pub, &VersionManager{SHA256: digest, Signature: "%%%"}, false},
+	}
+	for _, tt := range tests {
+		RequireDatasetManifest, DatasetPublicKey = tt.require, tt.key
+		err := VerifyDigest("gs://bucket/data.zip", digest, tt.manifest)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: VerifyDigest gave %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		var ve *VerificationError
+		if !errors.As(err, &ve) || !errors.Is(err, ErrVerificationFailed) {
+			t.Errorf("%s: error %v is not a *VerificationError matching ErrVerificationFailed", tt.name, err)
+		}
+		if StatusCode(err) != http.StatusBadGateway {
+			t.Errorf("%s: StatusCode = %d, want %d", tt.name, StatusCode(err), http.StatusBadGateway)
+		}
+	}
+
+	RequireDatasetManifest, DatasetPublicKey = false, nil
+	err = VerifyDigest("gs://bucket/data.zip", digest, &VersionManager{SHA256: hex.EncodeToString(other[:])})
+	var ve *VerificationError
+	if !errors.As(err, &ve) || ve.Expected != hex.EncodeToString(other[:]) || ve.Actual != digest {
+		t.Errorf("digest mismatch gave %#v, want the expected and actual digests", err)
+	}
+}
+
+func TestIsNotExist(t *testing.T) {
+	httpSrc := &httpSource{url: "https://example.com/data.zip.manifest.json"}
+	s3Src := &s3Source{}
+	tests := []struct {
+		name string
+		src  DatasetSource
+		err  error
+		want bool
+	}{
+		{"http 404", httpSrc, &DownloadError{StatusCode: http.StatusNotFound}, true},
+		{"http 403", httpSrc, &DownloadError{StatusCode: http.StatusForbidden}, false},
+		{"http 500", httpSrc, &DownloadError{StatusCode: http.StatusInternalServerError}, false},
+		{"s3 404", s3Src, &DownloadError{StatusCode: http.StatusNotFound}, true},
+		//S3 answers 403 for a missing key without s3:ListBucket
+		{"s3 403", s3Src, &DownloadError{StatusCode: http.StatusForbidden}, true},
+		{"s3 500", s3Src, &DownloadError{StatusCode: http.StatusInternalServerError}, false},
+		{"file", &fileSource{}, &DownloadError{Err: os.ErrNotExist}, true},
+	}
+	for _, tt := range tests {
+		if got := isNotExist(tt.src, tt.err); got != tt.want {
+			t.Errorf("%s: isNotExist = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadVerifiedDataset(t *testing.T) {
+	dir := t.TempDir()
+	LocalDownloadDir = filepath.Join(dir, "downloads")
+	archive := filepath.Join(dir, "data.zip")
+	if err := os.WriteFile(archive, []byte("dataset"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { RequireDatasetManifest = false }()
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+	for _, uri := range []string{archive, srv.URL + "/data.zip"} {
+		src, err := NewDatasetSource(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//no manifest is accepted unless one is required
+		RequireDatasetManifest = false
+		if _, manifest, err := DownloadVerifiedDataset(context.Background(), src); err != nil || manifest != nil {
+			t.Errorf("%s without manifest: %v, %v", uri, manifest, err)
+		}
+		RequireDatasetManifest = true
+		target, _, err := DownloadVerifiedDataset(context.Background(), src)
+		if !errors.Is(err, ErrVerificationFailed) {
+			t.Errorf("%s without required manifest gave %v, want ErrVerificationFailed", uri, err)
+		}
+		if _, err := os.Stat(filepath.Join(LocalDownloadDir, DatasetArchiveName)); target != "" || !os.IsNotExist(err) {
+			t.Errorf("%s: refused archive was kept", uri)
+		}
+	}
+}
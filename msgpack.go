@@ -0,0 +1,295 @@
+package sdsshared
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+//MsgPackEncoder writes SimpleData as MessagePack. The encoded value has the same shape
+// and field names as the JSON form, with map keys in sorted order
+type MsgPackEncoder struct{}
+
+func (MsgPackEncoder) ContentType() string { return "application/msgpack" }
+
+func (MsgPackEncoder) Encode(w io.Writer, data SimpleData) error {
+	v, err := genericValue(data)
+	if err != nil {
+		return err
+	}
+	out, err := appendMsgPack(nil, v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+//appendMsgPack appends the MessagePack encoding of v, a value made by genericValue
+func appendMsgPack(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendMsgPackInt(b, n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 0xcb)
+		return appendUint64(b, math.Float64bits(f)), nil
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = appendUint16(append(b, 0xda), uint16(n))
+		default:
+			b = appendUint32(append(b, 0xdb), uint32(n))
+		}
+		return append(b, v...), nil
+	case []interface{}:
+		n := len(v)
+		switch {
+		case n < 16:
+			b = append(b, 0x90|byte(n))
+		case n <= math.MaxUint16:
+			b = appendUint16(append(b, 0xdc), uint16(n))
+		default:
+			b = appendUint32(append(b, 0xdd), uint32(n))
+		}
+		var err error
+		for _, elem := range v {
+			if b, err = appendMsgPack(b, elem); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		n := len(v)
+		switch {
+		case n < 16:
+			b = append(b, 0x80|byte(n))
+		case n <= math.MaxUint16:
+			b = appendUint16(append(b, 0xde), uint16(n))
+		default:
+			b = appendUint32(append(b, 0xdf), uint32(n))
+		}
+		var err error
+		for _, k := range sortedKeys(v) {
+			if b, err = appendMsgPack(b, k); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgPack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("Error encoding MessagePack: unexpected %T", v)
+}
+
+//appendMsgPackInt appends n in the smallest MessagePack integer form
+func appendMsgPackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= math.MaxInt8:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(n))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return appendUint16(append(b, 0xcd), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return appendUint32(append(b, 0xce), uint32(n))
+	case n >= 0:
+		return appendUint64(append(b, 0xcf), uint64(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return appendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return appendUint32(append(b, 0xd2), uint32(n))
+	}
+	return appendUint64(append(b, 0xd3), uint64(n))
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func appendUint32(b []byte, n uint32) []byte {
+	return append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(n>>32)), uint32(n))
+}
+
+//decodeMsgPack decodes a MessagePack value into the plain maps, slices, strings, numbers
+// and bools of its JSON form. Binary data is returned as a string and extension types are
+// not supported
+func decodeMsgPack(b []byte) (interface{}, error) {
+	d := msgPackDecoder{b: b}
+	v, err := d.value()
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding MessagePack value: %v", err)
+	}
+	if d.pos != len(b) {
+		return nil, fmt.Errorf("Error decoding MessagePack value: %d bytes left over", len(b)-d.pos)
+	}
+	return v, nil
+}
+
+type msgPackDecoder struct {
+	b   []byte
+	pos int
+}
+
+func (d *msgPackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.b)-d.pos < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	out := d.b[d.pos : d.pos+n]
+	d.pos += n
+	return out, nil
+}
+
+//uint reads a big endian unsigned integer of n bytes
+func (d *msgPackDecoder) uint(n int) (uint64, error) {
+	raw, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range raw {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgPackDecoder) value() (interface{}, error) {
+	raw, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := raw[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		//bin 8/16/32 and str 8/16/32
+		size := 1
+		switch c {
+		case 0xc5, 0xda:
+			size = 2
+		case 0xc6, 0xdb:
+			size = 4
+		}
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		if n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := d.uint(size)
+		//sign extend from the top bit of the value read
+		shift := 64 - 8*uint(size)
+		return int64(n<<shift) >> shift, err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(int(n))
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(n))
+	}
+	return nil, fmt.Errorf("unsupported type byte 0x%x", c)
+}
+
+func (d *msgPackDecoder) str(n int) (interface{}, error) {
+	raw, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(raw), nil
+}
+
+func (d *msgPackDecoder) arrayOf(n int) (interface{}, error) {
+	if n > len(d.b)-d.pos {
+		return nil, io.ErrUnexpectedEOF
+	}
+	out := make([]interface{}, n)
+	for i := range out {
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+func (d *msgPackDecoder) mapOf(n int) (interface{}, error) {
+	if n > len(d.b)-d.pos {
+		return nil, io.ErrUnexpectedEOF
+	}
+	out := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		out[fmt.Sprint(k)] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,119 @@
+package sdsshared
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+//ProtobufEncoder writes SimpleData as the SimpleData message of proto/simpledata.proto.
+// []Record values are sent as Record messages; any other values are sent JSON encoded
+type ProtobufEncoder struct{}
+
+func (ProtobufEncoder) ContentType() string { return "application/x-protobuf" }
+
+func (ProtobufEncoder) Encode(w io.Writer, data SimpleData) error {
+	var b []byte
+	if data.ResultCount != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(data.ResultCount))
+	}
+	b = appendProtoMap(b, 2, data.RequestOptions)
+
+	var meta []byte
+	meta = appendProtoString(meta, 1, data.Meta.Resource)
+	meta = appendProtoString(meta, 2, data.Meta.LastUpdated)
+	for _, source := range data.Meta.DataSources {
+		meta = protowire.AppendTag(meta, 3, protowire.BytesType)
+		meta = protowire.AppendString(meta, source)
+	}
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendBytes(b, meta)
+
+	var values []byte
+	if records, ok := data.Data.Values.([]Record); ok {
+		for _, rec := range records {
+			encoded, err := protoRecord(rec)
+			if err != nil {
+				return err
+			}
+			values = protowire.AppendTag(values, 1, protowire.BytesType)
+			values = protowire.AppendBytes(values, encoded)
+		}
+	} else if data.Data.Values != nil {
+		raw, err := json.Marshal(data.Data.Values)
+		if err != nil {
+			return err
+		}
+		values = protowire.AppendTag(values, 2, protowire.BytesType)
+		values = protowire.AppendBytes(values, raw)
+	}
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendBytes(b, values)
+
+	b = appendProtoString(b, 5, data.NextCursor)
+	b = appendProtoMap(b, 6, data.Errors)
+	_, err := w.Write(b)
+	return err
+}
+
+//protoRecord returns the encoded Record message for rec
+func protoRecord(rec Record) ([]byte, error) {
+	var b []byte
+	b = appendProtoString(b, 1, rec.Key)
+	if rec.Timestamp != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(rec.Timestamp))
+	}
+	switch v := rec.Value.(type) {
+	case nil:
+	case string:
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	default:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, raw)
+	}
+	if rec.Distance != nil {
+		b = protowire.AppendTag(b, 5, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*rec.Distance))
+	}
+	if rec.Score != nil {
+		b = protowire.AppendTag(b, 6, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*rec.Score))
+	}
+	return b, nil
+}
+
+//appendProtoString appends a string field, left out when empty as proto3 does
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+//appendProtoMap appends a map<string, string> field, in key order
+func appendProtoMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendProtoString(entry, 1, k)
+		entry = appendProtoString(entry, 2, m[k])
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
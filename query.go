@@ -0,0 +1,215 @@
+package sdsshared
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Record orders accepted by the order option
+const (
+	//OrderOldest returns records in key order, so the records of one key oldest first.
+	// It is the default
+	OrderOldest = "oldest"
+	//OrderNewest returns records in reverse key order, so the records of one key newest
+	// first
+	OrderNewest = "newest"
+)
+
+//Query is the typed form of the options of a /fetch request. The server parses and
+// validates it once with NewQuery and hands it to data resources implementing
+// QueryRetriever.
+//
+//The options are:
+//
+//	fetch   the search term
+//	limit   the most records to return, at most and by default MaxPageSize
+//	cursor  the next_cursor of the previous page, to continue from there
+//	offset  how many matching records to skip first, after the cursor
+//	order   "oldest" (default) or "newest", see OrderOldest and OrderNewest
+//	since   only records stored at or after this time
+//	until   only records stored before this time
+//	fields  comma separated names of the fields of JSON object values to return
+//	records true for the results as a list of Record, see Query.Records
+//
+//since and until are RFC 3339 times or Unix nanosecond timestamps as used in the keys
+// made by CreateKVStoreKey
+type Query struct {
+	//Term is the search term
+	Term string
+	//Limit is the most records to return, 0 for no limit. NewQuery caps it at MaxPageSize
+	Limit int
+	//After is the key the previous page ended on, decoded from the cursor option. Results
+	// continue with the key after it in Order
+	After []byte
+	//Offset is how many matching records to skip before returning any
+	Offset int
+	//Order is OrderOldest or OrderNewest
+	Order string
+	//Since and Until bound record timestamps to [Since, Until). Zero times are unbounded
+	Since time.Time
+	Until time.Time
+	//Fields lists the fields of JSON object values to return, all if empty
+	Fields []string
+	//Records is set when the request asks for its results as a []Record. Otherwise the
+	// server keeps the shape /fetch had before Query, asking RetrieveContext rather than
+	// RetrieveQuery. Streamed and batch requests always get records
+	Records bool
+	//Options holds every option of the request as given, including ones not part of
+	// Query for connector specific use
+	Options map[string]string
+}
+
+//QueryRetriever is implemented by data resources that honour Query. The server calls
+// RetrieveQuery in place of RetrieveContext for resources implementing it when the
+// request asks for records, see Query.Records
+type QueryRetriever interface {
+	RetrieveQuery(ctx context.Context, q Query) (SimpleData, error)
+}
+
+//Record is one value stored under a key made by CreateKVStoreKey
+type Record struct {
+	//Key is the key without its timestamp
+	Key string `json:"key"`
+	//Timestamp is the Unix nanosecond time the record was stored
+	Timestamp int64 `json:"timestamp"`
+	//Value is the stored value decoded as described by the dataset's ValueSchema, left out
+	// for key only lookups. With Query.Fields set, object values are reduced to those
+	// fields
+	Value interface{} `json:"value,omitempty"`
+	//Distance is the distance in metres of the record from the point of a near query,
+	// left out for other lookups
+	Distance *float64 `json:"distance,omitempty"`
+	//Score is the relevance of the record to a full text search, higher first, left out
+	// for other lookups
+	Score *float64 `json:"score,omitempty"`
+}
+
+//NewQuery parses and validates the options of a request for term. Invalid options give
+// an error matching ErrBadRequest
+func NewQuery(term string, options map[string]string) (Query, error) {
+	q := Query{Term: term, Order: OrderOldest, Options: options}
+	var err error
+	if q.Limit, err = parseCount(options, "limit"); err != nil {
+		return Query{}, err
+	}
+	if MaxPageSize > 0 && (q.Limit == 0 || q.Limit > MaxPageSize) {
+		q.Limit = MaxPageSize
+	}
+	if q.Offset, err = parseCount(options, "offset"); err != nil {
+		return Query{}, err
+	}
+	switch order := strings.ToLower(options["order"]); order {
+	case "":
+	case OrderOldest, OrderNewest:
+		q.Order = order
+	default:
+		return Query{}, NewError(ErrBadRequest, "order must be %q or %q, got %q", OrderOldest, OrderNewest, options["order"])
+	}
+	if cursor := options["cursor"]; cursor != "" {
+		if q.After, err = decodeCursor(cursor, q.Order); err != nil {
+			return Query{}, err
+		}
+	}
+	if q.Since, err = parseQueryTime(options, "since"); err != nil {
+		return Query{}, err
+	}
+	if q.Until, err = parseQueryTime(options, "until"); err != nil {
+		return Query{}, err
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && !q.Since.Before(q.Until) {
+		return Query{}, NewError(ErrBadRequest, "since must be before until")
+	}
+	if records := options["records"]; records != "" {
+		if q.Records, err = strconv.ParseBool(records); err != nil {
+			return Query{}, NewError(ErrBadRequest, "records must be true or false, got %q", records)
+		}
+	}
+	if fields := options["fields"]; fields != "" {
+		for _, f := range strings.Split(fields, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				q.Fields = append(q.Fields, f)
+			}
+		}
+	}
+	return q, nil
+}
+
+//parseCount parses a whole number option, 0 if not set
+func parseCount(options map[string]string, name string) (int, error) {
+	v, ok := options[name]
+	if !ok || v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, NewError(ErrBadRequest, "%s must be a whole number, got %q", name, v)
+	}
+	return n, nil
+}
+
+//parseQueryTime parses an RFC 3339 or Unix nanosecond time option, zero if not set
+func parseQueryTime(options map[string]string, name string) (time.Time, error) {
+	v, ok := options[name]
+	if !ok || v == "" {
+		return time.Time{}, nil
+	}
+	if ns, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(0, ns), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, NewError(ErrBadRequest, "%s must be an RFC 3339 time or Unix nanoseconds, got %q", name, v)
+	}
+	return t, nil
+}
+
+//EncodeCursor returns the opaque cursor continuing a query in order after lastKey, the
+// key of the last record returned. Data resources return it in SimpleData.NextCursor
+func EncodeCursor(lastKey []byte, order string) string {
+	//the order is kept in the cursor so it cannot be used to continue the other way
+	return base64.RawURLEncoding.EncodeToString(append([]byte(order[:1]), lastKey...))
+}
+
+//decodeCursor returns the key a cursor continues after
+func decodeCursor(cursor, order string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(raw) < 2 {
+		return nil, NewError(ErrBadRequest, "invalid cursor")
+	}
+	if raw[0] != order[0] {
+		return nil, NewError(ErrBadRequest, "cursor is for a different order")
+	}
+	return raw[1:], nil
+}
+
+//InRange reports whether a record stored at the Unix nanosecond timestamp ts falls
+// within Since and Until
+func (q Query) InRange(ts int64) bool {
+	if !q.Since.IsZero() && ts < q.Since.UnixNano() {
+		return false
+	}
+	if !q.Until.IsZero() && ts >= q.Until.UnixNano() {
+		return false
+	}
+	return true
+}
+
+//Select applies Fields to a decoded value, such as one returned by ValueSchema.Decode.
+// Objects are reduced to the requested fields that they have; other values are returned
+// unchanged
+func (q Query) Select(value interface{}) interface{} {
+	obj, ok := value.(map[string]interface{})
+	if !ok || len(q.Fields) == 0 {
+		return value
+	}
+	out := make(map[string]interface{}, len(q.Fields))
+	for _, f := range q.Fields {
+		if v, ok := obj[f]; ok {
+			out[f] = v
+		}
+	}
+	return out
+}
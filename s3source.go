@@ -0,0 +1,224 @@
+package sdsshared
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//emptyPayloadHash is the hex SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+//s3Source reads dataset archives from S3 compatible object storage, addressed as
+// s3://bucket/key. Endpoint, region, credentials and addressing style come from the s3_*
+// settings. Requests are signed with AWS Signature Version 4, or sent unsigned if no
+// credentials are set
+type s3Source struct {
+	bucket    string
+	key       string
+	endpoint  *url.URL
+	region    string
+	pathStyle bool
+
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+func newS3Source(u *url.URL) (DatasetSource, error) {
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, NewError(ErrBadRequest, "dataset uri %q must be of the form s3://bucket/key", u.String())
+	}
+	endpoint := S3Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", S3Region)
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil || ep.Host == "" {
+		return nil, fmt.Errorf("Invalid s3_endpoint setting %q: %v", S3Endpoint, err)
+	}
+	return &s3Source{
+		bucket:          u.Host,
+		key:             key,
+		endpoint:        ep,
+		region:          S3Region,
+		pathStyle:       S3PathStyle,
+		accessKeyID:     S3AccessKeyID,
+		secretAccessKey: S3SecretAccessKey,
+		sessionToken:    S3SessionToken,
+	}, nil
+}
+
+func (s3 *s3Source) URI() string {
+	return fmt.Sprintf("s3://%s/%s", s3.bucket, s3.key)
+}
+
+func (s3 *s3Source) Open(ctx context.Context) (io.ReadCloser, error) {
+	resp, err := s3.do(ctx, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	return sizedBody{resp.Body, resp.ContentLength}, nil
+}
+
+//Revision is the object ETag
+func (s3 *s3Source) Revision(ctx context.Context) (string, error) {
+	resp, err := s3.do(ctx, http.MethodHead)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+//do sends a signed request for the object and checks the response status
+func (s3 *s3Source) do(ctx context.Context, method string) (*http.Response, error) {
+	req, err := s3.newRequest(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+	client := NewHTTPClient()
+	//large archives take longer than the client timeout so the download is bounded by ctx instead
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &DownloadError{URI: s3.URI(), Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &DownloadError{URI: s3.URI(), StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+//newRequest builds the signed request for the object using path-style
+// (endpoint/bucket/key) or virtual-hosted (bucket.endpoint/key) addressing
+func (s3 *s3Source) newRequest(ctx context.Context, method string) (*http.Request, error) {
+	host := s3.endpoint.Host
+	objectPath := "/" + awsURIEncode(s3.key, false)
+	if s3.pathStyle {
+		objectPath = "/" + awsURIEncode(s3.bucket, true) + objectPath
+	} else {
+		host = s3.bucket + "." + host
+	}
+	basePath := strings.TrimSuffix(s3.endpoint.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s://%s%s%s", s3.endpoint.Scheme, host, basePath, objectPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s3.accessKeyID != "" {
+		s3.sign(req, time.Now().UTC())
+	}
+	return req, nil
+}
+
+//sign adds AWS Signature Version 4 headers to a request with an empty body. The host and
+// every header already set on the request are signed
+func (s3 *s3Source) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", emptyPayloadHash)
+	if s3.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s3.sessionToken)
+	}
+	canonical, signedHeaders := canonicalRequest(req, emptyPayloadHash)
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s3.region)
+	toSign := stringToSign(amzDate, scope, canonical)
+	signature := hex.EncodeToString(hmacSHA256(signingKey(s3.secretAccessKey, date, s3.region), toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.accessKeyID, scope, signedHeaders, signature))
+}
+
+//canonicalRequest returns the SigV4 canonical request of req, whose body has the hex
+// SHA-256 payloadHash, and the list of headers it signs
+func canonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	values := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for name, v := range req.Header {
+		name = strings.ToLower(name)
+		//a request signed before, such as a retry, keeps its old signature out
+		if _, ok := values[name]; ok || name == "authorization" {
+			continue
+		}
+		trimmed := make([]string, len(v))
+		for i, value := range v {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		values[name] = strings.Join(trimmed, ",")
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&headers, "%s:%s\n", name, values[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	return strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+//stringToSign returns the SigV4 string to sign for a canonical request made at amzDate
+// within the credential scope
+func stringToSign(amzDate, scope, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	return strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+}
+
+//signingKey derives the SigV4 key for S3 requests in region on date
+func signingKey(secret, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//awsURIEncode percent encodes s as required for SigV4 canonical URIs. Slashes are kept
+// unless encodeSlash is set
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
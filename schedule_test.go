@@ -0,0 +1,94 @@
+package sdsshared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"6h", true},
+		{"@every 90m", true},
+		{"@hourly", true},
+		{"@daily", true},
+		{"@weekly", true},
+		{"@monthly", true},
+		{"30 3 * * 1-5", true},
+		{"*/15 * * * *", true},
+		{"0-30/5 1,13 1 1-12/3 7", true},
+		{"0s", false},
+		{"-1h", false},
+		{"@yearly", false},
+		{"* * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSchedule(tt.spec); (err == nil) != tt.ok {
+			t.Errorf("ParseSchedule(%q) gave %v, want ok %v", tt.spec, err, tt.ok)
+		}
+	}
+	if s, _ := ParseSchedule("@every 6h"); s != Every(6*time.Hour) {
+		t.Errorf("@every 6h parsed as %v", s)
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{"6h", "2021-12-08 21:07", "2021-12-09 03:07"},
+		{"@hourly", "2021-12-08 21:07", "2021-12-08 22:00"},
+		{"@daily", "2021-12-31 23:59", "2022-01-01 00:00"},
+		//a time on the schedule is not its own next run
+		{"30 3 * * *", "2021-12-08 03:30", "2021-12-09 03:30"},
+		{"*/15 * * * *", "2021-12-08 21:07", "2021-12-08 21:15"},
+		//2021-12-10 is a Friday, so the next weekday run is Monday
+		{"30 3 * * 1-5", "2021-12-10 04:00", "2021-12-13 03:30"},
+		//7 is also Sunday
+		{"0 0 * * 7", "2021-12-08 00:00", "2021-12-12 00:00"},
+		//with both day fields restricted either matching runs: the 15th or a Monday
+		{"0 0 15 * 1", "2021-12-08 00:00", "2021-12-13 00:00"},
+		{"0 0 15 * 1", "2021-12-13 00:00", "2021-12-15 00:00"},
+		//with one day field unrestricted only the other counts
+		{"0 0 15 * *", "2021-12-08 00:00", "2021-12-15 00:00"},
+		{"0 0 * * 1", "2021-12-08 00:00", "2021-12-13 00:00"},
+		//months without the day are skipped, rolling over the year
+		{"0 0 31 * *", "2021-11-01 00:00", "2021-12-31 00:00"},
+		{"0 0 31 * *", "2021-12-31 00:00", "2022-01-31 00:00"},
+		{"0 0 31 * *", "2022-01-31 00:00", "2022-03-31 00:00"},
+		{"0 0 29 2 *", "2021-03-01 00:00", "2024-02-29 00:00"},
+		{"@monthly", "2021-12-08 21:07", "2022-01-01 00:00"},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q): %v", tt.spec, err)
+		}
+		if got := s.Next(at(tt.from)); !got.Equal(at(tt.want)) {
+			t.Errorf("%q Next(%s) = %s, want %s", tt.spec, tt.from, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+	//a day that never comes
+	if s, _ := ParseSchedule("0 0 31 2 *"); !s.Next(at("2021-01-01 00:00")).IsZero() {
+		t.Error("0 0 31 2 * has a next run")
+	}
+}
@@ -1,26 +1,107 @@
 package sdsshared
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-//Redirect included to ensure http requests are forwarded to the Https endpoint - ref https://gist.github.com/d-schmidt/587ceec34ce1334a5e60
-func redirect(w http.ResponseWriter, req *http.Request) {
-	// remove/add not default ports from req.Host
-	target := "https://" + req.Host + req.URL.Path
-	if len(req.URL.RawQuery) > 0 {
-		target += "?" + req.URL.RawQuery
+//Server serves a single DataResource over HTTP. Create one with NewServer then either
+// call Run to serve until a context is done, or Start and Stop to control it from code.
+type Server struct {
+	//Resource is the data resource served by /fetch and /update
+	Resource ContextDataResource
+	//Name is the TLS server name. Defaults to ResourceServiceName suffixed with 'Server'
+	Name string
+	//Addr is the TCP address to listen on. Use port 0 to pick a free port, see ListenAddr
+	Addr string
+	//GracePeriod is how long Stop waits for in-flight requests to finish before
+	// cancelling their contexts and closing their connections
+	GracePeriod time.Duration
+	//CertFile and KeyFile are paths to a PEM encoded TLS certificate and key. When both
+	// are set the server serves HTTPS only and reloads the pair when the files change
+	CertFile string
+	KeyFile  string
+	//RedirectAddr is the TCP address of an optional plain HTTP listener that redirects
+	// every request to the HTTPS endpoint. Only used when serving TLS
+	RedirectAddr string
+	//Auth verifies JWT bearer tokens on every route. Authentication is disabled if nil
+	Auth *Authenticator
+	//FetchScope and UpdateScope are the token scopes required for /fetch and /update
+	// when Auth is set. An empty scope only requires a valid token
+	FetchScope  string
+	UpdateScope string
+	//Updater runs /update requests and scheduled background updates, making sure only
+	// one runs at a time. Created by Start if nil
+	Updater *Updater
+	//UpdateOnStart starts a background check for a newer dataset as soon as the server
+	// is up, for data resources that serve a dataset kept from before a restart
+	UpdateOnStart bool
+
+	mu sync.Mutex
+	//starting is set while StartContext runs the startup scripts without holding mu
+	starting       bool
+	httpServer     *http.Server
+	redirectServer *http.Server
+	listener       net.Listener
+	serveErr       chan error
+	cancelBase     context.CancelFunc
+	stopOnce       sync.Once
+	stopErr        error
+}
+
+//NewServer creates a Server for dr. The port and serverName arguments follow the same
+// defaulting rules as StartServer and the grace period is taken from ShutdownGracePeriod.
+//
+//If dr also implements ContextDataResource the request context is passed through to
+// Retrieve and UpdateDataset so that work stops when the client disconnects
+func NewServer(dr DataResource, serverName string, port int) *Server {
+	//set port
+	prt := ""
+	if port == 0 {
+		prt = fmt.Sprintf(":%s", PublicPort)
+	} else {
+		prt = fmt.Sprintf(":%d", port)
+	}
+	if serverName == "" {
+		serverName = fmt.Sprintf("%s Server", ResourceServiceName)
+	}
+
+	redirectAddr := ""
+	if RedirectPort != "" {
+		redirectAddr = fmt.Sprintf(":%s", RedirectPort)
 	}
-	log.Printf("redirect to: %s", target)
-	http.Redirect(w, req, target,
-		//consider the codes 308, 302, or 301. 307 used as also forwards req body
-		http.StatusTemporaryRedirect)
+
+	return &Server{
+		Resource:      WithContext(dr),
+		Name:          serverName,
+		Addr:          prt,
+		GracePeriod:   ShutdownGracePeriod,
+		CertFile:      TLSCertFile,
+		KeyFile:       TLSKeyFile,
+		RedirectAddr:  redirectAddr,
+		Auth:          NewAuthenticatorFromSettings(),
+		FetchScope:    JWTFetchScope,
+		UpdateScope:   JWTUpdateScope,
+		Updater:       NewUpdater(WithContext(dr), UpdateSchedule),
+		UpdateOnStart: UpdateOnStart,
+	}
+}
+
+//TLSEnabled reports whether the server is configured to serve HTTPS
+func (s *Server) TLSEnabled() bool {
+	return s.CertFile != "" && s.KeyFile != ""
 }
 
 //StartServer runs the server to interface with the system using the api methods of DataResource.
@@ -30,109 +111,397 @@ func redirect(w http.ResponseWriter, req *http.Request) {
 //
 //Similarly if serverName is not set the default will be used or the value in environment
 // variable `name` suffixed with the word 'server'
+//
+//On SIGINT or SIGTERM the server stops accepting connections, waits up to
+// ShutdownGracePeriod for in-flight requests and then runs the data resource shutdown
+// scripts. A signal during the data resource startup abandons it. A clean shutdown
+// returns nil
 func StartServer(dr DataResource, serverName string, port int) error {
-	//set port
-	prt := ""
-	if port == 0 {
-		prt = fmt.Sprintf(":%s", PublicPort)
-	} else {
-		prt = fmt.Sprintf(":%d", port)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return NewServer(dr, serverName, port).Run(ctx)
+}
+
+//Run starts the server and blocks until ctx is done or the server fails, then stops it
+// gracefully. A shutdown caused by ctx returns nil. If ctx is done while the data resource
+// is still starting up, such as during the first dataset download, startup is abandoned
+// and its error returned
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.StartContext(ctx); err != nil {
+		return err
+	}
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down server: %v", ctx.Err())
+	case serveErr = <-s.serveErr:
 	}
 
-	//set routes
-	router := http.NewServeMux()
+	stopErr := s.Stop(context.Background())
+	if serveErr != nil {
+		return fmt.Errorf("Could not launch server: %+v", serveErr)
+	}
+	return stopErr
+}
 
-	router.HandleFunc("/fetch", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Scheme == "http" {
-			redirect(w, r)
-		}
-		term := r.URL.Query().Get("fetch")
+//Start runs the data resource startup scripts, binds the listener and serves requests
+// in the background. It returns once the server is accepting connections
+func (s *Server) Start() error {
+	return s.StartContext(context.Background())
+}
 
-		args := make(map[string]string)
-		for k, v := range r.URL.Query() {
-			args[k] = strings.Join(v, ",")
-		}
-		data, err := dr.Retrieve(term, args)
+//StartContext is Start with a context passed to the data resource startup scripts and
+// the loading of JWT verification keys, so a slow startup can be abandoned
+func (s *Server) StartContext(ctx context.Context) error {
+	s.mu.Lock()
+	if s.httpServer != nil || s.starting {
+		s.mu.Unlock()
+		return errors.New("Server already started")
+	}
+	s.starting = true
+	if s.Updater == nil {
+		s.Updater = NewUpdater(s.Resource, nil)
+	}
+	s.mu.Unlock()
+	//the startup scripts can take as long as a dataset download so run them unlocked
+	err := s.start(ctx)
+	s.mu.Lock()
+	s.starting = false
+	s.mu.Unlock()
+	return err
+}
+
+//start does the work of StartContext
+func (s *Server) start(ctx context.Context) error {
+
+	tlsConfig := &tls.Config{
+		ServerName: s.Name,
+		MinVersion: tls.VersionTLS12,
+	}
+	if s.TLSEnabled() {
+		certs, err := newCertReloader(s.CertFile, s.KeyFile)
 		if err != nil {
-			log.Printf("Error. Could not retrieve data from data resource: %v", err)
-			errMsgPayload, err := returnErrorJSON("Dataset fetch error", http.StatusInternalServerError, err.Error())
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			fmt.Fprint(w, errMsgPayload)
-			return
+			return fmt.Errorf("Could not load TLS certificate before server launch: %+v", err)
 		}
-		dataJSON, err := json.MarshalIndent(data, " ", " ")
-		if err != nil {
-			log.Printf("Error marshalling returned SimpleData struct: %v", err)
-			errMsgPayload, err := returnErrorJSON("Marshaling results error", http.StatusInternalServerError, err.Error())
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+		tlsConfig.GetCertificate = certs.GetCertificate
+	}
+	if s.Auth != nil {
+		if kl, ok := s.Auth.Keys.(keyLoader); ok {
+			if err := kl.Load(ctx); err != nil {
+				return fmt.Errorf("Could not load JWT verification keys before server launch: %+v", err)
 			}
-			fmt.Fprint(w, errMsgPayload)
-			return
 		}
-		fmt.Fprint(w, string(dataJSON))
-	})
+	}
 
-	router.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Scheme == "http" {
-			redirect(w, r)
-		}
+	//run startup scripts in the data resource
+	if err := s.Resource.StartupContext(ctx); err != nil {
+		//release anything the resource opened before it failed or was abandoned
+		s.Resource.ShutdownContext(context.Background())
+		return fmt.Errorf("Could not run data resource startup scripts before server launch: %w", err)
+	}
 
-		newVersionInfo, err := dr.UpdateDataset()
-		if err != nil {
-			log.Printf("Error updating dataset: %v", err)
-			errMsgPayload, err := returnErrorJSON("Dataset update error", http.StatusInternalServerError, err.Error())
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			fmt.Fprint(w, errMsgPayload)
-			return
-		}
-		versionDataJSON, err := json.MarshalIndent(newVersionInfo, " ", " ")
-		if err != nil {
-			log.Printf("Error marshalling returned VersionData struct: %v", err)
-			errMsgPayload, err := returnErrorJSON("Dataset update error", http.StatusInternalServerError, err.Error())
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			fmt.Fprint(w, errMsgPayload)
-			return
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		s.Resource.ShutdownContext(context.Background())
+		return fmt.Errorf("Could not launch server: %+v", err)
+	}
+	var redirectLn net.Listener
+	if s.TLSEnabled() && s.RedirectAddr != "" {
+		if redirectLn, err = net.Listen("tcp", s.RedirectAddr); err != nil {
+			ln.Close()
+			s.Resource.ShutdownContext(context.Background())
+			return fmt.Errorf("Could not launch HTTP redirect server: %+v", err)
 		}
-		fmt.Fprint(w, string(versionDataJSON))
-	})
+	}
+
+	//request contexts derive from baseCtx so that they can be cancelled if the grace period runs out
+	baseCtx, cancel := context.WithCancel(context.Background())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	//build server
-	server := &http.Server{
-		Addr:              prt,
-		Handler:           router,
+	s.httpServer = &http.Server{
+		Addr:              s.Addr,
+		Handler:           s.routes(),
 		ReadTimeout:       2 * time.Second,
 		ReadHeaderTimeout: 1 * time.Second,
 		IdleTimeout:       2 * time.Second,
-		TLSConfig: &tls.Config{
-			ServerName: serverName,
-			MinVersion: tls.TLS_AES_128_GCM_SHA256,
-		},
+		TLSConfig:         tlsConfig,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
 	}
+	s.listener = ln
+	s.cancelBase = cancel
+	s.serveErr = make(chan error, 2)
+
+	//run server
+	go func(srv *http.Server) {
+		var err error
+		if s.TLSEnabled() {
+			log.Printf("Running HTTPS server on %s\n", ln.Addr())
+			//certificates come from TLSConfig.GetCertificate
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			log.Printf("Running server on %s\n", ln.Addr())
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.serveErr <- err
+		}
+	}(s.httpServer)
 
-	if server.TLSConfig.ServerName == "" {
-		server.TLSConfig.ServerName = fmt.Sprintf("%s Server", ResourceServiceName)
+	//run background dataset updates
+	s.Updater.Start()
+	if s.UpdateOnStart {
+		s.Updater.CheckNow()
 	}
 
-	//run startup scripts in the data resource
-	if err := dr.Startup(); err != nil {
-		return fmt.Errorf("Could not run data resource startup scripts before server launch: %+v", err)
+	//run redirect server
+	if redirectLn != nil {
+		_, httpsPort, _ := net.SplitHostPort(ln.Addr().String())
+		s.redirectServer = &http.Server{
+			Handler:           redirectHandler(httpsPort),
+			ReadTimeout:       2 * time.Second,
+			ReadHeaderTimeout: 1 * time.Second,
+			IdleTimeout:       2 * time.Second,
+		}
+		log.Printf("Redirecting HTTP requests on %s to HTTPS\n", redirectLn.Addr())
+		go func(srv *http.Server) {
+			if err := srv.Serve(redirectLn); err != nil && err != http.ErrServerClosed {
+				s.serveErr <- err
+			}
+		}(s.redirectServer)
 	}
 
-	//Ensure shutdown scripts are run
-	defer dr.Shutdown()
+	return nil
+}
 
-	//run server
-	log.Printf("Running server on port %d\n", port)
-	return fmt.Errorf("Could not launch server: %+v", server.ListenAndServe())
+//ListenAddr is the address the server is listening on. It is empty until Start succeeds
+func (s *Server) ListenAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+//Stop stops accepting new connections and waits for in-flight requests to drain for up
+// to GracePeriod or until ctx is done. Requests still running after that have their
+// contexts cancelled. The data resource shutdown scripts are run last.
+//
+//Stop is safe to call more than once; later calls return the first result
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.httpServer
+	redirectSrv := s.redirectServer
+	s.mu.Unlock()
+	if srv == nil {
+		return errors.New("Server not started")
+	}
+
+	s.stopOnce.Do(func() {
+		if s.GracePeriod > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.GracePeriod)
+			defer cancel()
+		}
+		if redirectSrv != nil {
+			redirectSrv.Close()
+		}
+		//no new background updates, and cancel any in progress
+		s.Updater.Stop()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Grace period over, closing remaining connections: %v", err)
+			s.cancelBase()
+			srv.Close()
+		}
+		s.cancelBase()
+
+		//Ensure shutdown scripts are run
+		if err := s.Resource.ShutdownContext(context.Background()); err != nil {
+			s.stopErr = fmt.Errorf("Could not run data resource shutdown scripts: %+v", err)
+		}
+	})
+	return s.stopErr
+}
+
+//routes builds the request router for the server
+func (s *Server) routes() http.Handler {
+	router := http.NewServeMux()
+	router.Handle("/fetch", s.authorise(http.HandlerFunc(s.handleFetch), s.FetchScope))
+	router.Handle("/fetch/batch", s.authorise(http.HandlerFunc(s.handleBatch), s.FetchScope))
+	router.Handle("/update", s.authorise(http.HandlerFunc(s.handleUpdate), s.UpdateScope))
+	router.Handle("/update/status", s.authorise(http.HandlerFunc(s.handleUpdateStatus), s.UpdateScope))
+	router.Handle("/update/status/", s.authorise(http.HandlerFunc(s.handleJob), s.UpdateScope))
+	router.Handle("/jobs", s.authorise(http.HandlerFunc(s.handleJobs), s.UpdateScope))
+	router.Handle("/rollback", s.authorise(http.HandlerFunc(s.handleRollback), s.UpdateScope))
+	router.Handle("/generations", s.authorise(http.HandlerFunc(s.handleGenerations), s.UpdateScope))
+	return compress(router)
+}
+
+//authorise wraps h with the JWT middleware requiring scope, if authentication is enabled
+func (s *Server) authorise(h http.Handler, scope string) http.Handler {
+	if s.Auth == nil {
+		return h
+	}
+	if scope == "" {
+		return s.Auth.Require()(h)
+	}
+	return s.Auth.Require(scope)(h)
+}
+
+//handleFetch parses the request options into a Query and retrieves the matching data,
+// writing it in the format the request asks for. See negotiateFormat
+func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
+	args := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		args[k] = strings.Join(v, ",")
+	}
+	q, err := NewQuery(args["fetch"], args)
+	if err != nil {
+		writeResourceError(w, "Dataset fetch error", err)
+		return
+	}
+	format, err := negotiateFormat(r)
+	if err != nil {
+		writeResourceError(w, "Dataset fetch error", err)
+		return
+	}
+	if format == FormatNDJSON {
+		s.streamFetch(w, r, q)
+		return
+	}
+	enc, _ := encoderFor(format)
+	data, err := s.retrieve(r.Context(), q)
+	if err != nil {
+		log.Printf("Error. Could not retrieve data from data resource: %v", err)
+		writeResourceError(w, "Dataset fetch error", err)
+		return
+	}
+	if err := writeEncoded(w, enc, data); err != nil {
+		log.Printf("Error encoding returned SimpleData struct as %s: %v", format, err)
+		writeError(w, "Marshaling results error", http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+//retrieve runs q against the data resource. Resources implementing QueryRetriever get
+// the Query if it asks for records, otherwise the term and options go to RetrieveContext
+// so the response keeps the resource's original shape
+func (s *Server) retrieve(ctx context.Context, q Query) (SimpleData, error) {
+	if qr, ok := s.underlying().(QueryRetriever); ok && q.Records {
+		return qr.RetrieveQuery(ctx, q)
+	}
+	return s.Resource.RetrieveContext(ctx, q.Term, q.Options)
+}
+
+//streamFetch writes the results of q as newline delimited JSON. Resources implementing
+// StreamRetriever pass records along as they are read; the results of others are
+// retrieved in one piece and then written out
+func (s *Server) streamFetch(w http.ResponseWriter, r *http.Request, q Query) {
+	stream := newNDJSONStream(w, q.Options)
+	var nextCursor string
+	var err error
+	if sr, ok := s.underlying().(StreamRetriever); ok {
+		nextCursor, err = sr.StreamQuery(r.Context(), q, stream)
+	} else {
+		var data SimpleData
+		q.Records = true
+		if data, err = s.retrieve(r.Context(), q); err == nil {
+			err = streamData(stream, data)
+			nextCursor = data.NextCursor
+		}
+	}
+	if err != nil {
+		log.Printf("Error. Could not stream data from data resource: %v", err)
+	}
+	stream.end(nextCursor, err)
+}
+
+//handleUpdate starts a dataset update job and responds straight away with 202 Accepted
+// and the job, whose progress is then reported at /update/status/{id}. The update only
+// loads a dataset if a newer version is available, or unconditionally with force=true.
+//
+//While a job is running further requests return the running job rather than starting
+// another
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	job := s.Updater.Submit(force)
+	w.Header().Set("Location", "/update/status/"+job.ID)
+	writeJSON(w, "Dataset update error", http.StatusAccepted, job)
+}
+
+//handleUpdateStatus reports the state of the updater, including the outcome of the last
+// update and when the next scheduled update is due
+func (s *Server) handleUpdateStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, "Update status error", http.StatusOK, s.Updater.Status())
+}
+
+//handleJob reports the progress or outcome of the update job /update/status/{id}
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/update/status/")
+	job, ok := s.Updater.Job(id)
+	if !ok {
+		writeResourceError(w, "Update status error", NewError(ErrNotFound, "no update job %q", id))
+		return
+	}
+	writeJSON(w, "Update status error", http.StatusOK, job)
+}
+
+//handleJobs lists the running update job and recent finished ones, newest first
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, "Update status error", http.StatusOK, s.Updater.Jobs())
+}
+
+//underlying returns the data resource as given to the server, without any adapter, to
+// check for optional interfaces
+func (s *Server) underlying() interface{} {
+	if ca, ok := s.Resource.(contextAdapter); ok {
+		return ca.DataResource
+	}
+	return s.Resource
+}
+
+//rollbacker returns the data resource as a Rollbacker if it supports rollback
+func (s *Server) rollbacker() (Rollbacker, error) {
+	if rb, ok := s.underlying().(Rollbacker); ok {
+		return rb, nil
+	}
+	return nil, NewError(ErrNotSupported, "%s does not keep previous datasets", ResourceServiceName)
+}
+
+//handleRollback puts a previous dataset generation back in use. generation selects the
+// generation, defaulting to the one before the current one
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	rb, err := s.rollbacker()
+	if err != nil {
+		writeResourceError(w, "Dataset rollback error", err)
+		return
+	}
+	generation := -1
+	if g := r.URL.Query().Get("generation"); g != "" {
+		if generation, err = strconv.Atoi(g); err != nil || generation < 0 {
+			writeResourceError(w, "Dataset rollback error", NewError(ErrBadRequest, "generation must be a generation number, got %q", g))
+			return
+		}
+	}
+	vm, err := rb.Rollback(r.Context(), generation)
+	if err != nil {
+		log.Printf("Error rolling back dataset: %v", err)
+		writeResourceError(w, "Dataset rollback error", err)
+		return
+	}
+	writeJSON(w, "Dataset rollback error", http.StatusOK, vm)
+}
+
+//handleGenerations lists the dataset generations kept for rollback
+func (s *Server) handleGenerations(w http.ResponseWriter, r *http.Request) {
+	rb, err := s.rollbacker()
+	if err != nil {
+		writeResourceError(w, "Dataset generations error", err)
+		return
+	}
+	writeJSON(w, "Dataset generations error", http.StatusOK, rb.Generations())
 }
@@ -0,0 +1,206 @@
+package sdsshared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//blockingResource is a ContextDataResource whose Startup and Retrieve wait to be released
+type blockingResource struct {
+	//startup, if set, blocks StartupContext until it is closed or the context is done
+	startup chan struct{}
+	//retrieving is sent to when a retrieve starts, which then waits for release
+	retrieving chan struct{}
+	release    chan struct{}
+	shutdowns  int32
+}
+
+func (br *blockingResource) StartupContext(ctx context.Context) error {
+	if br.startup == nil {
+		return nil
+	}
+	select {
+	case <-br.startup:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (br *blockingResource) UpdateDatasetContext(ctx context.Context) (VersionManager, error) {
+	return VersionManager{}, ErrUpToDate
+}
+
+func (br *blockingResource) RetrieveContext(ctx context.Context, term string, options map[string]string) (SimpleData, error) {
+	br.retrieving <- struct{}{}
+	<-br.release
+	return SimpleData{ResultCount: 1, Data: DataOutput{Values: term}}, nil
+}
+
+func (br *blockingResource) ShutdownContext(ctx context.Context) error {
+	atomic.AddInt32(&br.shutdowns, 1)
+	return nil
+}
+
+func newTestServer(dr ContextDataResource) *Server {
+	return &Server{Resource: dr, Addr: "127.0.0.1:0", GracePeriod: 5 * time.Second}
+}
+
+func TestServerStopDrainsRequests(t *testing.T) {
+	dr := &blockingResource{retrieving: make(chan struct{}), release: make(chan struct{})}
+	s := newTestServer(dr)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if s.ListenAddr() == "" {
+		t.Fatal("no listen address after Start")
+	}
+
+	type response struct {
+		code int
+		body string
+		err  error
+	}
+	done := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + s.ListenAddr() + "/fetch?fetch=inflight")
+		if err != nil {
+			done <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		done <- response{code: resp.StatusCode, body: string(body), err: err}
+	}()
+	<-dr.retrieving
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Stop(context.Background()) }()
+	//Stop waits for the request in flight
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop returned with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := atomic.LoadInt32(&dr.shutdowns); n != 0 {
+		t.Fatalf("Shutdown ran %d times before the request drained", n)
+	}
+	close(dr.release)
+
+	res := <-done
+	if res.err != nil || res.code != http.StatusOK {
+		t.Fatalf("in flight request got %d, %v", res.code, res.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if n := atomic.LoadInt32(&dr.shutdowns); n != 1 {
+		t.Errorf("Shutdown ran %d times, want 1", n)
+	}
+	if _, err := http.Get("http://" + s.ListenAddr() + "/fetch?fetch=late"); err == nil {
+		t.Error("server still accepting requests after Stop")
+	}
+}
+
+func TestRunAbandonsStartup(t *testing.T) {
+	dr := &blockingResource{startup: make(chan struct{})}
+	s := newTestServer(dr)
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() { ran <- s.Run(ctx) }()
+	//a signal during a long startup, such as the first dataset download
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-ran:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return when its context was cancelled during startup")
+	}
+	if n := atomic.LoadInt32(&dr.shutdowns); n != 1 {
+		t.Errorf("Shutdown ran %d times after abandoned startup, want 1", n)
+	}
+	if s.ListenAddr() != "" {
+		t.Error("server listening after abandoned startup")
+	}
+}
+
+//shapeResource answers RetrieveContext with the original timestamp map and RetrieveQuery
+// with records, counting the calls to each
+type shapeResource struct {
+	blockingResource
+	maps, queries int
+}
+
+func (sr *shapeResource) RetrieveContext(ctx context.Context, term string, options map[string]string) (SimpleData, error) {
+	sr.maps++
+	return SimpleData{ResultCount: 1, Data: DataOutput{Values: map[string]string{"1000": "value"}}}, nil
+}
+
+func (sr *shapeResource) RetrieveQuery(ctx context.Context, q Query) (SimpleData, error) {
+	sr.queries++
+	return SimpleData{ResultCount: 1, Data: DataOutput{Values: []Record{{Key: q.Term, Timestamp: 1000, Value: "value"}}}}, nil
+}
+
+func TestFetchKeepsValueShape(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		//queried is set when RetrieveQuery should answer
+		queried bool
+	}{
+		{"fetch=a", `{"1000":"value"}`, false},
+		{"fetch=a&limit=5&order=newest", `{"1000":"value"}`, false},
+		{"fetch=a&records=false", `{"1000":"value"}`, false},
+		{"fetch=a&records=true", `[{"key":"a","timestamp":1000,"value":"value"}]`, true},
+		{"fetch=a&records=1&limit=5", `[{"key":"a","timestamp":1000,"value":"value"}]`, true},
+	}
+	for _, tt := range tests {
+		dr := &shapeResource{}
+		rec := httptest.NewRecorder()
+		newTestServer(dr).routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fetch?format=json&"+tt.query, nil))
+		var out struct {
+			Data struct {
+				Values json.RawMessage `json:"values"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatalf("%s: decoding %s: %v", tt.query, rec.Body, err)
+		}
+		if string(out.Data.Values) != tt.want {
+			t.Errorf("%s: values %s, want %s", tt.query, out.Data.Values, tt.want)
+		}
+		if (dr.queries == 1) != tt.queried || dr.maps+dr.queries != 1 {
+			t.Errorf("%s: %d RetrieveContext and %d RetrieveQuery calls", tt.query, dr.maps, dr.queries)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	newTestServer(&shapeResource{}).routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fetch?fetch=a&records=maybe", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("records=maybe gave status %d, want 400", rec.Code)
+	}
+
+	//streamed and batch requests always get records
+	dr := &shapeResource{}
+	if _, lines := getStream(t, dr, "a"); len(lines) != 3 || lines[1].Key != "a" || dr.queries != 1 {
+		t.Errorf("streamed lines %+v with %d RetrieveQuery calls, want the record", lines, dr.queries)
+	}
+	dr = &shapeResource{}
+	out := decodeBatch(t, postBatch(newTestServer(dr), "", `["a", {"fetch": "b", "records": false}]`))
+	if dr.queries != 2 || dr.maps != 0 {
+		t.Errorf("batch made %d RetrieveContext and %d RetrieveQuery calls, want records for both", dr.maps, dr.queries)
+	}
+	if _, ok := out.Results[1].Data.Values.([]interface{}); !ok {
+		t.Errorf("batch item values %v, want a list of records", out.Results[1].Data.Values)
+	}
+}
@@ -4,44 +4,77 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"os"
-	"path"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/storage"
 )
 
 //GCPDownload downloads assets from Google Cloud Storage with the given
-//  Object name and within the given Bucket
+//  Object name and within the given Bucket. The download is abandoned after 50 seconds.
+//
+//Use GCPDownloadContext to control cancellation from the caller
 func GCPDownload(bucket, object string) error {
-	ctx := context.Background()
-	//gcp client
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*50)
+	defer cancel()
+	return GCPDownloadContext(ctx, bucket, object)
+}
+
+//GCPDownloadContext downloads assets from Google Cloud Storage with the given
+//  Object name and within the given Bucket. The download stops when ctx is done
+func GCPDownloadContext(ctx context.Context, bucket, object string) error {
+	_, err := downloadTo(ctx, &gcsSource{bucket: bucket, object: object}, filepath.Join(LocalDownloadDir, DatasetArchiveName))
+	return err
+}
+
+//gcsSource reads dataset archives from Google Cloud Storage. Requires GCP Authentication
+type gcsSource struct {
+	bucket string
+	object string
+}
+
+func (gs *gcsSource) URI() string {
+	return fmt.Sprintf("gs://%s/%s", gs.bucket, gs.object)
+}
+
+//Revision is the object generation, which changes whenever the object is overwritten
+func (gs *gcsSource) Revision(ctx context.Context) (string, error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		return fmt.Errorf("storage.NewClient: %v", err)
+		return "", fmt.Errorf("storage.NewClient: %v", err)
 	}
 	defer client.Close()
-	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
-	defer cancel()
-	//Local download target file
-	if err := os.MkdirAll(LocalDownloadDir, 0755); err != nil {
-		return err
+	attrs, err := client.Bucket(gs.bucket).Object(gs.object).Attrs(ctx)
+	if err != nil {
+		return "", &DownloadError{URI: gs.URI(), Err: fmt.Errorf("Object(%q).Attrs: %w", gs.object, err)}
 	}
-	file, err := os.Create(path.Join(LocalDownloadDir, "datasetupdate.zip"))
-	defer file.Close()
+	return strconv.FormatInt(attrs.Generation, 10), nil
+}
+
+func (gs *gcsSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	//gcp client
+	client, err := storage.NewClient(ctx)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("storage.NewClient: %v", err)
 	}
 	//Cloud object target
-	rc, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	rc, err := client.Bucket(gs.bucket).Object(gs.object).NewReader(ctx)
 	if err != nil {
-		return fmt.Errorf("Object(%q).NewReader: %v", object, err)
-	}
-	defer rc.Close()
-	//Download
-	if _, err := io.Copy(file, rc); err != nil {
-		return fmt.Errorf("Error downloading file from Cloud Storage: %v", err)
+		client.Close()
+		return nil, &DownloadError{URI: gs.URI(), Err: fmt.Errorf("Object(%q).NewReader: %w", gs.object, err)}
 	}
+	return &gcsReader{Reader: rc, client: client}, nil
+}
+
+//gcsReader closes the storage client along with the object reader
+type gcsReader struct {
+	*storage.Reader
+	client *storage.Client
+}
 
-	return nil
+func (gr *gcsReader) Close() error {
+	err := gr.Reader.Close()
+	gr.client.Close()
+	return err
 }
@@ -0,0 +1,147 @@
+package sdsshared
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+//NDJSONContentType is the media type of streamed /fetch responses. Ask for one with an
+// Accept header of this type, format=ndjson or stream=true
+const NDJSONContentType = "application/x-ndjson"
+
+//Streamed response line types. A streamed response is a "meta" line, a "record" line for
+// each record and an "end" line
+const (
+	StreamLineMeta   = "meta"
+	StreamLineRecord = "record"
+	StreamLineEnd    = "end"
+)
+
+//streamFlushEvery is how many records are written between flushes to the client
+const streamFlushEvery = 100
+
+//RecordStream receives the results of a streamed query
+type RecordStream interface {
+	//Header is called once, before any records, with the response metadata
+	Header(meta Meta) error
+	//Record is called with each record in turn. An error, such as the client going away,
+	// should stop the query
+	Record(rec Record) error
+}
+
+//StreamRetriever is implemented by data resources that can yield records one at a time,
+// so a streamed response does not hold every result in memory. The server uses it in
+// place of RetrieveQuery for streamed /fetch requests
+type StreamRetriever interface {
+	//StreamQuery passes the results of q to stream and returns the cursor continuing
+	// after them, if the limit cut them short
+	StreamQuery(ctx context.Context, q Query, stream RecordStream) (nextCursor string, err error)
+}
+
+//streamMeta is the first line of a streamed response
+type streamMeta struct {
+	Type           string            `json:"type"`
+	RequestOptions map[string]string `json:"request_options,omitempty"`
+	Meta           Meta              `json:"meta"`
+}
+
+//streamRecord is a record line of a streamed response
+type streamRecord struct {
+	Type string `json:"type"`
+	Record
+}
+
+//streamEnd is the last line of a streamed response
+type streamEnd struct {
+	Type        string            `json:"type"`
+	ResultCount int               `json:"result_count"`
+	NextCursor  string            `json:"next_cursor,omitempty"`
+	Errors      map[string]string `json:"errors,omitempty"`
+}
+
+//ndjsonStream writes a streamed response as newline delimited JSON
+type ndjsonStream struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	options map[string]string
+	started bool
+	count   int
+}
+
+func newNDJSONStream(w http.ResponseWriter, options map[string]string) *ndjsonStream {
+	return &ndjsonStream{w: w, enc: json.NewEncoder(w), options: options}
+}
+
+//Header writes the response headers and the meta line
+func (ns *ndjsonStream) Header(meta Meta) error {
+	if ns.started {
+		return nil
+	}
+	ns.started = true
+	ns.w.Header().Set("Content-Type", NDJSONContentType)
+	ns.w.WriteHeader(http.StatusOK)
+	return ns.enc.Encode(streamMeta{Type: StreamLineMeta, RequestOptions: ns.options, Meta: meta})
+}
+
+//Record writes a record line, flushing every streamFlushEvery records
+func (ns *ndjsonStream) Record(rec Record) error {
+	if !ns.started {
+		if err := ns.Header(Meta{Resource: ResourceServiceName}); err != nil {
+			return err
+		}
+	}
+	if err := ns.enc.Encode(streamRecord{Type: StreamLineRecord, Record: rec}); err != nil {
+		return err
+	}
+	ns.count++
+	if ns.count%streamFlushEvery == 0 {
+		ns.flush()
+	}
+	return nil
+}
+
+//end finishes the response. An error before anything was written is sent as a normal
+// error response with its status code; after that it goes in the end line
+func (ns *ndjsonStream) end(nextCursor string, err error) {
+	if err != nil && !ns.started {
+		writeResourceError(ns.w, "Dataset fetch error", err)
+		return
+	}
+	if !ns.started {
+		ns.Header(Meta{Resource: ResourceServiceName})
+	}
+	trailer := streamEnd{Type: StreamLineEnd, ResultCount: ns.count, NextCursor: nextCursor}
+	if err != nil {
+		trailer.Errors = map[string]string{"title": "Dataset fetch error", "code": strconv.Itoa(StatusCode(err)), "message": err.Error()}
+	}
+	ns.enc.Encode(trailer)
+	ns.flush()
+}
+
+func (ns *ndjsonStream) flush() {
+	if f, ok := ns.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+//streamData passes data retrieved in one piece to stream. []Record values are passed one
+// record at a time; other values are passed whole as the value of a single record
+func streamData(stream RecordStream, data SimpleData) error {
+	if err := stream.Header(data.Meta); err != nil {
+		return err
+	}
+	if records, ok := data.Data.Values.([]Record); ok {
+		for _, rec := range records {
+			if err := stream.Record(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if data.Data.Values == nil {
+		return nil
+	}
+	return stream.Record(Record{Value: data.Data.Values})
+}
@@ -0,0 +1,188 @@
+package sdsshared
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//streamResource streams records records and then fails with err, if set. With failFirst
+// it fails before writing anything
+type streamResource struct {
+	blockingResource
+	records   int
+	err       error
+	failFirst bool
+}
+
+func (sr *streamResource) StreamQuery(ctx context.Context, q Query, stream RecordStream) (string, error) {
+	if sr.failFirst {
+		return "", sr.err
+	}
+	if err := stream.Header(Meta{Resource: "streamed"}); err != nil {
+		return "", err
+	}
+	for i := 0; i < sr.records; i++ {
+		if err := stream.Record(Record{Key: q.Term, Timestamp: int64(i), Value: i}); err != nil {
+			return "", err
+		}
+	}
+	if sr.err != nil {
+		return "", sr.err
+	}
+	return "next", nil
+}
+
+//valuesResource answers every query with data in one piece, or fails with err
+type valuesResource struct {
+	blockingResource
+	data SimpleData
+	err  error
+}
+
+func (vr *valuesResource) RetrieveContext(ctx context.Context, term string, options map[string]string) (SimpleData, error) {
+	return vr.data, vr.err
+}
+
+//streamLine is any line of a streamed response
+type streamLine struct {
+	Type        string            `json:"type"`
+	Meta        Meta              `json:"meta"`
+	Key         string            `json:"key"`
+	Timestamp   int64             `json:"timestamp"`
+	Value       interface{}       `json:"value"`
+	ResultCount int               `json:"result_count"`
+	NextCursor  string            `json:"next_cursor"`
+	Errors      map[string]string `json:"errors"`
+}
+
+//getStream requests a streamed /fetch of term from dr and decodes the response line by
+// line. A response that is not a stream gives its status code and no lines
+func getStream(t *testing.T, dr ContextDataResource, term string) (int, []streamLine) {
+	t.Helper()
+	srv := httptest.NewServer(newTestServer(dr).routes())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/fetch?stream=true&fetch=" + term)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != NDJSONContentType {
+		t.Errorf("Content-Type %q, want %s", ct, NDJSONContentType)
+	}
+	var lines []streamLine
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		var line streamLine
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("line %d %q is not JSON: %v", len(lines), sc.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, lines
+}
+
+//checkShape checks lines are a meta line, records records lines and an end line and
+// returns the end line
+func checkShape(t *testing.T, lines []streamLine, records int) streamLine {
+	t.Helper()
+	if len(lines) != records+2 {
+		t.Fatalf("%d lines, want %d: %+v", len(lines), records+2, lines)
+	}
+	if lines[0].Type != StreamLineMeta {
+		t.Errorf("first line is %q, want meta", lines[0].Type)
+	}
+	for _, line := range lines[1 : records+1] {
+		if line.Type != StreamLineRecord {
+			t.Errorf("line %+v, want a record", line)
+		}
+	}
+	end := lines[len(lines)-1]
+	if end.Type != StreamLineEnd {
+		t.Errorf("last line is %q, want end", end.Type)
+	}
+	return end
+}
+
+func TestStreamFetch(t *testing.T) {
+	code, lines := getStream(t, &streamResource{records: 250}, "SE1")
+	if code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+	end := checkShape(t, lines, 250)
+	if lines[0].Meta.Resource != "streamed" {
+		t.Errorf("meta line %+v does not hold the streamed meta", lines[0])
+	}
+	for i, line := range lines[1:251] {
+		if line.Key != "SE1" || line.Timestamp != int64(i) {
+			t.Errorf("record %d is %+v", i, line)
+		}
+	}
+	if end.ResultCount != 250 || end.NextCursor != "next" || end.Errors != nil {
+		t.Errorf("end line %+v, want 250 results continuing at next", end)
+	}
+}
+
+func TestStreamFetchErrors(t *testing.T) {
+	code, _ := getStream(t, &streamResource{failFirst: true, err: NewError(ErrNotFound, "no dataset")}, "SE1")
+	if code != http.StatusNotFound {
+		t.Errorf("error before the first line gave status %d, want 404", code)
+	}
+	code, _ = getStream(t, &valuesResource{err: NewError(ErrUpdating, "busy")}, "SE1")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("error of a resource without streaming gave status %d, want 503", code)
+	}
+
+	code, lines := getStream(t, &streamResource{records: 3, err: errors.New("disk gone")}, "SE1")
+	if code != http.StatusOK {
+		t.Fatalf("error after records gave status %d, want 200", code)
+	}
+	end := checkShape(t, lines, 3)
+	if end.ResultCount != 3 || end.NextCursor != "" {
+		t.Errorf("end line %+v, want 3 results and no cursor", end)
+	}
+	if end.Errors["code"] != "500" || end.Errors["message"] != "disk gone" {
+		t.Errorf("end line errors %v, want the 500 error", end.Errors)
+	}
+}
+
+func TestStreamDataFallback(t *testing.T) {
+	records := []Record{{Key: "a", Timestamp: 1, Value: "x"}, {Key: "b", Timestamp: 2, Value: "y"}}
+	dr := &valuesResource{data: SimpleData{ResultCount: 2, Meta: Meta{Resource: "whole"}, Data: DataOutput{Values: records}, NextCursor: "more"}}
+	_, lines := getStream(t, dr, "a")
+	end := checkShape(t, lines, 2)
+	if lines[0].Meta.Resource != "whole" {
+		t.Errorf("meta line %+v does not hold the retrieved meta", lines[0])
+	}
+	if lines[1].Key != "a" || lines[2].Key != "b" || lines[2].Value != "y" {
+		t.Errorf("records %+v %+v, want a then b", lines[1], lines[2])
+	}
+	if end.ResultCount != 2 || end.NextCursor != "more" {
+		t.Errorf("end line %+v, want 2 results continuing at more", end)
+	}
+
+	dr = &valuesResource{data: SimpleData{ResultCount: 1, Data: DataOutput{Values: map[string]interface{}{"1638997653": "SE129TA"}}}}
+	_, lines = getStream(t, dr, "SE12")
+	end = checkShape(t, lines, 1)
+	if v, ok := lines[1].Value.(map[string]interface{}); !ok || v["1638997653"] != "SE129TA" {
+		t.Errorf("plain value streamed as %+v, want the whole value in one record", lines[1])
+	}
+	if end.ResultCount != 1 {
+		t.Errorf("end line %+v, want 1 result", end)
+	}
+
+	_, lines = getStream(t, &valuesResource{}, "none")
+	if end := checkShape(t, lines, 0); end.ResultCount != 0 {
+		t.Errorf("end line %+v for no values, want 0 results", end)
+	}
+}
@@ -0,0 +1,117 @@
+package sdsshared
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//certReloadInterval is the least time between checks of the certificate files for changes
+const certReloadInterval = 10 * time.Second
+
+//certReloader serves a TLS certificate loaded from disk and reloads it when the certificate
+// or key file changes, so rotated certificates are picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+//newCertReloader loads the certificate pair and returns a reloader serving it
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+//reload reads the certificate pair from disk. Must be called with cr.mu held or before
+// the reloader is shared
+func (cr *certReloader) reload() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return fmt.Errorf("Error reading TLS certificate file: %v", err)
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error reading TLS key file: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading TLS certificate pair: %v", err)
+	}
+	cr.cert = &cert
+	cr.certModTime = certInfo.ModTime()
+	cr.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+//GetCertificate implements tls.Config.GetCertificate. If the files on disk have changed
+// since they were last loaded the pair is reloaded. A failed reload keeps the previous
+// certificate in use so a half written rotation does not take the server down
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.lastCheck) < certReloadInterval {
+		return cr.cert, nil
+	}
+	cr.lastCheck = time.Now()
+
+	certInfo, certErr := os.Stat(cr.certFile)
+	keyInfo, keyErr := os.Stat(cr.keyFile)
+	if certErr != nil || keyErr != nil {
+		return cr.cert, nil
+	}
+	if certInfo.ModTime().Equal(cr.certModTime) && keyInfo.ModTime().Equal(cr.keyModTime) {
+		return cr.cert, nil
+	}
+	if err := cr.reload(); err != nil {
+		log.Printf("Error reloading rotated TLS certificate, keeping current certificate: %v", err)
+		return cr.cert, nil
+	}
+	log.Printf("Reloaded TLS certificate from %s", cr.certFile)
+	return cr.cert, nil
+}
+
+//redirectHandler redirects every request to the same path and query on the HTTPS
+// endpoint listening on httpsPort
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		redirect(w, req, httpsPort)
+	})
+}
+
+//Redirect included to ensure http requests are forwarded to the Https endpoint - ref https://gist.github.com/d-schmidt/587ceec34ce1334a5e60
+func redirect(w http.ResponseWriter, req *http.Request, httpsPort string) {
+	// remove/add not default ports from req.Host
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if httpsPort != "" && httpsPort != "443" {
+		host = net.JoinHostPort(host, httpsPort)
+	}
+	target := "https://" + host + req.URL.Path
+	if len(req.URL.RawQuery) > 0 {
+		target += "?" + req.URL.RawQuery
+	}
+	log.Printf("redirect to: %s", target)
+	//301 for reads. 308 for everything else as it also forwards the method and body
+	code := http.StatusPermanentRedirect
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		code = http.StatusMovedPermanently
+	}
+	http.Redirect(w, req, target, code)
+}
@@ -0,0 +1,159 @@
+package sdsshared
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//writeTestCert writes a self signed certificate for name and its key to certFile and
+// keyFile, stamped with modTime
+func writeTestCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//servedName returns the common name of the certificate the reloader serves, skipping
+// the interval between checks of the files
+func servedName(t *testing.T, cr *certReloader) string {
+	t.Helper()
+	cr.mu.Lock()
+	cr.lastCheck = time.Time{}
+	cr.mu.Unlock()
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeTestCert(t, certFile, keyFile, "first", start)
+
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	if name := servedName(t, cr); name != "first" {
+		t.Fatalf("serving %q, want first", name)
+	}
+
+	//a check inside the reload interval does not look at the files
+	first, _ := cr.GetCertificate(nil)
+	writeTestCert(t, certFile, keyFile, "second", start.Add(time.Minute))
+	if cert, _ := cr.GetCertificate(nil); cert != first {
+		t.Error("GetCertificate reloaded the pair inside the reload interval")
+	}
+	if name := servedName(t, cr); name != "second" {
+		t.Errorf("serving %q after rotation, want second", name)
+	}
+
+	//a broken pair keeps the last good certificate
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	broken := start.Add(2 * time.Minute)
+	if err := os.Chtimes(keyFile, broken, broken); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, cr); name != "second" {
+		t.Errorf("serving %q after a broken rotation, want second", name)
+	}
+
+	//a missing file keeps the last good certificate
+	if err := os.Remove(certFile); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, cr); name != "second" {
+		t.Errorf("serving %q with the certificate file missing, want second", name)
+	}
+
+	writeTestCert(t, certFile, keyFile, "third", start.Add(3*time.Minute))
+	if name := servedName(t, cr); name != "third" {
+		t.Errorf("serving %q after the pair was fixed, want third", name)
+	}
+}
+
+func TestNewCertReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("newCertReloader accepted missing files")
+	}
+	writeTestCert(t, certFile, keyFile, "first", time.Now())
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("newCertReloader accepted a broken pair")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		method, target, port string
+		wantCode             int
+		wantLocation         string
+	}{
+		{http.MethodGet, "http://example.com/fetch?key=a&cursor=b", "443", http.StatusMovedPermanently, "https://example.com/fetch?key=a&cursor=b"},
+		{http.MethodHead, "http://example.com:8080/health", "", http.StatusMovedPermanently, "https://example.com/health"},
+		{http.MethodGet, "http://example.com:8080/fetch", "8443", http.StatusMovedPermanently, "https://example.com:8443/fetch"},
+		{http.MethodPost, "http://example.com/update?force=true", "8443", http.StatusPermanentRedirect, "https://example.com:8443/update?force=true"},
+		{http.MethodPost, "http://[::1]:8080/fetch/batch", "8443", http.StatusPermanentRedirect, "https://[::1]:8443/fetch/batch"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		redirectHandler(tt.port).ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, rec.Code, tt.wantCode)
+		}
+		if loc := rec.Header().Get("Location"); loc != tt.wantLocation {
+			t.Errorf("%s %s: Location %q, want %q", tt.method, tt.target, loc, tt.wantLocation)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package sdsshared
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//Updater runs dataset updates for a DataResource, both on demand and in the background
+// on a Schedule. It makes sure only one update runs at a time and records each update as
+// an UpdateJob whose progress can be inspected while it runs
+type Updater struct {
+	//Resource is the data resource to update
+	Resource ContextDataResource
+	//Schedule decides when background updates run. Background updates are off if nil
+	Schedule Schedule
+	//MinBackoff and MaxBackoff bound the jittered, exponentially growing delay before a
+	// background update is retried after a failure
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mu     sync.Mutex
+	status UpdaterStatus
+	//current is the running job, jobs the most recent jobs oldest first
+	current *updateJob
+	jobs    []*updateJob
+	//queued is a forced job submitted while an unforced one was running, started when
+	// current finishes
+	queued *updateJob
+	//jobsCtx is the context detached jobs run under, cancelled by Stop
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+//maxJobHistory is the number of finished jobs an Updater remembers
+const maxJobHistory = 32
+
+//UpdaterStatus is the state of an Updater
+type UpdaterStatus struct {
+	//Running is true while an update is in progress
+	Running bool `json:"running"`
+	//Scheduled is true if background updates are on
+	Scheduled bool `json:"scheduled"`
+	//NextRun is when the next background update is due
+	NextRun time.Time `json:"next_run"`
+	//LastAttempt is when the last update, successful or not, started
+	LastAttempt time.Time `json:"last_attempt"`
+	//LastSuccess is when the last successful update, including one finding the dataset
+	// already up to date, finished
+	LastSuccess time.Time `json:"last_success"`
+	//LastError is the error of the last failed update. It is cleared by a success
+	LastError string `json:"last_error,omitempty"`
+	//LastErrorAt is when the last failed update finished
+	LastErrorAt time.Time `json:"last_error_at"`
+	//ConsecutiveFailures counts failed updates since the last success
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	//Dataset is the dataset version returned by the last successful update
+	Dataset *VersionManager `json:"dataset,omitempty"`
+	//Job is the ID of the running job, or of the last job if none is running
+	Job string `json:"job,omitempty"`
+}
+
+//NewUpdater creates an Updater for dr. Pass a nil schedule for on demand updates only
+func NewUpdater(dr ContextDataResource, schedule Schedule) *Updater {
+	return &Updater{
+		Resource:   dr,
+		Schedule:   schedule,
+		MinBackoff: 30 * time.Second,
+		MaxBackoff: 30 * time.Minute,
+	}
+}
+
+//Update runs UpdateDatasetContext on the resource now and waits for it to finish. If an
+// update is already running it returns an error matching ErrUpdating instead of starting
+// another
+func (u *Updater) Update(ctx context.Context) (VersionManager, error) {
+	return u.update(ctx, TriggerManual)
+}
+
+func (u *Updater) update(ctx context.Context, trigger string) (VersionManager, error) {
+	job, started := u.begin(trigger, ForceUpdate(ctx), false)
+	if !started {
+		return VersionManager{}, NewError(ErrUpdating, "a dataset update is already running")
+	}
+	return u.run(ctx, job)
+}
+
+//Submit starts an update in the background and returns its job straight away. If an
+// update is already running no new one is started and the running job is returned, so
+// duplicate requests are coalesced into one update. Pass force to skip the version check.
+//
+//A forced submission while an unforced job runs cannot be answered by that job, which
+// may find the dataset up to date, so one forced job is queued to start when it ends and
+// returned instead. Further forced submissions get the queued job
+func (u *Updater) Submit(force bool) UpdateJob {
+	return u.submit(TriggerRequest, force)
+}
+
+func (u *Updater) submit(trigger string, force bool) UpdateJob {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch {
+	case u.current == nil:
+		job := newUpdateJob(trigger, force, true)
+		u.start(job)
+		return job.snapshot()
+	case !force || u.current.job.Forced:
+		return u.current.snapshot()
+	case u.queued == nil:
+		u.queued = newQueuedJob(trigger)
+		u.remember(u.queued)
+	}
+	return u.queued.snapshot()
+}
+
+//start claims the update slot for the detached job and runs it in the background. The
+// caller must hold u.mu
+func (u *Updater) start(job *updateJob) {
+	u.claim(job)
+	ctx := u.jobContext()
+	if job.job.Forced {
+		ctx = WithForceUpdate(ctx)
+	}
+	go u.run(ctx, job)
+}
+
+//Job returns the job with the given ID, if it is running or among the most recent jobs
+func (u *Updater) Job(id string) (UpdateJob, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, job := range u.jobs {
+		if job.job.ID == id {
+			return job.snapshot(), true
+		}
+	}
+	return UpdateJob{}, false
+}
+
+//Jobs returns the running job and the most recent finished jobs, newest first
+func (u *Updater) Jobs() []UpdateJob {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	out := make([]UpdateJob, 0, len(u.jobs))
+	for i := len(u.jobs) - 1; i >= 0; i-- {
+		out = append(out, u.jobs[i].snapshot())
+	}
+	return out
+}
+
+//begin claims the single update slot for a new job. If an update is already running it
+// returns the running job and false
+func (u *Updater) begin(trigger string, force, detached bool) (*updateJob, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.current != nil {
+		return u.current, false
+	}
+	job := newUpdateJob(trigger, force, detached)
+	u.claim(job)
+	return job, true
+}
+
+//claim makes job the running job, adding it to the history if it is not there already.
+// The caller must hold u.mu
+func (u *Updater) claim(job *updateJob) {
+	if job.job.Status == UpdateStatusQueued {
+		job.begin()
+	} else {
+		u.remember(job)
+	}
+	u.current = job
+	u.status.Running = true
+	u.status.LastAttempt = job.job.StartedAt
+	u.status.Job = job.job.ID
+}
+
+//remember adds job to the history, dropping the oldest beyond maxJobHistory. The caller
+// must hold u.mu
+func (u *Updater) remember(job *updateJob) {
+	u.jobs = append(u.jobs, job)
+	if len(u.jobs) > maxJobHistory {
+		u.jobs = u.jobs[len(u.jobs)-maxJobHistory:]
+	}
+}
+
+//run runs job on the resource and records the outcome
+func (u *Updater) run(ctx context.Context, job *updateJob) (VersionManager, error) {
+	vm, err := u.Resource.UpdateDatasetContext(WithProgress(ctx, job))
+	if err != nil && !errors.Is(err, ErrUpToDate) {
+		log.Printf("Dataset update job %s failed: %v", job.job.ID, err)
+	}
+	u.finish(job, vm, err)
+	return vm, err
+}
+
+//finish releases the update slot and records the outcome, then starts any queued job
+func (u *Updater) finish(job *updateJob, vm VersionManager, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	job.finish(vm, err)
+	u.current = nil
+	u.status.Running = false
+	if err != nil && !errors.Is(err, ErrUpToDate) {
+		u.status.LastError = err.Error()
+		u.status.LastErrorAt = time.Now()
+		u.status.ConsecutiveFailures++
+	} else {
+		u.status.LastSuccess = time.Now()
+		u.status.LastError = ""
+		u.status.ConsecutiveFailures = 0
+		u.status.Dataset = &vm
+	}
+	if queued := u.queued; queued != nil {
+		u.queued = nil
+		u.start(queued)
+	}
+}
+
+//jobContext returns the context detached jobs and background updates run under. The
+// caller must hold u.mu
+func (u *Updater) jobContext() context.Context {
+	if u.jobsCtx == nil {
+		u.jobsCtx, u.cancelJobs = context.WithCancel(context.Background())
+	}
+	return u.jobsCtx
+}
+
+//Status returns the current state of the updater
+func (u *Updater) Status() UpdaterStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status := u.status
+	status.Scheduled = u.stop != nil
+	return status
+}
+
+//CheckNow starts a background check for a newer dataset, as a job with trigger
+// TriggerStartup, unless an update is already running
+func (u *Updater) CheckNow() UpdateJob {
+	return u.submit(TriggerStartup, false)
+}
+
+//Start begins background updates on the Schedule. It does nothing if there is no
+// Schedule or background updates are already running
+func (u *Updater) Start() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.Schedule == nil || u.stop != nil {
+		return
+	}
+	u.stop = make(chan struct{})
+	u.done = make(chan struct{})
+	go u.loop(u.jobContext(), u.stop, u.done)
+}
+
+//Stop ends background updates and cancels any update started by Submit or the schedule,
+// then waits for them to exit. Updates started with Update run under their caller's
+// context and are left alone
+func (u *Updater) Stop() {
+	u.mu.Lock()
+	stop, done := u.stop, u.done
+	u.stop, u.done = nil, nil
+	cancel := u.cancelJobs
+	u.jobsCtx, u.cancelJobs = nil, nil
+	current := u.current
+	queued := u.queued
+	u.queued = nil
+	if queued != nil {
+		queued.finish(VersionManager{}, context.Canceled)
+	}
+	u.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	if current != nil && current.detached {
+		<-current.done
+	}
+}
+
+//loop runs scheduled updates under ctx until stop is closed
+func (u *Updater) loop(ctx context.Context, stop, done chan struct{}) {
+	defer close(done)
+
+	next := u.Schedule.Next(time.Now())
+	for !next.IsZero() {
+		u.setNextRun(next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		_, err := u.update(ctx, TriggerSchedule)
+		next = u.Schedule.Next(time.Now())
+		switch {
+		case err == nil, errors.Is(err, ErrUpToDate):
+		case errors.Is(err, ErrUpdating):
+			//an on demand update is already doing the work
+		case ctx.Err() != nil:
+			return
+		default:
+			retry := time.Now().Add(u.backoff())
+			log.Printf("Background dataset update failed, retrying at %s: %v", retry.Format(time.RFC3339), err)
+			if next.IsZero() || retry.Before(next) {
+				next = retry
+			}
+		}
+	}
+	u.setNextRun(time.Time{})
+}
+
+func (u *Updater) setNextRun(t time.Time) {
+	u.mu.Lock()
+	u.status.NextRun = t
+	u.mu.Unlock()
+}
+
+//backoff returns the delay before retrying after the recorded consecutive failures. It
+// doubles with each failure up to MaxBackoff and is jittered by up to half either way so
+// that many instances do not retry in step
+func (u *Updater) backoff() time.Duration {
+	u.mu.Lock()
+	failures := u.status.ConsecutiveFailures
+	u.mu.Unlock()
+
+	d := u.MinBackoff
+	for i := 1; i < failures && d < u.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > u.MaxBackoff {
+		d = u.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
@@ -0,0 +1,146 @@
+package sdsshared
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+//updateResource is a ContextDataResource whose updates wait to be released. Forced
+// updates load version 2; others find the dataset up to date
+type updateResource struct {
+	blockingResource
+	//started receives whether each update is forced as it starts
+	started chan bool
+	finish  chan struct{}
+}
+
+func newUpdateResource() *updateResource {
+	return &updateResource{started: make(chan bool, 8), finish: make(chan struct{})}
+}
+
+func (ur *updateResource) UpdateDatasetContext(ctx context.Context) (VersionManager, error) {
+	ur.started <- ForceUpdate(ctx)
+	select {
+	case <-ur.finish:
+	case <-ctx.Done():
+		return VersionManager{}, ctx.Err()
+	}
+	if ForceUpdate(ctx) {
+		return VersionManager{CurrentVersion: "2"}, nil
+	}
+	return VersionManager{CurrentVersion: "1"}, ErrUpToDate
+}
+
+//waitJob waits for the job id to leave status
+func waitJob(t *testing.T, u *Updater, id, status string) UpdateJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, ok := u.Job(id); ok && job.Status != status {
+			return job
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("job %s still %s", id, status)
+	return UpdateJob{}
+}
+
+func TestSubmitCoalesces(t *testing.T) {
+	ur := newUpdateResource()
+	u := NewUpdater(ur, nil)
+	defer u.Stop()
+
+	first := u.Submit(false)
+	if forced := <-ur.started; forced {
+		t.Fatal("unforced submission ran forced")
+	}
+	if again := u.Submit(false); again.ID != first.ID {
+		t.Errorf("duplicate submission started job %s, want %s", again.ID, first.ID)
+	}
+	if _, err := u.Update(context.Background()); !errors.Is(err, ErrUpdating) {
+		t.Errorf("Update during a job gave %v, want ErrUpdating", err)
+	}
+
+	//a forced submission is queued behind the unforced job rather than coalesced into it
+	forced := u.Submit(true)
+	if forced.ID == first.ID || forced.Status != UpdateStatusQueued || !forced.Forced {
+		t.Fatalf("forced submission during an unforced job gave %+v, want a queued forced job", forced)
+	}
+	if again := u.Submit(true); again.ID != forced.ID {
+		t.Errorf("second forced submission gave job %s, want queued %s", again.ID, forced.ID)
+	}
+	if again := u.Submit(false); again.ID != first.ID {
+		t.Errorf("unforced submission gave job %s, want running %s", again.ID, first.ID)
+	}
+
+	ur.finish <- struct{}{}
+	if job := waitJob(t, u, first.ID, UpdateStatusRunning); job.Status != UpdateStatusUpToDate {
+		t.Errorf("first job ended %q, want %q", job.Status, UpdateStatusUpToDate)
+	}
+	if forced := <-ur.started; !forced {
+		t.Fatal("queued job ran unforced")
+	}
+	if again := u.Submit(true); again.ID != forced.ID || again.Status != UpdateStatusRunning {
+		t.Errorf("forced submission during the forced job gave %+v, want running %s", again, forced.ID)
+	}
+	ur.finish <- struct{}{}
+	job := waitJob(t, u, forced.ID, UpdateStatusRunning)
+	if job.Status != UpdateStatusUpdated || job.Dataset == nil || job.Dataset.CurrentVersion != "2" {
+		t.Errorf("queued job ended %+v, want updated to version 2", job)
+	}
+	if jobs := u.Jobs(); len(jobs) != 2 || jobs[0].ID != forced.ID || jobs[1].ID != first.ID {
+		t.Errorf("Jobs() = %+v, want the forced then the first job", jobs)
+	}
+}
+
+func TestStopCancelsQueuedJob(t *testing.T) {
+	ur := newUpdateResource()
+	u := NewUpdater(ur, nil)
+	first := u.Submit(false)
+	<-ur.started
+	queued := u.Submit(true)
+	u.Stop()
+	if job, _ := u.Job(first.ID); job.Status != UpdateStatusFailed {
+		t.Errorf("running job after Stop is %q, want %q", job.Status, UpdateStatusFailed)
+	}
+	if job, _ := u.Job(queued.ID); job.Status != UpdateStatusFailed || !job.StartedAt.IsZero() {
+		t.Errorf("queued job after Stop is %+v, want failed without starting", job)
+	}
+	select {
+	case <-ur.started:
+		t.Error("queued job started after Stop")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	u := &Updater{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	tests := []struct {
+		failures int
+		//base is the delay before jitter of up to half either way
+		base time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		u.status.ConsecutiveFailures = tt.failures
+		lo, hi := tt.base/2, tt.base/2+tt.base
+		for i := 0; i < 200; i++ {
+			if d := u.backoff(); d < lo || d >= hi {
+				t.Errorf("%d failures: backoff %s outside [%s, %s)", tt.failures, d, lo, hi)
+				break
+			}
+		}
+	}
+	if d := (&Updater{}).backoff(); d != 0 {
+		t.Errorf("zero backoff settings gave %s", d)
+	}
+}
@@ -1,9 +1,12 @@
 package sdsshared
 
 import (
+	"crypto/ed25519"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
 var (
@@ -21,13 +24,66 @@ var (
 	// some connector implementations. For local dbs this may be pre/suf-fixed
 	// to allow for dataset updates with minimised downtime
 	DBURI string
-	//DBURI is the path (URL or local path) to the archive file for
-	//the dataset used to rebuild the database
+	//KeepGenerations is how many dataset generations, including the one in use, connectors
+	// that support rollback keep on disk
+	KeepGenerations = 3
+	//DatasetURI is the path (URL or local path) to the archive file for
+	//the dataset used to rebuild the database. The scheme picks how it is fetched,
+	// see NewDatasetSource
 	DatasetURI string
 	//PublicPort is the port from which this API can be accessed for data retrieval
 	PublicPort string
 	//LocalDownloadDir is the local relative or absolute path to a downloads folder to use
 	LocalDownloadDir string
+	//MaxPageSize is the most records a single /fetch returns. Larger limits are reduced
+	// to it and further results are reached with next_cursor. 0 for no maximum
+	MaxPageSize = 1000
+	//MaxBatchSize is the most queries a single /fetch/batch request can hold. 0 for no
+	// maximum
+	MaxBatchSize = 1000
+	//Compression compresses responses with gzip or zstd for clients that accept them
+	Compression = true
+	//CompressMinSize is the smallest response body, in bytes, that is compressed.
+	// Streamed responses are compressed whatever their size
+	CompressMinSize = 1024
+	//FuzzyIndexDistance is the largest edit distance fuzzy matches can be asked for with,
+	// for connectors that index keys for fuzzy matching. Larger distances make much
+	// larger indexes. 0 turns fuzzy matching off
+	FuzzyIndexDistance = 1
+	//UpdateSchedule is when background dataset updates run, nil for none. Set with a
+	// duration or cron expression, see ParseSchedule
+	UpdateSchedule Schedule
+	//UpdateOnStart checks for a newer dataset in the background as soon as the server
+	// starts. Useful with connectors that reuse the dataset loaded before a restart
+	UpdateOnStart bool
+	//TLSCertFile is the path to a PEM encoded TLS certificate. When set with TLSKeyFile
+	// the server serves HTTPS only
+	TLSCertFile string
+	//TLSKeyFile is the path to the PEM encoded private key for TLSCertFile
+	TLSKeyFile string
+	//RedirectPort is the port of an optional plain HTTP listener that redirects
+	// to the HTTPS endpoint. Leave empty to disable
+	RedirectPort string
+	//JWT authentication settings. Authentication is enabled when JWTKeyFile or JWTJWKSURI is set
+
+	//JWTKeyFile is the path to a PEM public key or certificate for RS256/ES256 tokens, or
+	// a file holding the shared secret for HS256 tokens
+	JWTKeyFile string
+	//JWTJWKSURI is the URL or local path of a JSON Web Key Set used to verify tokens.
+	// Takes precedence over JWTKeyFile
+	JWTJWKSURI string
+	//JWTIssuer is the required token issuer. Not checked if empty
+	JWTIssuer string
+	//JWTAudience is the required token audience. Not checked if empty
+	JWTAudience string
+	//JWTFetchScope is the token scope required to use /fetch
+	JWTFetchScope = "data:read"
+	//JWTUpdateScope is the token scope required to use /update
+	JWTUpdateScope = "data:admin"
+
+	//ShutdownGracePeriod is how long the server waits for in-flight requests to finish
+	// when shutting down before closing them
+	ShutdownGracePeriod = 30 * time.Second
 
 	//Cloud blob storage related settings
 
@@ -36,6 +92,32 @@ var (
 	//DatasetObjectName is the cloud object name found in DatasetBucketName that
 	// identifies the dataset archive for download
 	DatasetObjectName string
+
+	//Dataset verification settings, see DownloadVerifiedDataset
+
+	//RequireDatasetManifest refuses dataset archives without a manifest holding their
+	// SHA-256 digest
+	RequireDatasetManifest bool
+	//DatasetPublicKey is the Ed25519 key dataset manifests must be signed with. When set
+	// every archive needs a signed manifest
+	DatasetPublicKey ed25519.PublicKey
+
+	//S3 compatible object storage settings, used for s3://bucket/key dataset URIs
+
+	//S3Endpoint is the URL of the S3 compatible service, for example http://localhost:9000
+	// for a local MinIO. Defaults to the AWS endpoint for S3Region
+	S3Endpoint string
+	//S3Region is the region requests are signed for
+	S3Region = "us-east-1"
+	//S3AccessKeyID and S3SecretAccessKey are the credentials requests are signed with.
+	// Requests are sent unsigned if S3AccessKeyID is empty
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	//S3SessionToken is the session token for temporary credentials
+	S3SessionToken string
+	//S3PathStyle selects path-style addressing (endpoint/bucket/key) over virtual-hosted
+	// addressing (bucket.endpoint/key). Most self hosted services such as MinIO need it
+	S3PathStyle bool
 )
 
 func init() {
@@ -47,6 +129,12 @@ func init() {
 	DebugMode = db
 	//database location setting
 	DBURI = GetEnv("database_uri", "working/databases/simpledataservice-default/")
+	//number of dataset generations to keep for rollback
+	if keep, err := strconv.Atoi(GetEnv("keepgenerations", strconv.Itoa(KeepGenerations))); err != nil || keep < 1 {
+		log.Panicf("Invalid keepgenerations setting: must be a whole number of at least 1")
+	} else {
+		KeepGenerations = keep
+	}
 	//location of the dataset archive
 	DatasetURI = GetEnv("dataset_uri", "working/datasets/data.zip")
 	//get name of this running resource -
@@ -55,6 +143,62 @@ func init() {
 	PublicPort = GetEnv("publicport", "8080")
 	//get download dir to use
 	LocalDownloadDir = GetEnv("downloaddir", "working/downloads")
+	//largest page of results
+	if max, err := strconv.Atoi(GetEnv("maxpagesize", strconv.Itoa(MaxPageSize))); err != nil || max < 0 {
+		log.Panicf("Invalid maxpagesize setting: must be a whole number")
+	} else {
+		MaxPageSize = max
+	}
+	//largest batch of queries
+	if max, err := strconv.Atoi(GetEnv("max_batch_size", strconv.Itoa(MaxBatchSize))); err != nil || max < 0 {
+		log.Panicf("Invalid max_batch_size setting: must be a whole number")
+	} else {
+		MaxBatchSize = max
+	}
+	//response compression
+	if c, err := strconv.ParseBool(GetEnv("compression", strconv.FormatBool(Compression))); err != nil {
+		log.Panicf("Invalid compression setting: must be true or false")
+	} else {
+		Compression = c
+	}
+	if min, err := strconv.Atoi(GetEnv("compress_min_size", strconv.Itoa(CompressMinSize))); err != nil || min < 0 {
+		log.Panicf("Invalid compress_min_size setting: must be a whole number")
+	} else {
+		CompressMinSize = min
+	}
+	//fuzzy match index
+	if d, err := strconv.Atoi(GetEnv("fuzzy_index_distance", strconv.Itoa(FuzzyIndexDistance))); err != nil || d < 0 || d > 3 {
+		log.Panicf("Invalid fuzzy_index_distance setting: must be a whole number from 0 to 3")
+	} else {
+		FuzzyIndexDistance = d
+	}
+	//check for a newer dataset at startup
+	UpdateOnStart, _ = strconv.ParseBool(GetEnv("update_on_start", "false"))
+	//background update schedule
+	if spec := GetEnv("update_schedule", ""); spec != "" {
+		schedule, err := ParseSchedule(spec)
+		if err != nil {
+			log.Panicf("Invalid update_schedule setting: %v", err)
+		}
+		UpdateSchedule = schedule
+	}
+	//TLS certificate pair and http redirect listener
+	TLSCertFile = GetEnv("tls_cert", "")
+	TLSKeyFile = GetEnv("tls_key", "")
+	RedirectPort = GetEnv("redirectport", "")
+	//JWT authentication
+	JWTKeyFile = GetEnv("jwt_key_file", "")
+	JWTJWKSURI = GetEnv("jwt_jwks_uri", "")
+	JWTIssuer = GetEnv("jwt_issuer", "")
+	JWTAudience = GetEnv("jwt_audience", "")
+	JWTFetchScope = GetEnv("jwt_fetch_scope", JWTFetchScope)
+	JWTUpdateScope = GetEnv("jwt_update_scope", JWTUpdateScope)
+	//get shutdown grace period to use
+	if grace, err := time.ParseDuration(GetEnv("shutdowngrace", ShutdownGracePeriod.String())); err != nil || grace < 0 {
+		log.Panicf("Invalid shutdowngrace setting: must be a duration such as 30s")
+	} else {
+		ShutdownGracePeriod = grace
+	}
 
 	//GCP Authentication
 	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
@@ -64,4 +208,32 @@ func init() {
 	}
 	DatasetBucketName = GetEnv("bucket", DatasetBucketName)
 	DatasetObjectName = GetEnv("objectname", DatasetObjectName)
+	//dataset verification
+	if rm, err := strconv.ParseBool(GetEnv("dataset_require_manifest", strconv.FormatBool(RequireDatasetManifest))); err != nil {
+		log.Panicf("Invalid dataset_require_manifest setting: must be true or false")
+	} else {
+		RequireDatasetManifest = rm
+	}
+	if pk := GetEnv("dataset_public_key", ""); pk != "" {
+		key, err := parsePublicKey(pk)
+		if err != nil {
+			log.Panicf("Invalid dataset_public_key setting: %v", err)
+		}
+		DatasetPublicKey = key
+	}
+	//S3 compatible storage, falling back to the standard AWS environment variables
+	S3Endpoint = GetEnv("s3_endpoint", "")
+	S3Region = GetEnv("s3_region", GetEnv("AWS_REGION", S3Region))
+	S3AccessKeyID = GetEnv("s3_access_key_id", os.Getenv("AWS_ACCESS_KEY_ID"))
+	S3SecretAccessKey = GetEnv("s3_secret_access_key", os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	S3SessionToken = GetEnv("s3_session_token", os.Getenv("AWS_SESSION_TOKEN"))
+	if ps, err := strconv.ParseBool(GetEnv("s3_path_style", strconv.FormatBool(S3PathStyle))); err != nil {
+		log.Panicf("Invalid s3_path_style setting: must be true or false")
+	} else {
+		S3PathStyle = ps
+	}
+	//an object name without an explicit dataset_uri means the archive is in the cloud bucket
+	if _, set := os.LookupEnv("dataset_uri"); !set && DatasetObjectName != "" {
+		DatasetURI = fmt.Sprintf("gs://%s/%s", DatasetBucketName, DatasetObjectName)
+	}
 }
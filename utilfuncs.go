@@ -3,11 +3,13 @@ package sdsshared
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,6 +26,23 @@ func CreateKVStoreKey(key string, sep string) string {
 	return fmt.Sprintf("%s%s%d", key, sep, time.Now().UnixNano())
 }
 
+//ParseKVStoreKey splits a key made by CreateKVStoreKey into the original key and its
+// Unix nanosecond timestamp. ok is false if the key has no valid timestamp
+func ParseKVStoreKey(kvKey string, sep string) (key string, timestamp int64, ok bool) {
+	if sep == "" {
+		sep = "/"
+	}
+	i := strings.LastIndex(kvKey, sep)
+	if i < 0 {
+		return kvKey, 0, false
+	}
+	timestamp, err := strconv.ParseInt(kvKey[i+len(sep):], 10, 64)
+	if err != nil {
+		return kvKey, 0, false
+	}
+	return kvKey[:i], timestamp, true
+}
+
 //isValidUrl tests a string to determine if it is a well-structured url or not.
 func isValidUrl(toTest string) bool {
 	_, err := url.ParseRequestURI(toTest)
@@ -91,5 +110,34 @@ func returnErrorJSON(errorTitle string, errorCode int, errorMsg string) (string,
 	}
 
 	binjson, err := json.MarshalIndent(nw, " ", " ")
-	return string(binjson), fmt.Errorf("Error json marshalling Error message: %v", err)
+	if err != nil {
+		return "", fmt.Errorf("Error json marshalling Error message: %v", err)
+	}
+	return string(binjson), nil
+}
+
+//writeError writes the standard simple data error payload to w with the errorCode status
+func writeError(w http.ResponseWriter, errorTitle string, errorCode int, errorMsg string) {
+	errMsgPayload, err := returnErrorJSON(errorTitle, errorCode, errorMsg)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errorCode)
+	fmt.Fprint(w, errMsgPayload)
+}
+
+//writeJSON writes v to w as indented JSON with the given status code. If v cannot be
+// marshalled a standard error payload titled errorTitle is written instead
+func writeJSON(w http.ResponseWriter, errorTitle string, code int, v interface{}) {
+	payload, err := json.MarshalIndent(v, " ", " ")
+	if err != nil {
+		log.Printf("Error marshalling %T: %v", v, err)
+		writeError(w, errorTitle, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprint(w, string(payload))
 }
@@ -0,0 +1,179 @@
+package sdsshared
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//SchemaKey is the database key datasets record their ValueSchema under, next to _version
+const SchemaKey = "_schema"
+
+//Value codecs of a ValueSchema
+const (
+	//CodecAuto decodes values holding a JSON object or array and returns any other value
+	// as a string. It is used for datasets without a schema
+	CodecAuto = "auto"
+	//CodecRaw returns values as stored, as strings
+	CodecRaw = "raw"
+	//CodecJSON decodes values as JSON
+	CodecJSON = "json"
+	//CodecMsgPack decodes values as MessagePack
+	CodecMsgPack = "msgpack"
+)
+
+//Field types a ValueSchema can declare
+const (
+	FieldString  = "string"
+	FieldNumber  = "number"
+	FieldInteger = "integer"
+	FieldBool    = "bool"
+)
+
+//ValueSchema describes how the values of a dataset are stored. Datasets record it as JSON
+// under SchemaKey, for example
+//
+//	{"codec": "json", "fields": {"lat": "number", "population": "integer"}, "indexes": ["district"],
+//	 "geo": {"lat": "lat", "lon": "lng"}, "search": {"fields": ["name"], "stem": true}}
+type ValueSchema struct {
+	//Codec is the encoding of values: CodecAuto (the default), CodecRaw, CodecJSON or
+	// CodecMsgPack
+	Codec string `json:"codec"`
+	//Fields declares the types of fields of object values as FieldString, FieldNumber,
+	// FieldInteger or FieldBool. Declared fields are converted to their type, so that
+	// numbers stored as strings are returned as numbers. Other fields are left as decoded
+	Fields map[string]string `json:"fields,omitempty"`
+	//Indexes lists the fields of object values that connectors index so that records can
+	// be looked up by field value as well as by key. Names cannot contain "/"
+	Indexes []string `json:"indexes,omitempty"`
+	//Geo names the fields of object values holding the latitude and longitude of a
+	// record, in decimal degrees, for connectors supporting geospatial lookups
+	Geo *GeoFields `json:"geo,omitempty"`
+	//Search lists the text fields of object values that connectors index for full text
+	// search
+	Search *SearchFields `json:"search,omitempty"`
+}
+
+//GeoFields names the coordinate fields of a ValueSchema
+type GeoFields struct {
+	Lat string `json:"lat"`
+	Lon string `json:"lon"`
+}
+
+//SearchFields names the full text fields of a ValueSchema
+type SearchFields struct {
+	Fields []string `json:"fields"`
+	//Stem reduces English words to their stems, so that "stations" finds "station"
+	Stem bool `json:"stem,omitempty"`
+}
+
+//ParseValueSchema parses and checks a ValueSchema recorded under SchemaKey
+func ParseValueSchema(raw []byte) (ValueSchema, error) {
+	var s ValueSchema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return ValueSchema{}, fmt.Errorf("Error reading value schema: %v", err)
+	}
+	switch s.Codec {
+	case "":
+		s.Codec = CodecAuto
+	case CodecAuto, CodecRaw, CodecJSON, CodecMsgPack:
+	default:
+		return ValueSchema{}, fmt.Errorf("Error reading value schema: unknown codec %q", s.Codec)
+	}
+	for name, typ := range s.Fields {
+		switch typ {
+		case FieldString, FieldNumber, FieldInteger, FieldBool:
+		default:
+			return ValueSchema{}, fmt.Errorf("Error reading value schema: field %q has unknown type %q", name, typ)
+		}
+	}
+	for _, name := range s.Indexes {
+		if name == "" || strings.ContainsAny(name, "/\x00") {
+			return ValueSchema{}, fmt.Errorf("Error reading value schema: invalid index field name %q", name)
+		}
+	}
+	if s.Geo != nil && (s.Geo.Lat == "" || s.Geo.Lon == "") {
+		return ValueSchema{}, fmt.Errorf("Error reading value schema: geo needs both lat and lon field names")
+	}
+	if s.Search != nil && len(s.Search.Fields) == 0 {
+		return ValueSchema{}, fmt.Errorf("Error reading value schema: search needs at least one field")
+	}
+	return s, nil
+}
+
+//Decode returns a stored value as the plain maps, slices, strings, numbers and bools of
+// its JSON form
+func (s ValueSchema) Decode(raw []byte) (interface{}, error) {
+	var v interface{}
+	switch s.Codec {
+	case CodecRaw:
+		return string(raw), nil
+	case CodecJSON:
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("Error decoding JSON value: %v", err)
+		}
+	case CodecMsgPack:
+		var err error
+		if v, err = decodeMsgPack(raw); err != nil {
+			return nil, err
+		}
+	default:
+		trimmed := bytes.TrimSpace(raw)
+		if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+			return string(raw), nil
+		}
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return string(raw), nil
+		}
+	}
+	if obj, ok := v.(map[string]interface{}); ok {
+		for name, typ := range s.Fields {
+			if field, ok := obj[name]; ok {
+				obj[name] = convertField(field, typ)
+			}
+		}
+	}
+	return v, nil
+}
+
+//convertField converts a decoded field to the declared type, leaving it as it is if it
+// cannot be converted
+func convertField(v interface{}, typ string) interface{} {
+	s, isString := v.(string)
+	if !isString {
+		if typ != FieldString {
+			//other codecs may give numbers of other types; bring them into line with JSON
+			if n, ok := v.(json.Number); ok && typ == FieldInteger {
+				if i, err := n.Int64(); err == nil {
+					return i
+				}
+			}
+			return v
+		}
+		if v == nil {
+			return v
+		}
+		return fmt.Sprint(v)
+	}
+	switch typ {
+	case FieldNumber:
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	case FieldInteger:
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+	case FieldBool:
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	}
+	return v
+}
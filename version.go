@@ -0,0 +1,149 @@
+package sdsshared
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+//DatasetProber is implemented by DatasetSources that can report the revision of their
+// archive without downloading it, such as an HTTP ETag or a Cloud Storage generation
+type DatasetProber interface {
+	//Revision returns an opaque token that changes whenever the archive changes
+	Revision(ctx context.Context) (string, error)
+}
+
+//DatasetProbe describes the latest dataset archive available at a source
+type DatasetProbe struct {
+	//Manifest is the manifest stored next to the archive, nil if there is none
+	Manifest *VersionManager
+	//Revision is the source revision token of the archive, empty if the source
+	// cannot report one
+	Revision string
+}
+
+//ProbeDataset finds out what the latest archive at src is without downloading it, using
+// its manifest and, if src implements DatasetProber, its revision token
+func ProbeDataset(ctx context.Context, src DatasetSource) (DatasetProbe, error) {
+	manifest, err := FetchManifest(ctx, src)
+	if err != nil {
+		return DatasetProbe{}, err
+	}
+	probe := DatasetProbe{Manifest: manifest}
+	if prober, ok := src.(DatasetProber); ok {
+		if probe.Revision, err = prober.Revision(ctx); err != nil {
+			return DatasetProbe{}, err
+		}
+	}
+	return probe, nil
+}
+
+//NeedsUpdate judges whether the dataset described by current should be replaced by the
+// archive described by latest. Manifest versions are compared semantically when both
+// are known, otherwise source revisions are compared. If neither can be compared an
+// update is needed
+func (latest DatasetProbe) NeedsUpdate(current VersionManager) bool {
+	if latest.Manifest != nil && latest.Manifest.CurrentVersion != "" && current.CurrentVersion != "" {
+		return CompareVersions(latest.Manifest.CurrentVersion, current.CurrentVersion) > 0
+	}
+	if latest.Revision != "" && current.Revision != "" {
+		return latest.Revision != current.Revision
+	}
+	return true
+}
+
+//CompareVersions compares two dataset version strings and returns -1, 0 or +1 if a is
+// older than, the same as or newer than b.
+//
+//Versions are compared as semantic versions: an optional leading 'v' is ignored, dot
+// separated parts are compared numerically where both are numbers and as text otherwise,
+// missing parts count as zero, and a pre-release suffix after '-' sorts before the release.
+// Date versions such as 2021.12 or 20211208 compare correctly under the same rules. A '-'
+// followed by a digit separates parts like a dot rather than starting a pre-release, so
+// dashed dates such as 2021-12-08 compare as 2021.12.08
+func CompareVersions(a, b string) int {
+	a = strings.TrimPrefix(strings.TrimSpace(a), "v")
+	b = strings.TrimPrefix(strings.TrimSpace(b), "v")
+	//build metadata does not take part in comparisons
+	a = strings.SplitN(a, "+", 2)[0]
+	b = strings.SplitN(b, "+", 2)[0]
+
+	aRel, aPre := splitPreRelease(a)
+	bRel, bPre := splitPreRelease(b)
+	if c := compareParts(strings.Split(aRel, "."), strings.Split(bRel, ".")); c != 0 {
+		return c
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return compareParts(strings.Split(aPre, "."), strings.Split(bPre, "."))
+}
+
+//splitPreRelease splits a version into its release and pre-release parts. Dashes
+// followed by a digit are part separators of the release, as in a dashed date
+func splitPreRelease(v string) (string, string) {
+	for i := 0; i < len(v); i++ {
+		if v[i] != '-' {
+			continue
+		}
+		if i+1 < len(v) && v[i+1] >= '0' && v[i+1] <= '9' {
+			v = v[:i] + "." + v[i+1:]
+			continue
+		}
+		return v[:i], v[i+1:]
+	}
+	return v, ""
+}
+
+//compareParts compares version identifiers pairwise
+func compareParts(a, b []string) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		ap, bp := "0", "0"
+		if i < len(a) {
+			ap = a[i]
+		}
+		if i < len(b) {
+			bp = b[i]
+		}
+		an, aErr := strconv.ParseUint(ap, 10, 64)
+		bn, bErr := strconv.ParseUint(bp, 10, 64)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		//numeric identifiers sort before text ones
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(ap, bp); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+type forceUpdateKey struct{}
+
+//WithForceUpdate returns a context asking UpdateDatasetContext to reload the dataset
+// even if the version check says it is up to date
+func WithForceUpdate(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceUpdateKey{}, true)
+}
+
+//ForceUpdate reports whether ctx was created by WithForceUpdate
+func ForceUpdate(ctx context.Context) bool {
+	force, _ := ctx.Value(forceUpdateKey{}).(bool)
+	return force
+}
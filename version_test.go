@@ -0,0 +1,60 @@
+package sdsshared
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.10.0", "1.9.2", 1},
+		{"1.9.2", "1.10.0", -1},
+		{"2021.12", "2021.9", 1},
+		{"20211208", "20211130", 1},
+		{"1.0.0", "1.0.0-rc1", 1},
+		{"1.0.0-rc1", "1.0.0", -1},
+		{"1.0.0-rc.10", "1.0.0-rc.9", 1},
+		{"1.0.0-alpha", "1.0.0-beta", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.1", 0},
+		{"v1.2", "1.2.0", 0},
+		{" V1.2 ", "1.2", 1},
+		{"1.2.0+build5", "1.2.0+build6", 0},
+		{"2021-12-08", "2021", 1},
+		{"2021-12-08", "2021-12-09", -1},
+		{"2021-12-10", "2021-12-9", 1},
+		{"2021-12-08", "2021.12.8", 0},
+		{"2021-12-08-rc1", "2021-12-08", -1},
+		{"1.0.x", "1.0.1", 1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNeedsUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		latest  DatasetProbe
+		current VersionManager
+		want    bool
+	}{
+		{"newer manifest version", DatasetProbe{Manifest: &VersionManager{CurrentVersion: "1.10.0"}}, VersionManager{CurrentVersion: "1.9.2"}, true},
+		{"same manifest version", DatasetProbe{Manifest: &VersionManager{CurrentVersion: "1.2"}}, VersionManager{CurrentVersion: "v1.2.0"}, false},
+		{"older manifest version", DatasetProbe{Manifest: &VersionManager{CurrentVersion: "1.0.0"}}, VersionManager{CurrentVersion: "1.1.0"}, false},
+		//the manifest version decides even when the revision changed
+		{"manifest over revision", DatasetProbe{Manifest: &VersionManager{CurrentVersion: "2"}, Revision: "b"}, VersionManager{CurrentVersion: "2", Revision: "a"}, false},
+		{"revision changed", DatasetProbe{Revision: "b"}, VersionManager{CurrentVersion: "2", Revision: "a"}, true},
+		{"revision unchanged", DatasetProbe{Revision: "a"}, VersionManager{CurrentVersion: "2", Revision: "a"}, false},
+		{"manifest without version", DatasetProbe{Manifest: &VersionManager{}, Revision: "a"}, VersionManager{CurrentVersion: "2", Revision: "a"}, false},
+		{"no current version", DatasetProbe{Manifest: &VersionManager{CurrentVersion: "2"}, Revision: "a"}, VersionManager{Revision: "a"}, false},
+		{"no current revision", DatasetProbe{Revision: "a"}, VersionManager{CurrentVersion: "2"}, true},
+		{"nothing known", DatasetProbe{}, VersionManager{CurrentVersion: "2"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.latest.NeedsUpdate(tt.current); got != tt.want {
+			t.Errorf("%s: NeedsUpdate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}